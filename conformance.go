@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/turntest"
+)
+
+// runConformance checks the first -turn server against the TURN specs with -u, -p, -insecure and -family,
+// or how it stands crafted and abusive requests with -robustness, prints a pass/fail/skip matrix and fails
+// when any check fails
+func runConformance(args []string) error {
+	var checks, jsonFile string
+	var robustness bool
+	var maxAllocations int
+
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	fs.StringVar(&checks, "checks", "", "Comma separated checks to run, all when empty: "+strings.Join(turntest.CheckNames(), ",")+
+		" or with -robustness: "+strings.Join(turntest.RobustnessCheckNames(), ","))
+	fs.StringVar(&jsonFile, "json", "", "File to write the results to as JSON, stdout after the matrix when empty")
+	fs.BoolVar(&robustness, "robustness", false, "Send crafted and abusive requests instead, only to servers you own")
+	fs.IntVar(&maxAllocations, "maxalloc", 100, "Allocations the quota check of -robustness makes waiting for 486")
+	fs.Parse(args)
+
+	servers, err := parseTurnServers()
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("-turn is required")
+	}
+
+	clientFamily, err := turntest.ParseAddressFamily(family)
+	if err != nil {
+		return err
+	}
+
+	f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevel(reqLogLvl)}
+	req := &turntest.ConformanceRequestST{
+		Log:            f.NewLogger("conformance"),
+		TurnServerAddr: servers[0].Addr,
+		Username:       username,
+		Password:       password,
+		ClientFamily:   clientFamily,
+		MaxAllocations: maxAllocations,
+	}
+	if servers[0].Username != "" {
+		req.Username = servers[0].Username
+		req.Password = servers[0].Password
+	}
+	if tlsInsecure {
+		req.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req.Ctx = ctx
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	check, title := turntest.CheckConformance, "Conformance"
+	if robustness {
+		check, title = turntest.CheckRobustness, "Robustness"
+	}
+
+	results, err := check(req, splitList(checks)...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s of %v\n", title, req.TurnServerAddr)
+	failed := 0
+	for _, result := range results {
+		fmt.Printf("  %-22s %-5s %s\n", result.Name, result.Status, result.Detail)
+		if result.Status == turntest.CHECK_FAIL {
+			failed++
+		}
+	}
+
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if jsonFile == "" {
+		fmt.Println(string(data))
+	} else if err = ioutil.WriteFile(jsonFile, data, 0644); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
@@ -2,11 +2,13 @@ package dispose
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/impair"
 	"github.com/xylophone21/go-turn-test/statistics"
 	"github.com/xylophone21/go-turn-test/stuntest"
 	"github.com/xylophone21/go-turn-test/turntest"
@@ -31,19 +33,48 @@ type DisposeRequestST struct {
 	Duration    time.Duration
 	PackageSize int32
 	PackageWait time.Duration
-	StatLogLvl  int
-	ReqLogLvl   int
+	Bitrate     int64                     // optional, bits per second each channel sends instead of PackageWait
+	PacketRate  float64                   // optional, packages per second each channel sends instead of PackageWait
+	Burst       int                       // optional, packages sent back-to-back to catch up
+	Profiles    []turntest.TrafficProfile // traffic of the channels in turn, e.g. {AUDIO, AUDIO, VIDEO} mixes 2:1, fixed when empty
+	Rtp         bool                      // frame packages as RTP with RTCP reports, adds loss, jitter and rtt to the summary
+	Echo        bool                      // the far peer reflects packages, latencies are round trip times
+	Bidir       bool                      // both ends of each channel send, the summary has each direction
+	FanOut      int                       // optional, each allocation sends to this many peers, the summary has each peer (1-cloud)
+	Family      turntest.AddressFamily    // optional, family of the sockets to the TURN and STUN servers
+	RelayFamily turntest.AddressFamily    // optional, family of the relayed addresses asked for, the local peers follow it
+	Dual        bool                      // ask for IPv4 and IPv6 relayed addresses in one allocation, the summary has each family (1-cloud)
+	Impair      *impair.Config            // optional, impairs the packets every channel sends
+
+	StunReuse       bool              // STUN channels keep one socket for all their requests instead of a new 5-tuple each
+	StunQps         float64           // optional, STUN requests per second of all channels together started open loop, back-to-back when 0
+	StunRto         time.Duration     // optional, open loop STUN retransmission timeout, else only the wait before dialing again
+	StunRetransmits int               // optional, open loop STUN retransmits of a request without response, only with StunQps
+	StunTimeout     time.Duration     // optional, open loop STUN wait for a response, unused without StunQps
+	Peers           *turntest.PeerHub // optional, remote peers registered with it are the far ends of the channels
+	StatLogLvl      int
+	ReqLogLvl       int
 
 	Mode DisposeMode
 
 	Source         DisposeSource
-	StunServerAddr string // STUN server address (e.g. "stun.abc.com:3478")
-	TurnServerAddr string // TURN server addrees (e.g. "turn.abc.com:3478")
+	StunServerAddr string              // STUN server address (e.g. "stun.abc.com:3478", "stun:stun.abc.com" or "stuns:stun.abc.com:443")
+	TurnServerAddr string              // TURN server addrees (e.g. "turn.abc.com:3478" or "turns:turn.abc.com:443?transport=tcp")
+	TlsInsecure    bool                // skip certificate verification of turns: and stuns: servers
+	TurnServers    []TurnServerST      // several TURN servers sharing the channels, instead of TurnServerAddr
+	Distribution   DisposeDistribution // how channels are shared by TurnServers
 	Username       string
 	Password       string
+	AuthSecret     string        // TURN REST API shared secret, Username (optional) becomes the user part when set
+	AuthTTL        time.Duration // lifetime of TURN REST API credentials
+	OAuthUrl       string        // authorization server issuing RFC 7635 access tokens, used instead of Username/Password when set
+	OAuthClientId  string
 
 	AwsDeviceId string
 	AwsToken    string
+	AwsApiUrl   string // optional, provider api instead of the UAT one (e.g. a mock-provider)
+
+	Summary *statistics.Summary // filled with the final statistics when not nil
 }
 
 func checkAndDefaultRequest(req *DisposeRequestST) error {
@@ -51,7 +82,11 @@ func checkAndDefaultRequest(req *DisposeRequestST) error {
 		return fmt.Errorf("req nil")
 	}
 
-	if req.Method == METHOD_TURN && req.Source == SOURCE_BASE && req.TurnServerAddr == "" {
+	if len(req.TurnServers) == 0 && req.TurnServerAddr != "" {
+		req.TurnServers = []TurnServerST{{Addr: req.TurnServerAddr, Weight: 1}}
+	}
+
+	if req.Method == METHOD_TURN && req.Source == SOURCE_BASE && len(req.TurnServers) == 0 {
 		return fmt.Errorf("base mode without turn server")
 	}
 
@@ -59,10 +94,32 @@ func checkAndDefaultRequest(req *DisposeRequestST) error {
 		return fmt.Errorf("base mode without stun server")
 	}
 
+	if req.Method == METHOD_TURN && req.Source == SOURCE_BASE {
+		for i := range req.TurnServers {
+			if _, err := turntest.ParseTurnURI(req.TurnServers[i].Addr); err != nil {
+				return err
+			}
+
+			if req.Distribution == DISTRIBUTION_WEIGHTED && req.TurnServers[i].Weight <= 0 {
+				return fmt.Errorf("weight %d of %s is not positive", req.TurnServers[i].Weight, req.TurnServers[i].Addr)
+			}
+		}
+	}
+
+	if req.StunServerAddr != "" {
+		if _, err := turntest.ParseStunURI(req.StunServerAddr); err != nil {
+			return err
+		}
+	}
+
 	if req.ChanCount == 0 {
 		req.ChanCount = 5
 	}
 
+	if req.StunQps < 0 || req.StunRetransmits < 0 || req.StunQps == 0 && req.StunRetransmits > 0 {
+		return fmt.Errorf("negative STUN qps or retransmits")
+	}
+
 	if req.Duration <= 0 {
 		req.Duration = time.Second * 30
 	}
@@ -79,6 +136,10 @@ func checkAndDefaultRequest(req *DisposeRequestST) error {
 		req.StatLogLvl = int(logging.LogLevelInfo)
 	}
 
+	if req.AuthSecret != "" && req.AuthTTL <= 0 {
+		req.AuthTTL = time.Hour * 24
+	}
+
 	if req.ReqLogLvl <= 0 {
 		req.ReqLogLvl = int(logging.LogLevelWarn)
 	}
@@ -114,6 +175,7 @@ func Dispose(req *DisposeRequestST) error {
 		Log:       statisticsLog,
 		ChanCount: req.ChanCount,
 		Ch:        ch,
+		Summary:   req.Summary,
 	}
 
 	go func() {
@@ -124,34 +186,77 @@ func Dispose(req *DisposeRequestST) error {
 	var awsTurn *turntest.AwsTurnsServers
 	index := 0
 
+	// the channels renew their credentials from one shared fetch
+	awsCache := turntest.NewAwsCredentialCache(&turntest.RequestBody{
+		DeviceId: req.AwsDeviceId,
+		Token:    req.AwsToken,
+		ApiUrl:   req.AwsApiUrl,
+	})
+
+	picker := newServerPicker(req.TurnServers, req.Distribution)
+
 	for i := uint64(0); i < req.ChanCount; i++ {
 		if req.Method == METHOD_TURN {
 			turnReq := &turntest.TrunRequestST{
-				Ctx:         ctx,
-				Log:         reqLog,
-				ChanId:      i,
-				PackageSize: req.PackageSize,
-				PackageWait: req.PackageWait,
-				Ch:          ch,
+				Ctx:            ctx,
+				Log:            reqLog,
+				ChanId:         i,
+				PackageSize:    req.PackageSize,
+				PackageWait:    req.PackageWait,
+				Bitrate:        req.Bitrate,
+				PacketRate:     req.PacketRate,
+				Burst:          req.Burst,
+				Rtp:            req.Rtp,
+				Echo:           req.Echo,
+				Bidirectional:  req.Bidir,
+				PeerCount:      req.FanOut,
+				ClientFamily:   req.Family,
+				RelayFamily:    req.RelayFamily,
+				DualAllocation: req.Dual,
+				Impair:         req.Impair,
+				Peers:          req.Peers,
+				Ch:             ch,
+			}
+
+			if len(req.Profiles) > 0 {
+				turnReq.Profile = req.Profiles[i%uint64(len(req.Profiles))]
+			}
+
+			if req.TlsInsecure {
+				turnReq.TlsConfig = &tls.Config{InsecureSkipVerify: true}
 			}
 
 			if req.Source == SOURCE_BASE {
+				server := picker.pick()
+				username, password := req.Username, req.Password
+				if server.Username != "" {
+					username, password = server.Username, server.Password
+				}
+
 				turnReq.StunServerAddr = req.StunServerAddr
-				turnReq.TurnServerAddr = req.TurnServerAddr
-				turnReq.Username = req.Username
-				turnReq.Password = req.Password
+				turnReq.TurnServerAddr = server.Addr
+				turnReq.OAuthUrl = req.OAuthUrl
+				turnReq.OAuthClientId = req.OAuthClientId
+				if req.AuthSecret != "" {
+					turnReq.Credential = turntest.RestCredential(req.AuthSecret, username, req.AuthTTL)
+				} else {
+					turnReq.Username = username
+					turnReq.Password = password
+				}
 			} else {
 				if awsTurn == nil || index >= len(awsTurn.TurnServerAddrs) {
-					var err error
 					awsReq := &turntest.RequestBody{
 						DeviceId: req.AwsDeviceId,
 						Token:    req.AwsToken,
+						ApiUrl:   req.AwsApiUrl,
 					}
 					awsTurn, err = turntest.AllocAwsTurns(awsReq)
+					if err == nil && len(awsTurn.TurnServerAddrs) == 0 {
+						err = fmt.Errorf("no turn server from aws")
+					}
 					if err != nil {
 						reqLog.Errorf("AllocAwsTurns error:%v", err)
 						canceled()
-						wg.Done()
 						break
 					}
 					index = 0
@@ -161,6 +266,8 @@ func Dispose(req *DisposeRequestST) error {
 				turnReq.TurnServerAddr = awsTurn.TurnServerAddrs[index].TurnServerAddr
 				turnReq.Username = awsTurn.TurnServerAddrs[index].Username
 				turnReq.Password = awsTurn.TurnServerAddrs[index].Password
+				turnReq.Expired = awsTurn.TurnServerAddrs[index].Expired
+				turnReq.Credential = awsCache.Credential(index)
 				index++
 			}
 
@@ -171,26 +278,34 @@ func Dispose(req *DisposeRequestST) error {
 			}
 		} else if req.Method == METHOD_STUN {
 			stunReq := &stuntest.StunRequestST{
-				Ctx:    ctx,
-				Log:    reqLog,
-				ChanId: i,
-				Ch:     ch,
+				Ctx:         ctx,
+				Log:         reqLog,
+				ChanId:      i,
+				Family:      req.Family,
+				ReuseSocket: req.StunReuse,
+				Qps:         req.StunQps / float64(req.ChanCount),
+				Rto:         req.StunRto,
+				Retransmits: req.StunRetransmits,
+				Timeout:     req.StunTimeout,
+				Ch:          ch,
+			}
+			if req.TlsInsecure {
+				stunReq.TlsConfig = &tls.Config{InsecureSkipVerify: true}
 			}
 
 			if req.Source == SOURCE_BASE {
 				stunReq.StunServerAddr = req.StunServerAddr
 			} else {
 				if awsTurn == nil {
-					var err error
 					awsReq := &turntest.RequestBody{
 						DeviceId: req.AwsDeviceId,
 						Token:    req.AwsToken,
+						ApiUrl:   req.AwsApiUrl,
 					}
 					awsTurn, err = turntest.AllocAwsTurns(awsReq)
 					if err != nil {
 						reqLog.Errorf("AllocAwsTurns error:%v", err)
 						canceled()
-						wg.Done()
 						break
 					}
 				}
@@ -201,6 +316,7 @@ func Dispose(req *DisposeRequestST) error {
 			go stuntest.StunRequest(stunReq)
 		} else {
 			err = fmt.Errorf("error method")
+			canceled()
 			break
 		}
 
@@ -210,5 +326,5 @@ func Dispose(req *DisposeRequestST) error {
 	wg.Wait()
 	canceled()
 
-	return nil
+	return err
 }
@@ -1,79 +1,372 @@
 package dispose
 
 import (
-	"fmt"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/impair"
+	"github.com/xylophone21/go-turn-test/statistics"
 	"github.com/xylophone21/go-turn-test/testdata"
+	"github.com/xylophone21/go-turn-test/testserver"
+	"github.com/xylophone21/go-turn-test/turntest"
 )
 
+const (
+	testUsername = "user"
+	testPassword = "pass"
+	testSecret   = "secret"
+)
+
+func startTestServer(t *testing.T) *testserver.Server {
+	return testserver.StartTest(t, &testserver.ServerConfig{
+		Users:      map[string]string{testUsername: testPassword},
+		AuthSecret: testSecret,
+	})
+}
+
+func makeDisposeRequestST(method DisposeMethod, mode DisposeMode) *DisposeRequestST {
+	return &DisposeRequestST{
+		ChanCount:   3,
+		Method:      method,
+		Mode:        mode,
+		Source:      SOURCE_BASE,
+		Duration:    time.Second * 2,
+		PackageWait: time.Millisecond * 50,
+		StatLogLvl:  int(logging.LogLevelWarn),
+		ReqLogLvl:   int(logging.LogLevelWarn),
+		Summary:     &statistics.Summary{},
+	}
+}
+
+// checkSummary fails unless every channel delivered packages
+func checkSummary(t *testing.T, req *DisposeRequestST) {
+	if err := Dispose(req); err != nil {
+		t.Fatalf("Dispose error:%v", err)
+	}
+
+	sum := req.Summary
+	t.Logf("summary:%+v", sum)
+
+	if sum.SuccessedChanCount != int(req.ChanCount) || sum.RecvCount == 0 || sum.RecvCount < sum.SentCount/2 {
+		t.Fatalf("unexpected summary:%+v", sum)
+	}
+}
+
 func TestBasic(t *testing.T) {
-	req := &DisposeRequestST{
-		StatLogLvl:     int(logging.LogLevelTrace),
-		ReqLogLvl:      int(logging.LogLevelTrace),
-		Mode:           MODE_1CLOUD,
-		Source:         SOURCE_BASE,
-		StunServerAddr: testdata.BasicStunUrl,
-		TurnServerAddr: testdata.BasicTurnUrl,
-		Username:       testdata.BasicTurnUsername,
-		Password:       testdata.BasicTurnPassword,
-		Duration:       time.Second * 10,
-	}
-
-	err := Dispose(req)
-	if err != nil {
-		fmt.Printf("Dispose error:%v", err)
-		t.Fail()
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.TurnServerAddr = server.UDPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+
+	checkSummary(t, req)
+}
+
+func TestBase2Cloud(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_2CLOUD)
+	req.TurnServerAddr = server.TCPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+
+	checkSummary(t, req)
+}
+
+func TestRestSecret(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.TurnServerAddr = server.TLSURI()
+	req.TlsInsecure = true
+	req.AuthSecret = testSecret
+
+	checkSummary(t, req)
+}
+
+func TestServers(t *testing.T) {
+	server1 := startTestServer(t)
+	server2 := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.ChanCount = 4
+	req.TurnServers = []TurnServerST{{Addr: server1.UDPURI()}, {Addr: server2.UDPURI()}}
+	req.Username = testUsername
+	req.Password = testPassword
+
+	checkSummary(t, req)
+}
+
+func TestBitrate(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_2CLOUD)
+	req.TurnServerAddr = server.UDPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+	req.Bitrate = 2000000
+
+	checkSummary(t, req)
+
+	// kbps are counted by 1024 bits, the pacing itself is checked on a virtual clock by the turntest tests
+	target := 2000000 / 1024
+	if req.Summary.TargetKbps != target || req.Summary.SentKbps < target*3/4 || req.Summary.SentKbps > target*5/4 {
+		t.Fatalf("sent %d kbps for target %d kbps", req.Summary.SentKbps, req.Summary.TargetKbps)
 	}
 }
 
-func TestAws(t *testing.T) {
-	req := &DisposeRequestST{
-		StatLogLvl: int(logging.LogLevelTrace),
-		ReqLogLvl:  int(logging.LogLevelTrace),
-		Mode:       MODE_1CLOUD,
-		Source:     SOURCE_AWS,
+func TestProfiles(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.ChanCount = 4
+	req.TurnServerAddr = server.UDPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+	req.Profiles = []turntest.TrafficProfile{turntest.PROFILE_AUDIO, turntest.PROFILE_AUDIO, turntest.PROFILE_VIDEO, turntest.PROFILE_SCREEN}
+
+	checkSummary(t, req)
+
+	wants := map[string]int{"audio": 2, "video": 1, "screen": 1}
+	for name, chans := range wants {
+		profile := req.Summary.Profiles[name]
+		if profile == nil || profile.ChanCount != chans || profile.RecvCount == 0 {
+			t.Fatalf("profile %s:%+v", name, profile)
+		}
+	}
+
+	// video sends far more than audio
+	if req.Summary.Profiles["video"].Kbps < req.Summary.Profiles["audio"].Kbps*10 {
+		t.Fatalf("video %d kbps, audio %d kbps", req.Summary.Profiles["video"].Kbps, req.Summary.Profiles["audio"].Kbps)
+	}
+}
+
+func TestImpair(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.Duration = time.Second * 4
+	req.PackageWait = time.Millisecond * 10
+	req.TurnServerAddr = server.UDPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+	req.Impair = &impair.Config{Loss: 20, Delay: time.Millisecond * 50}
+
+	if err := Dispose(req); err != nil {
+		t.Fatalf("Dispose error:%v", err)
+	}
+
+	// the loss hits the setup too, so some channel may not come up, the others tell the impairments,
+	// packages still in flight at the end count as lost too
+	sum := req.Summary
+	if sum.SuccessedChanCount == 0 || sum.Loss < 10 || sum.Loss > 30 || sum.AvgLatency < time.Millisecond*50 {
+		t.Fatalf("statistics don't show the impairments:%+v", sum)
+	}
+}
+
+func makeRtpRequestST(t *testing.T, cfg *impair.Config) *DisposeRequestST {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.Duration = time.Second * 4
+	req.PackageWait = time.Millisecond * 10
+	req.TurnServerAddr = server.UDPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+	req.Rtp = true
+	req.Impair = cfg
+
+	if err := Dispose(req); err != nil {
+		t.Fatalf("Dispose error:%v", err)
+	}
+	t.Logf("summary:%+v", req.Summary)
+
+	return req
+}
+
+// the impairments apply to the setup and the RTCP reports too, so loss is checked apart from the
+// round trip time, which needs a sender report and the receiver report answering it to go through
+func TestRtp(t *testing.T) {
+	// some channel may not come up through the loss, the RTP loss is of the ones that did
+	req := makeRtpRequestST(t, &impair.Config{Loss: 20})
+	if sum := req.Summary; sum.SuccessedChanCount == 0 || sum.RtpLoss < 10 || sum.RtpLoss > 30 {
+		t.Fatalf("rtp loss %v of 20%% over %d channels", sum.RtpLoss, sum.SuccessedChanCount)
+	}
+
+	// each of the sender and receiver reports takes the delay once
+	cfg := &impair.Config{Delay: time.Millisecond * 50, Jitter: time.Millisecond * 10}
+	req = makeRtpRequestST(t, cfg)
+	if req.Summary.SuccessedChanCount != int(req.ChanCount) {
+		t.Fatalf("%d of %d channels", req.Summary.SuccessedChanCount, req.ChanCount)
+	}
+
+	minRtt, maxRtt := 2*(cfg.Delay-cfg.Jitter), 2*(cfg.Delay+cfg.Jitter)+time.Millisecond*20
+	if sum := req.Summary; sum.AvgJitter < time.Millisecond || sum.AvgRtt < minRtt || sum.AvgRtt > maxRtt {
+		t.Fatalf("rtp jitter %v rtt %v, want rtt in [%v, %v]", sum.AvgJitter, sum.AvgRtt, minRtt, maxRtt)
+	}
+}
+
+func TestBidirectional(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_2CLOUD)
+	req.TurnServerAddr = server.UDPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+	req.Bidir = true
+
+	checkSummary(t, req)
+
+	if req.Summary.SentKbps < req.Summary.TargetKbps*9/10 {
+		t.Fatalf("sent %d kbps for target %d kbps", req.Summary.SentKbps, req.Summary.TargetKbps)
 	}
 
-	err := Dispose(req)
+	for _, name := range []string{turntest.DIRECTION_UP, turntest.DIRECTION_DOWN} {
+		dir := req.Summary.Directions[name]
+		if dir == nil || dir.ChanCount != int(req.ChanCount) || dir.RecvCount < dir.SentCount*9/10 || dir.Kbps == 0 {
+			t.Fatalf("direction %s:%+v", name, dir)
+		}
+	}
+}
+
+func TestFanout(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.TurnServerAddr = server.UDPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+	req.FanOut = 5
+
+	checkSummary(t, req)
+
+	for peer := 1; peer <= req.FanOut; peer++ {
+		group := req.Summary.Peers[strconv.Itoa(peer)]
+		if group == nil || group.ChanCount != int(req.ChanCount) || group.RecvCount < group.SentCount*9/10 {
+			t.Fatalf("peer %d:%+v", peer, group)
+		}
+	}
+
+	// peers 1, 2-3 and 4-7 of each channel
+	for _, method := range []string{turntest.SETUP_CREATE_PERMISSION, turntest.SETUP_CHANNEL_BIND} {
+		buckets := req.Summary.Setups[method]
+		if len(buckets) != 3 || buckets[1].Count != 3 || buckets[2].Count != 6 || buckets[4].Count != 6 || buckets[4].AvgLatency <= 0 {
+			t.Fatalf("%s setups:%v", method, buckets)
+		}
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	server, err := testserver.Start(&testserver.ServerConfig{
+		Users:     map[string]string{testUsername: testPassword},
+		DualStack: true,
+		RelayIPv6: true,
+	})
 	if err != nil {
-		fmt.Printf("Dispose error:%v", err)
-		t.Fail()
+		t.Skipf("no IPv6 loopback, testserver.Start error:%v", err)
 	}
+	defer server.Close()
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_2CLOUD)
+	req.TurnServerAddr = server.UDP6URI()
+	req.Username = testUsername
+	req.Password = testPassword
+	req.Family = turntest.FAMILY_IPV6
+	req.RelayFamily = turntest.FAMILY_IPV6
+
+	checkSummary(t, req)
 }
 
-func TestBase2Cloud(t *testing.T) {
-	req := &DisposeRequestST{
-		StatLogLvl:     int(logging.LogLevelTrace),
-		ReqLogLvl:      int(logging.LogLevelTrace),
-		Mode:           MODE_2CLOUD,
-		Source:         SOURCE_BASE,
-		StunServerAddr: testdata.BasicStunUrl,
-		TurnServerAddr: testdata.BasicTurnUrl,
-		Username:       testdata.BasicTurnUsername,
-		Password:       testdata.BasicTurnPassword,
-	}
-
-	err := Dispose(req)
+func TestDualAllocation(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.TurnServerAddr = server.UDPURI()
+	req.Username = testUsername
+	req.Password = testPassword
+	req.Dual = true
+
+	checkSummary(t, req)
+
+	// pion/turn relays IPv4 only
+	v4 := req.Summary.Families[turntest.FAMILY_IPV4.String()]
+	v6 := req.Summary.Families[turntest.FAMILY_IPV6.String()]
+	if v4 == nil || v4.RecvCount < v4.SentCount*9/10 || v6 == nil || v6.SentCount != 0 || v6.FailedCount == 0 {
+		t.Fatalf("families ipv4:%+v ipv6:%+v", v4, v6)
+	}
+	if req.Summary.ErrCodes[turntest.ERRCODE_RELAY_FAMILY] == 0 {
+		t.Fatalf("missing family not reported:%v", req.Summary.ErrCodes)
+	}
+}
+
+func TestStun(t *testing.T) {
+	server := startTestServer(t)
+
+	req := makeDisposeRequestST(METHOD_STUN, MODE_1CLOUD)
+	req.StunServerAddr = server.UDPAddr
+
+	checkSummary(t, req)
+}
+
+// setAwsSource points req at the real provider when deviceId and token are set, a local mock provider otherwise
+func setAwsSource(t *testing.T, req *DisposeRequestST) {
+	req.Source = SOURCE_AWS
+
+	if testdata.AwsDeviceId != "" {
+		req.AwsDeviceId = testdata.AwsDeviceId
+		req.AwsToken = testdata.AwsToken
+		req.AwsApiUrl = testdata.AwsApiUrl
+		return
+	}
+
+	provider, err := testserver.StartProvider(nil)
 	if err != nil {
-		fmt.Printf("Dispose error:%v", err)
-		t.Fail()
+		t.Fatalf("StartProvider error:%v", err)
 	}
+	t.Cleanup(func() { provider.Close() })
+
+	req.AwsDeviceId = "device"
+	req.AwsApiUrl = provider.URL
+}
+
+func TestAws(t *testing.T) {
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	setAwsSource(t, req)
+
+	checkSummary(t, req)
 }
 
 func TestAws2Cloud(t *testing.T) {
-	req := &DisposeRequestST{
-		StatLogLvl: int(logging.LogLevelTrace),
-		ReqLogLvl:  int(logging.LogLevelTrace),
-		Mode:       MODE_2CLOUD,
-		Source:     SOURCE_AWS,
-	}
+	req := makeDisposeRequestST(METHOD_TURN, MODE_2CLOUD)
+	setAwsSource(t, req)
+
+	checkSummary(t, req)
+}
 
-	err := Dispose(req)
+func TestAwsStun(t *testing.T) {
+	req := makeDisposeRequestST(METHOD_STUN, MODE_1CLOUD)
+	setAwsSource(t, req)
+
+	checkSummary(t, req)
+}
+
+func TestAwsError(t *testing.T) {
+	provider, err := testserver.StartProvider(&testserver.ProviderConfig{
+		Replies: []testserver.ProviderReply{{Code: 1001, Message: "no device"}},
+	})
 	if err != nil {
-		fmt.Printf("Dispose error:%v", err)
-		t.Fail()
+		t.Fatalf("StartProvider error:%v", err)
+	}
+	defer provider.Close()
+
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.Source = SOURCE_AWS
+	req.AwsApiUrl = provider.URL
+
+	if err := Dispose(req); err == nil {
+		t.Fatalf("Dispose should fail")
 	}
 }
@@ -0,0 +1,53 @@
+package dispose
+
+type DisposeDistribution int32
+
+const (
+	DISTRIBUTION_ROUND_ROBIN DisposeDistribution = 0
+	DISTRIBUTION_WEIGHTED    DisposeDistribution = 1
+)
+
+type TurnServerST struct {
+	Addr     string // TURN server address or URI, same as DisposeRequestST.TurnServerAddr
+	Weight   int    // share of channels in DISTRIBUTION_WEIGHTED, must be positive there
+	Username string // optional, DisposeRequestST.Username when empty
+	Password string
+}
+
+// serverPicker hands out servers to channels, in turn or by smooth weighted round-robin
+type serverPicker struct {
+	servers      []TurnServerST
+	distribution DisposeDistribution
+	current      []int
+	next         int
+}
+
+func newServerPicker(servers []TurnServerST, distribution DisposeDistribution) *serverPicker {
+	return &serverPicker{
+		servers:      servers,
+		distribution: distribution,
+		current:      make([]int, len(servers)),
+	}
+}
+
+func (p *serverPicker) pick() *TurnServerST {
+	if p.distribution != DISTRIBUTION_WEIGHTED {
+		server := &p.servers[p.next%len(p.servers)]
+		p.next++
+		return server
+	}
+
+	total := 0
+	best := 0
+	for i := range p.servers {
+		p.current[i] += p.servers[i].Weight
+		total += p.servers[i].Weight
+
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= total
+
+	return &p.servers[best]
+}
@@ -0,0 +1,40 @@
+package dispose
+
+import "testing"
+
+func TestServerPicker(t *testing.T) {
+	servers := []TurnServerST{
+		{Addr: "a", Weight: 3},
+		{Addr: "b", Weight: 1},
+	}
+
+	counts := make(map[string]int)
+	picker := newServerPicker(servers, DISTRIBUTION_WEIGHTED)
+	for i := 0; i < 8; i++ {
+		counts[picker.pick().Addr]++
+	}
+
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Fatalf("weighted error:%v", counts)
+	}
+
+	picker = newServerPicker(servers, DISTRIBUTION_ROUND_ROBIN)
+	order := ""
+	for i := 0; i < 4; i++ {
+		order += picker.pick().Addr
+	}
+
+	if order != "abab" {
+		t.Fatalf("round robin error:%s", order)
+	}
+}
+
+func TestServerWeights(t *testing.T) {
+	req := makeDisposeRequestST(METHOD_TURN, MODE_1CLOUD)
+	req.Distribution = DISTRIBUTION_WEIGHTED
+	req.TurnServers = []TurnServerST{{Addr: "turn:127.0.0.1", Weight: 1}, {Addr: "turn:127.0.0.2", Weight: 0}}
+
+	if err := Dispose(req); err == nil {
+		t.Fatalf("weight 0 accepted")
+	}
+}
@@ -0,0 +1,290 @@
+// Package impair 模拟弱网 (丢包, 延迟, 抖动, 重复, 乱序, 带宽限制), 无需 root 权限的 tc netem
+package impair
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReorderDelay = time.Millisecond * 20
+	defaultQueueDelay   = time.Millisecond * 200
+)
+
+var errConnClosed = errors.New("use of closed impaired connection")
+
+// Config describes the impairments applied to packets written to a connection,
+// percents are 0-100 and zero values disable the impairment
+type Config struct {
+	Loss float64 // random loss in percent
+
+	// Gilbert-Elliott bursty loss, enabled when GoodToBad > 0
+	GoodToBad float64 // percent chance to enter the bad state per packet
+	BadToGood float64 // percent chance to leave the bad state per packet
+	GoodLoss  float64 // loss in percent in the good state
+	BadLoss   float64 // loss in percent in the bad state
+
+	Delay        time.Duration // fixed one-way delay
+	Jitter       time.Duration // delay varies uniformly in [Delay-Jitter, Delay+Jitter]
+	Duplicate    float64       // percent of packets sent twice
+	Reorder      float64       // percent of packets held back by ReorderDelay so later ones overtake them
+	ReorderDelay time.Duration // default 20ms
+
+	Bandwidth  int64         // link rate in bits per second
+	QueueDelay time.Duration // packets waiting longer than this for the link are dropped, default 200ms
+
+	Seed int64 // random seed, zero for a time based one
+}
+
+// Enabled tells if cfg impairs anything
+func (cfg *Config) Enabled() bool {
+	if cfg == nil {
+		return false
+	}
+
+	return cfg.Loss > 0 || cfg.GoodToBad > 0 || cfg.Delay > 0 || cfg.Jitter > 0 ||
+		cfg.Duplicate > 0 || cfg.Reorder > 0 || cfg.Bandwidth > 0
+}
+
+// Stats counts what the impairments did to the written packets
+type Stats struct {
+	Written    uint64 // packets given to WriteTo
+	Lost       uint64 // dropped by random or bursty loss
+	Overflowed uint64 // dropped by the bandwidth queue
+	Duplicated uint64
+	Reordered  uint64
+}
+
+type packet struct {
+	buf  []byte
+	addr net.Addr
+	due  time.Time
+	seq  uint64
+}
+
+// packetQueue is a heap of packets by due time, then by write order
+type packetQueue []*packet
+
+func (q packetQueue) Len() int { return len(q) }
+
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+
+func (q packetQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packetQueue) Push(x interface{}) { *q = append(*q, x.(*packet)) }
+
+func (q *packetQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
+
+// Conn impairs the packets written to the wrapped net.PacketConn, reading is untouched
+type Conn struct {
+	net.PacketConn
+
+	cfg      Config
+	lock     sync.Mutex
+	rand     *rand.Rand
+	bad      bool      // Gilbert-Elliott state
+	linkFree time.Time // when the emulated link finishes sending the queued packets
+	queue    packetQueue
+	seq      uint64
+	stats    Stats
+	wakeup   chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// Wrap returns conn impaired by cfg, or conn itself when cfg impairs nothing
+func Wrap(conn net.PacketConn, cfg *Config) net.PacketConn {
+	if !cfg.Enabled() {
+		return conn
+	}
+
+	c := &Conn{
+		PacketConn: conn,
+		cfg:        *cfg,
+		wakeup:     make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+
+	if c.cfg.ReorderDelay <= 0 {
+		c.cfg.ReorderDelay = defaultReorderDelay
+	}
+	if c.cfg.QueueDelay <= 0 {
+		c.cfg.QueueDelay = defaultQueueDelay
+	}
+
+	seed := c.cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c.rand = rand.New(rand.NewSource(seed))
+
+	go c.deliver()
+
+	return c
+}
+
+// chance returns true with the given percent probability, lock held
+func (c *Conn) chance(percent float64) bool {
+	return percent > 0 && c.rand.Float64()*100 < percent
+}
+
+// lose decides if the next packet is lost, lock held
+func (c *Conn) lose() bool {
+	if c.cfg.GoodToBad > 0 {
+		if c.bad {
+			if c.chance(c.cfg.BadToGood) {
+				c.bad = false
+			}
+		} else if c.chance(c.cfg.GoodToBad) {
+			c.bad = true
+		}
+
+		loss := c.cfg.GoodLoss
+		if c.bad {
+			loss = c.cfg.BadLoss
+		}
+		if c.chance(loss) {
+			return true
+		}
+	}
+
+	return c.chance(c.cfg.Loss)
+}
+
+// WriteTo impairs p and queues it, it always reports p as written like a lossy network would
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errConnClosed
+	default:
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.Written++
+
+	if c.lose() {
+		c.stats.Lost++
+		return len(p), nil
+	}
+
+	now := time.Now()
+	departure := now
+	if c.cfg.Bandwidth > 0 {
+		if c.linkFree.Before(now) {
+			c.linkFree = now
+		}
+		if c.linkFree.Sub(now) > c.cfg.QueueDelay {
+			c.stats.Overflowed++
+			return len(p), nil
+		}
+
+		c.linkFree = c.linkFree.Add(time.Duration(int64(len(p)) * 8 * int64(time.Second) / c.cfg.Bandwidth))
+		departure = c.linkFree
+	}
+
+	delay := c.cfg.Delay
+	if c.cfg.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.cfg.Jitter)*2+1)) - c.cfg.Jitter
+		if delay < 0 {
+			delay = 0
+		}
+	}
+	if c.chance(c.cfg.Reorder) {
+		c.stats.Reordered++
+		delay += c.cfg.ReorderDelay
+	}
+
+	copies := 1
+	if c.chance(c.cfg.Duplicate) {
+		c.stats.Duplicated++
+		copies = 2
+	}
+
+	for i := 0; i < copies; i++ {
+		c.seq++
+		heap.Push(&c.queue, &packet{
+			buf:  append([]byte{}, p...),
+			addr: addr,
+			due:  departure.Add(delay),
+			seq:  c.seq,
+		})
+	}
+
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+
+	return len(p), nil
+}
+
+// deliver writes the queued packets to the wrapped conn when they are due
+func (c *Conn) deliver() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		c.lock.Lock()
+		var next *packet
+		wait := time.Hour
+		if len(c.queue) > 0 {
+			wait = time.Until(c.queue[0].due)
+			if wait <= 0 {
+				next = heap.Pop(&c.queue).(*packet)
+			}
+		}
+		c.lock.Unlock()
+
+		if next != nil {
+			c.PacketConn.WriteTo(next.buf, next.addr)
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-c.closed:
+			return
+		case <-c.wakeup:
+		case <-timer.C:
+		}
+	}
+}
+
+// Stats returns the counters so far
+func (c *Conn) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.stats
+}
+
+// Close drops the queued packets and closes the wrapped conn
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.PacketConn.Close()
+}
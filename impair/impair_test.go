@@ -0,0 +1,158 @@
+package impair
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+const testPackets = 1000
+
+// sendAndReceive writes count numbered packets through an impaired loopback socket
+// and returns the numbers in receiving order
+func sendAndReceive(t *testing.T, cfg *Config, count int, wait time.Duration) ([]uint32, *Conn) {
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket error:%v", err)
+	}
+
+	receiver, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket error:%v", err)
+	}
+	defer receiver.Close()
+
+	conn := Wrap(sender, cfg).(*Conn)
+	defer conn.Close()
+
+	got := make(chan []uint32)
+	go func() {
+		var seqs []uint32
+		buf := make([]byte, 1500)
+		for {
+			receiver.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+			n, _, err := receiver.ReadFrom(buf)
+			if err != nil || n < 4 {
+				got <- seqs
+				return
+			}
+			seqs = append(seqs, binary.BigEndian.Uint32(buf))
+		}
+	}()
+
+	buf := make([]byte, 100)
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint32(buf, uint32(i))
+		if _, err := conn.WriteTo(buf, receiver.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo error:%v", err)
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	return <-got, conn
+}
+
+func TestDisabled(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket error:%v", err)
+	}
+	defer conn.Close()
+
+	if Wrap(conn, nil) != conn || Wrap(conn, &Config{Seed: 1}) != conn {
+		t.Fatalf("conn should not be wrapped without impairments")
+	}
+}
+
+func TestLoss(t *testing.T) {
+	seqs, conn := sendAndReceive(t, &Config{Loss: 20, Seed: 1}, testPackets, time.Microsecond*200)
+
+	stats := conn.Stats()
+	if stats.Written != testPackets || int(stats.Lost)+len(seqs) != testPackets {
+		t.Fatalf("stats %+v don't match %d received", stats, len(seqs))
+	}
+
+	loss := 100 - float64(len(seqs))*100/testPackets
+	if loss < 15 || loss > 25 {
+		t.Fatalf("loss %.1f%% too far from 20%%", loss)
+	}
+}
+
+func TestBurstLoss(t *testing.T) {
+	cfg := &Config{GoodToBad: 2, BadToGood: 20, BadLoss: 100, Seed: 1}
+	seqs, _ := sendAndReceive(t, cfg, testPackets, time.Microsecond*200)
+
+	// stationary bad state share is p/(p+r)
+	loss := 100 - float64(len(seqs))*100/testPackets
+	if loss < 4 || loss > 15 {
+		t.Fatalf("loss %.1f%% too far from 9%%", loss)
+	}
+
+	// losses come in bursts averaging 1/r packets
+	gaps, lost := 0, 0
+	for i := 1; i < len(seqs); i++ {
+		if d := int(seqs[i] - seqs[i-1]); d > 1 {
+			gaps++
+			lost += d - 1
+		}
+	}
+	if gaps == 0 || float64(lost)/float64(gaps) < 2 {
+		t.Fatalf("losses are not bursty, %d lost in %d gaps", lost, gaps)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	cfg := &Config{Delay: time.Millisecond * 100, Seed: 1}
+
+	start := time.Now()
+	seqs, _ := sendAndReceive(t, cfg, 1, 0)
+	if len(seqs) != 1 {
+		t.Fatalf("packet lost")
+	}
+
+	// the receiver gives up 500ms after the last packet
+	if elapsed := time.Since(start) - time.Millisecond*500; elapsed < time.Millisecond*100 {
+		t.Fatalf("delivered after %v", elapsed)
+	}
+}
+
+func TestDuplicateAndReorder(t *testing.T) {
+	cfg := &Config{Duplicate: 10, Reorder: 10, ReorderDelay: time.Millisecond * 5, Seed: 1}
+	seqs, conn := sendAndReceive(t, cfg, 500, time.Millisecond)
+
+	stats := conn.Stats()
+	if len(seqs) != 500+int(stats.Duplicated) || stats.Duplicated == 0 {
+		t.Fatalf("got %d packets, stats %+v", len(seqs), stats)
+	}
+
+	reordered := 0
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] < seqs[i-1] {
+			reordered++
+		}
+	}
+	if reordered == 0 || stats.Reordered == 0 {
+		t.Fatalf("nothing reordered, stats %+v", stats)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	// 100 bytes at 80kbps is 10ms a packet, so 200ms of queue holds about 20 packets
+	cfg := &Config{Bandwidth: 80000, QueueDelay: time.Millisecond * 200, Seed: 1}
+
+	start := time.Now()
+	seqs, conn := sendAndReceive(t, cfg, 100, 0)
+	elapsed := time.Since(start) - time.Millisecond*500
+
+	stats := conn.Stats()
+	if len(seqs) < 15 || len(seqs) > 25 || int(stats.Overflowed)+len(seqs) != 100 {
+		t.Fatalf("got %d packets, stats %+v", len(seqs), stats)
+	}
+
+	if elapsed < time.Millisecond*150 {
+		t.Fatalf("%d packets delivered in %v", len(seqs), elapsed)
+	}
+}
@@ -2,13 +2,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pion/logging"
 	"github.com/xylophone21/go-turn-test/dispose"
+	"github.com/xylophone21/go-turn-test/impair"
+	"github.com/xylophone21/go-turn-test/turntest"
 )
 
 var (
@@ -17,16 +23,53 @@ var (
 	duration     time.Duration = time.Second * 30
 	packageSize  int           = 1024
 	packageWait  time.Duration = time.Second
+	bitrate      string        = ""
+	packetRate   float64       = 0
+	burst        int           = 0
+	profiles     string        = ""
+	rtp          bool          = false
+	echo         bool          = false
+	bidir        bool          = false
+	fanOut       int           = 0
+	family       string        = ""
+	relayFamily  string        = ""
+	dual         bool          = false
 	statLogLvl   int           = int(logging.LogLevelInfo)
 	reqLogLvl    int           = int(logging.LogLevelError)
 	is2CloudMode bool          = false
 	isAwsMode    bool          = false
 	stunServer   string        = ""
+	stunReuse    bool          = false
+	stunQps      float64       = 0
+	stunRto      time.Duration = time.Millisecond * 500
+	stunRetrans  int           = 0
+	stunTimeout  time.Duration = time.Second * 5
 	turnServer   string        = "hellohui.space:3478"
+	tlsInsecure  bool          = false
+	weights      string        = ""
+	distribution string        = "rr"
 	username     string        = ""
 	password     string        = ""
+	authSecret   string        = ""
+	authTTL      time.Duration = time.Hour * 24
+	oauthUrl     string        = ""
+	oauthClient  string        = ""
+	loss         float64       = 0
+	burstLoss    string        = ""
+	delay        time.Duration = 0
+	jitter       time.Duration = 0
+	duplicate    float64       = 0
+	reorder      float64       = 0
+	bandwidth    int64         = 0
 	awsDeviceId  string        = ""
 	awsToken     string        = ""
+	awsApiUrl    string        = ""
+	peerListen   string        = ""
+	peerCount    int           = 1
+	peerWait     time.Duration = time.Minute
+	peerToken    string        = ""
+	peerCert     string        = ""
+	peerKey      string        = ""
 )
 
 func init() {
@@ -34,37 +77,344 @@ func init() {
 	flag.DurationVar(&duration, "d", duration, "Duration of test")
 	flag.IntVar(&packageSize, "s", packageSize, "Package size to send")
 	flag.DurationVar(&packageWait, "w", packageWait, "Duration per each send")
+	flag.StringVar(&bitrate, "rate", bitrate, "Bitrate each connection sends instead of -w (e.g. 2mbps, 500kbps)")
+	flag.Float64Var(&packetRate, "pps", packetRate, "Packages per second each connection sends instead of -w")
+	flag.IntVar(&burst, "burst", burst, "Packages sent back-to-back to catch up when sending falls behind")
+	flag.BoolVar(&rtp, "rtp", rtp, "Frame packages as RTP (header on top of -size) with RTCP reports, for loss, jitter and rtt as WebRTC reports them")
+	flag.BoolVar(&echo, "echo", echo, "Far peer reflects the packages, latency is the round trip time so peers need no synchronized clocks")
+	flag.BoolVar(&bidir, "bidir", bidir, "Both ends of each connection send, statistics by direction (up leaves the TURN client)")
+	flag.IntVar(&fanOut, "fanout", fanOut, "Peers each allocation binds channels to and sends to, like a group call without SFU (1 cloud mode). Unless the server is on loopback on Linux (or with 127.0.0.x aliases) the peers share our ip, then only ChannelBind is timed per peer")
+	flag.StringVar(&family, "family", family, "Address family of the sockets to the servers, ipv4 or ipv6 (e.g. the AAAA record of a dual-stack server)")
+	flag.StringVar(&relayFamily, "relayfamily", relayFamily, "Address family of the relayed addresses to request by REQUESTED-ADDRESS-FAMILY, ipv4 or ipv6")
+	flag.BoolVar(&dual, "dual", dual, "Ask for IPv4 and IPv6 relayed addresses in one allocation by ADDITIONAL-ADDRESS-FAMILY (RFC 8656) and send through both (1 cloud mode)")
+	flag.StringVar(&profiles, "profile", profiles, "Traffic profiles of the connections in turn, fixed, audio, video or screen (e.g. audio,audio,video)")
 	flag.IntVar(&statLogLvl, "statlog", statLogLvl, "Log level of statistics")
 	flag.IntVar(&reqLogLvl, "reqlog", reqLogLvl, "Log level of request")
 	flag.BoolVar(&is2CloudMode, "2cloud", is2CloudMode, "Using cloud2cloud turn mode")
 	flag.BoolVar(&isAwsMode, "aws", isAwsMode, "Using AWS turn server")
-	flag.StringVar(&stunServer, "stun", stunServer, "Stun server url")
-	flag.StringVar(&turnServer, "turn", stunServer, "Turn server url")
-	flag.StringVar(&username, "u", username, "Username of turn server")
-	flag.StringVar(&password, "p", password, "Password of turn server")
+	flag.StringVar(&stunServer, "stun", stunServer, "Stun server url (e.g. stun:host:3478, host:3478, stun:host?transport=tcp or stuns:host:443)")
+	flag.BoolVar(&stunReuse, "reuse", stunReuse, "Each STUN connection keeps one socket for all its requests instead of a new 5-tuple each (existing vs new flows)")
+	flag.Float64Var(&stunQps, "qps", stunQps, "STUN requests per second of all connections together, started whatever the responses (open loop)")
+	flag.DurationVar(&stunRto, "rto", stunRto, "Retransmission timeout of -qps STUN requests, doubled each time, only with -qps")
+	flag.IntVar(&stunRetrans, "retransmits", stunRetrans, "Retransmits of a -qps STUN request without response, only with -qps")
+	flag.DurationVar(&stunTimeout, "stuntimeout", stunTimeout, "Wait for the response to a -qps STUN request since its first transmit, only with -qps")
+	flag.StringVar(&turnServer, "turn", stunServer, "Turn server url (e.g. turn:host:443?transport=tcp, turns:host or host:3478), comma separated for several servers")
+	flag.StringVar(&weights, "weights", weights, "Comma separated weights of the turn servers, only with -dist weighted, 1 each by default")
+	flag.StringVar(&distribution, "dist", distribution, "Distribution of connections over turn servers, rr or weighted")
+	flag.BoolVar(&tlsInsecure, "insecure", tlsInsecure, "Skip certificate verification of turns: and stuns: servers")
+	flag.StringVar(&username, "u", username, "Username of turn server, comma separated for each of several servers")
+	flag.StringVar(&password, "p", password, "Password of turn server, comma separated for each of several servers")
+	flag.StringVar(&authSecret, "secret", authSecret, "Shared secret of TURN REST API, -u becomes the user part of generated usernames")
+	flag.DurationVar(&authTTL, "ttl", authTTL, "Lifetime of TURN REST API credentials")
+	flag.StringVar(&oauthUrl, "oauth", oauthUrl, "Authorization server url issuing RFC 7635 access tokens for TURN")
+	flag.StringVar(&oauthClient, "oauthclient", oauthClient, "Client id sent to the authorization server")
+	flag.Float64Var(&loss, "loss", loss, "Random loss in percent of sent packets")
+	flag.StringVar(&burstLoss, "burstloss", burstLoss, "Gilbert-Elliott bursty loss in percent, p,r[,goodloss,badloss] (e.g. 1,30 or 1,30,0,80)")
+	flag.DurationVar(&delay, "delay", delay, "Extra delay of sent packets")
+	flag.DurationVar(&jitter, "jitter", jitter, "Jitter of the extra delay")
+	flag.Float64Var(&duplicate, "dup", duplicate, "Duplicated sent packets in percent")
+	flag.Float64Var(&reorder, "reorder", reorder, "Reordered sent packets in percent")
+	flag.Int64Var(&bandwidth, "bw", bandwidth, "Bandwidth cap of each connection in kbps")
 	flag.StringVar(&awsDeviceId, "did", awsDeviceId, "Device Id to get AWS servers")
 	flag.StringVar(&awsToken, "token", awsToken, "Token to get AWS servers")
+	flag.StringVar(&awsApiUrl, "api", awsApiUrl, "Api url to get AWS servers from instead of the UAT one (e.g. a mock-provider)")
+	flag.StringVar(&peerListen, "peerlisten", peerListen, "Control address remote peers register with (e.g. :7000), they become the far ends of the connections")
+	flag.IntVar(&peerCount, "peers", peerCount, "Remote peers to wait for with -peerlisten")
+	flag.DurationVar(&peerWait, "peerwait", peerWait, "Wait this long for the -peers to register before giving up")
+	flag.StringVar(&peerToken, "peertoken", peerToken, "Token remote peers must present to get jobs, required with -peerlisten as jobs carry the TURN credentials")
+	flag.StringVar(&peerCert, "peercert", peerCert, "Certificate file to serve -peerlisten over TLS by, with -peerkey")
+	flag.StringVar(&peerKey, "peerkey", peerKey, "Private key file of -peercert")
 	flag.IntVar(&method, "m", method, "Methdo to test, 0-STUN;1-TURN")
 
 	// 解析参数
 	flag.Parse()
 }
 
+// splitList splits a comma separated flag, an empty flag gives no item
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// parseTurnServers builds the server list from -turn, -weights, -u and -p,
+// a single username/password applies to every server, and every server weighs 1 without -weights
+func parseTurnServers() ([]dispose.TurnServerST, error) {
+	addrs := splitList(turnServer)
+	weightList := splitList(weights)
+	users := splitList(username)
+	passwords := splitList(password)
+
+	if len(weightList) > 0 && len(weightList) != len(addrs) {
+		return nil, fmt.Errorf("%d weights for %d servers", len(weightList), len(addrs))
+	}
+
+	if (len(users) > 1 || len(passwords) > 1) && (len(users) != len(addrs) || len(passwords) != len(addrs)) {
+		return nil, fmt.Errorf("%d usernames and %d passwords for %d servers", len(users), len(passwords), len(addrs))
+	}
+
+	servers := make([]dispose.TurnServerST, len(addrs))
+	for i, addr := range addrs {
+		servers[i].Addr = addr
+
+		if len(weightList) == 0 && distribution == "weighted" {
+			servers[i].Weight = 1
+		} else if len(weightList) > 0 {
+			weight, err := strconv.Atoi(weightList[i])
+			if err != nil {
+				return nil, fmt.Errorf("weight %q error:%v", weightList[i], err)
+			}
+			if weight <= 0 {
+				return nil, fmt.Errorf("weight %d of %s is not positive", weight, addr)
+			}
+			servers[i].Weight = weight
+		}
+
+		if len(users) > 1 || len(passwords) > 1 {
+			servers[i].Username = users[i]
+			servers[i].Password = passwords[i]
+		}
+	}
+
+	return servers, nil
+}
+
+// parseBitrate parses rates like "2mbps", "500kbps", "1.5Mbps" or "64000" (bits per second)
+func parseBitrate(rate string) (int64, error) {
+	if rate == "" {
+		return 0, nil
+	}
+
+	value := strings.ToLower(strings.TrimSpace(rate))
+	value = strings.TrimSuffix(value, "bps")
+	value = strings.TrimSuffix(value, "bit/s")
+
+	unit := float64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		unit = 1e3
+	case strings.HasSuffix(value, "m"):
+		unit = 1e6
+	case strings.HasSuffix(value, "g"):
+		unit = 1e9
+	}
+	if unit != 1 {
+		value = value[:len(value)-1]
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("bad rate %q", rate)
+	}
+
+	return int64(number * unit), nil
+}
+
+// parseProfiles parses the comma separated -profile list
+func parseProfiles() ([]turntest.TrafficProfile, error) {
+	var ret []turntest.TrafficProfile
+	for _, name := range splitList(profiles) {
+		profile, err := turntest.ParseTrafficProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, profile)
+	}
+	return ret, nil
+}
+
+// parseDistribution parses -dist, -weights only applies to the weighted distribution
+func parseDistribution() (dispose.DisposeDistribution, error) {
+	switch distribution {
+	case "rr":
+		if weights != "" {
+			return dispose.DISTRIBUTION_ROUND_ROBIN, fmt.Errorf("-weights only applies with -dist weighted")
+		}
+		return dispose.DISTRIBUTION_ROUND_ROBIN, nil
+	case "weighted":
+		return dispose.DISTRIBUTION_WEIGHTED, nil
+	default:
+		return dispose.DISTRIBUTION_ROUND_ROBIN, fmt.Errorf("unknown -dist %q, rr or weighted", distribution)
+	}
+}
+
+// checkOpenLoopFlags rejects the STUN open loop flags without -qps, the closed loop retransmits and times
+// out by the schedule of pion/stun
+func checkOpenLoopFlags() error {
+	if stunQps > 0 {
+		return nil
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "rto" || f.Name == "retransmits" || f.Name == "stuntimeout" {
+			err = fmt.Errorf("-%s only applies with -qps", f.Name)
+		}
+	})
+	return err
+}
+
+// parseImpair builds the network impairment from -loss, -burstloss, -delay, -jitter, -dup, -reorder and -bw
+func parseImpair() (*impair.Config, error) {
+	cfg := &impair.Config{
+		Loss:      loss,
+		Delay:     delay,
+		Jitter:    jitter,
+		Duplicate: duplicate,
+		Reorder:   reorder,
+		Bandwidth: bandwidth * 1000,
+		BadLoss:   100,
+	}
+
+	params := splitList(burstLoss)
+	if len(params) != 0 && len(params) != 2 && len(params) != 4 {
+		return nil, fmt.Errorf("burstloss %q wants p,r or p,r,goodloss,badloss", burstLoss)
+	}
+
+	values := []*float64{&cfg.GoodToBad, &cfg.BadToGood, &cfg.GoodLoss, &cfg.BadLoss}
+	for i, param := range params {
+		value, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return nil, fmt.Errorf("burstloss %q error:%v", burstLoss, err)
+		}
+		*values[i] = value
+	}
+
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	return cfg, nil
+}
+
+// runCommand runs the subcommand given after the flags, it returns false when there is none
+func runCommand() (bool, error) {
+	if flag.NArg() == 0 {
+		return false, nil
+	}
+
+	switch flag.Arg(0) {
+	case "mock-provider":
+		return true, runMockProvider(flag.Args()[1:])
+	case "peer":
+		return true, runPeer(flag.Args()[1:])
+	case "conformance":
+		return true, runConformance(flag.Args()[1:])
+	case "quota":
+		return true, runQuota(flag.Args()[1:])
+	case "nat-discovery":
+		return true, runNatDiscovery(flag.Args()[1:])
+	}
+
+	return true, fmt.Errorf("unknown command %q", flag.Arg(0))
+}
+
 func main() {
+	if ok, err := runCommand(); ok {
+		if err != nil {
+			fmt.Printf("Run error:%v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	dist, err := parseDistribution()
+	if err != nil {
+		fmt.Printf("Run error:%v\n", err)
+		os.Exit(-1)
+	}
+
+	turnServers, err := parseTurnServers()
+	if err != nil {
+		fmt.Printf("Run error:%v\n", err)
+		os.Exit(-1)
+	}
+
+	impairCfg, err := parseImpair()
+	if err != nil {
+		fmt.Printf("Run error:%v\n", err)
+		os.Exit(-1)
+	}
+
+	bitrateValue, err := parseBitrate(bitrate)
+	if err != nil {
+		fmt.Printf("Run error:%v\n", err)
+		os.Exit(-1)
+	}
+
+	profileList, err := parseProfiles()
+	if err != nil {
+		fmt.Printf("Run error:%v\n", err)
+		os.Exit(-1)
+	}
+
+	if err = checkOpenLoopFlags(); err != nil {
+		fmt.Printf("Run error:%v\n", err)
+		os.Exit(-1)
+	}
+
+	clientFamily, err := turntest.ParseAddressFamily(family)
+	if err != nil {
+		fmt.Printf("Run error:%v\n", err)
+		os.Exit(-1)
+	}
+
+	relayFamilyValue, err := turntest.ParseAddressFamily(relayFamily)
+	if err != nil {
+		fmt.Printf("Run error:%v\n", err)
+		os.Exit(-1)
+	}
+
 	req := &dispose.DisposeRequestST{
 		ChanCount:      connections,
 		Duration:       duration,
 		PackageSize:    int32(packageSize),
 		PackageWait:    packageWait,
+		Bitrate:        bitrateValue,
+		PacketRate:     packetRate,
+		Burst:          burst,
+		Profiles:       profileList,
+		Rtp:            rtp,
+		Echo:           echo,
+		Bidir:          bidir,
+		FanOut:         fanOut,
+		Family:         clientFamily,
+		RelayFamily:    relayFamilyValue,
+		Dual:           dual,
+		Impair:         impairCfg,
 		StatLogLvl:     statLogLvl,
 		ReqLogLvl:      reqLogLvl,
 		StunServerAddr: stunServer,
-		TurnServerAddr: turnServer,
+		TurnServers:    turnServers,
+		TlsInsecure:    tlsInsecure,
 		Username:       username,
 		Password:       password,
+		AuthSecret:     authSecret,
+		AuthTTL:        authTTL,
+		OAuthUrl:       oauthUrl,
+		OAuthClientId:  oauthClient,
+		AwsDeviceId:    awsDeviceId,
+		AwsToken:       awsToken,
+		AwsApiUrl:      awsApiUrl,
 		Method:         dispose.DisposeMethod(method),
 	}
 
+	// STUN flows and open loop
+	req.StunReuse = stunReuse
+	req.StunQps = stunQps
+	req.StunRto = stunRto
+	req.StunRetransmits = stunRetrans
+	req.StunTimeout = stunTimeout
+
+	req.Distribution = dist
+
+	// per server credentials are in turnServers
+	if len(splitList(username)) > 1 {
+		req.Username = ""
+		req.Password = ""
+	}
+
 	var mode string
 	if is2CloudMode {
 		req.Mode = dispose.MODE_2CLOUD
@@ -91,11 +441,47 @@ func main() {
 		}
 	}
 
+	if peerListen != "" {
+		if peerToken == "" {
+			fmt.Printf("Run error: -peerlisten requires -peertoken\n")
+			os.Exit(-1)
+		}
+
+		f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevel(statLogLvl)}
+		hubCfg := &turntest.PeerHubConfig{Addr: peerListen, Token: peerToken, Log: f.NewLogger("peers")}
+		if peerCert != "" || peerKey != "" {
+			cert, err := tls.LoadX509KeyPair(peerCert, peerKey)
+			if err != nil {
+				fmt.Printf("Run error:%v\n", err)
+				os.Exit(-1)
+			}
+			hubCfg.TlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+
+		hub, err := turntest.ListenPeers(hubCfg)
+		if err != nil {
+			fmt.Printf("Run error:%v\n", err)
+			os.Exit(-1)
+		}
+		defer hub.Close()
+
+		fmt.Printf("Waiting for %v peers on %v\n", peerCount, hub.Addr())
+		ctx, cancel := context.WithTimeout(context.Background(), peerWait)
+		err = hub.WaitPeers(ctx, peerCount)
+		cancel()
+		if err != nil {
+			fmt.Printf("Run error:%v\n", err)
+			hub.Close()
+			os.Exit(-1)
+		}
+		req.Peers = hub
+	}
+
 	//todo added paramters check for each mode
 
 	fmt.Printf("Start request %v connections to %v by %v\n", connections, server, mode)
 
-	err := dispose.Dispose(req)
+	err = dispose.Dispose(req)
 	if err != nil {
 		fmt.Printf("Run error:%v\n", err)
 		os.Exit(-1)
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/testserver"
+)
+
+// runMockProvider serves the /v1/call api with credentials of an embedded TURN server until interrupted
+func runMockProvider(args []string) error {
+	cfg := &testserver.ProviderConfig{}
+	var script string
+
+	fs := flag.NewFlagSet("mock-provider", flag.ExitOnError)
+	fs.StringVar(&cfg.Listen, "listen", "127.0.0.1:8080", "HTTP listening address")
+	fs.StringVar(&cfg.Token, "token", "", "Token requests must carry, any when empty")
+	fs.DurationVar(&cfg.TTL, "ttl", time.Hour, "Lifetime of the handed out credentials")
+	fs.BoolVar(&cfg.TLS, "tls", false, "Also hand out turns: (self-signed, use -insecure)")
+	fs.StringVar(&script, "script", "", "Replies in order before answering normally (e.g. ok,code=1001,status=500,delay=3s+expired)")
+	fs.Parse(args)
+
+	replies, err := testserver.ParseProviderScript(script)
+	if err != nil {
+		return err
+	}
+	cfg.Replies = replies
+	cfg.LogLevel = logging.LogLevel(reqLogLvl)
+
+	provider, err := testserver.StartProvider(cfg)
+	if err != nil {
+		return err
+	}
+	defer provider.Close()
+
+	fmt.Printf("Mock provider on %v, TURN server udp %v tcp %v tls %v\n", provider.URL, provider.Server.UDPAddr, provider.Server.TCPAddr, provider.Server.TLSAddr)
+	fmt.Printf("Run with: -aws -api %v\n", provider.URL)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	return nil
+}
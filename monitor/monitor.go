@@ -114,6 +114,10 @@ func (c *monitorStatisticsClient) addResult(result *statistics.RequestResults) {
 		return
 	}
 
+	if result.IsRotated || result.IsRtpReport || result.SetupMethod != "" || result.ConnectMethod != "" {
+		return
+	}
+
 	if c.firstTime.Unix() == 0 {
 		c.firstTime = result.Time
 	}
@@ -144,12 +148,17 @@ func doMonitor(log logging.LeveledLogger, chanid uint64, ch chan statistics.Requ
 	awsReq := &turntest.RequestBody{
 		DeviceId: testdata.AwsDeviceId,
 		Token:    testdata.AwsToken,
+		ApiUrl:   testdata.AwsApiUrl,
 	}
 	awsServers, err := turntest.AllocAwsTurns(awsReq)
 	if err != nil {
 		return err
 	}
 
+	if len(awsServers.TurnServerAddrs) == 0 {
+		return fmt.Errorf("no turn server")
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 
 	turnReq := &turntest.TrunRequestST{
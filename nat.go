@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/stuntest"
+	"github.com/xylophone21/go-turn-test/turntest"
+)
+
+// runNatDiscovery classifies the NAT between us and the -stun server, which must support RFC 5780,
+// and prints its mapping, filtering, hairpinning and binding lifetime
+func runNatDiscovery(args []string) error {
+	var jsonFile string
+	req := &stuntest.NatRequestST{}
+
+	fs := flag.NewFlagSet("nat-discovery", flag.ExitOnError)
+	fs.DurationVar(&req.LifetimeMax, "lifetime", 0, "Longest idle time to test the binding lifetime for (e.g. 2m), waits doubled from 1s, skipped when 0")
+	fs.DurationVar(&req.Rto, "rto", time.Millisecond*500, "Retransmission timeout of the discovery requests, doubled each time")
+	fs.StringVar(&jsonFile, "json", "", "File to write the result to as JSON, stdout after the summary when empty")
+	fs.Parse(args)
+
+	if stunServer == "" {
+		return fmt.Errorf("-stun is required")
+	}
+
+	var err error
+	req.Family, err = turntest.ParseAddressFamily(family)
+	if err != nil {
+		return err
+	}
+
+	f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevel(reqLogLvl)}
+	req.Log = f.NewLogger("nat")
+	req.StunServerAddr = stunServer
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req.Ctx = ctx
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	result, err := stuntest.DiscoverNat(req)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("NAT toward %v (other address %v)\n", req.StunServerAddr, result.OtherAddress)
+	if result.NoNat {
+		fmt.Printf("  no NAT, %v\n", result.LocalAddress)
+	} else {
+		fmt.Printf("  %v mapped to %v\n", result.LocalAddress, result.MappedAddress)
+	}
+	fmt.Printf("  mapping:     %s\n", result.Mapping)
+	fmt.Printf("  filtering:   %s\n", result.Filtering)
+	fmt.Printf("  hairpinning: %v\n", result.Hairpinning)
+	switch {
+	case req.LifetimeMax == 0:
+	case result.LifetimeError != "":
+		fmt.Printf("  lifetime:    %s\n", result.LifetimeError)
+	case result.LifetimeExpired != 0:
+		fmt.Printf("  lifetime:    alive after %v, expired after %v\n", result.LifetimeAlive, result.LifetimeExpired)
+	default:
+		fmt.Printf("  lifetime:    alive after %v\n", result.LifetimeAlive)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	if jsonFile == "" {
+		fmt.Println(string(data))
+		return nil
+	}
+	return ioutil.WriteFile(jsonFile, data, 0644)
+}
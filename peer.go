@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/turntest"
+)
+
+// runPeer serves as the remote far end of a tester's connections until interrupted,
+// the impairment flags and -insecure before the command apply
+func runPeer(args []string) error {
+	cfg := &turntest.PeerConfig{}
+	var retry time.Duration
+	var testerTls bool
+	var caFile string
+
+	hostname, _ := os.Hostname()
+
+	fs := flag.NewFlagSet("peer", flag.ExitOnError)
+	fs.StringVar(&cfg.Tester, "tester", "", "Control address of the tester (e.g. tester.abc.com:7000)")
+	fs.StringVar(&cfg.Token, "token", "", "Token of the tester, its -peertoken")
+	fs.BoolVar(&testerTls, "tls", false, "Reach the tester over TLS, verifying its certificate by the system roots or -ca")
+	fs.StringVar(&caFile, "ca", "", "PEM file of the certificates to verify the tester by with -tls")
+	fs.StringVar(&cfg.Name, "name", hostname, "Name the tester logs this peer by")
+	fs.DurationVar(&retry, "retry", time.Second*5, "Wait before registering again when the tester goes away")
+	fs.Parse(args)
+
+	if cfg.Tester == "" || cfg.Token == "" {
+		return fmt.Errorf("-tester and -token are required")
+	}
+
+	if testerTls {
+		cfg.TesterTls = &tls.Config{}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return err
+			}
+			cfg.TesterTls.RootCAs = x509.NewCertPool()
+			if !cfg.TesterTls.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificate in %s", caFile)
+			}
+		}
+	}
+
+	impairCfg, err := parseImpair()
+	if err != nil {
+		return err
+	}
+	cfg.Impair = impairCfg
+
+	if tlsInsecure {
+		cfg.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevel(reqLogLvl)}
+	cfg.Log = f.NewLogger("peer")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	for {
+		fmt.Printf("Registering with tester %v as %v\n", cfg.Tester, cfg.Name)
+		err = turntest.RunPeer(ctx, cfg)
+		if ctx.Err() != nil {
+			return nil
+		}
+		fmt.Printf("Peer error:%v\n", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(retry):
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/turntest"
+)
+
+// runQuota allocates on the first -turn server until it refuses, with -u and -p or distinct -secret users,
+// and prints the limit found, how long it took and whether deallocating restored the capacity
+func runQuota(args []string) error {
+	var jsonFile string
+	var distinct bool
+	req := &turntest.QuotaRequestST{}
+
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	fs.BoolVar(&distinct, "distinct", false, "Allocate with a distinct TURN REST API user each time (needs -secret), for total-quota instead of user-quota")
+	fs.IntVar(&req.MaxAllocations, "max", 1000, "Allocations to make before giving up looking for the limit")
+	fs.DurationVar(&req.RecoveryTimeout, "recovery", time.Second*10, "How long to retry allocating after deallocating all")
+	fs.StringVar(&jsonFile, "json", "", "File to write the result to as JSON")
+	fs.Parse(args)
+
+	servers, err := parseTurnServers()
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("-turn is required")
+	}
+
+	req.ClientFamily, err = turntest.ParseAddressFamily(family)
+	if err != nil {
+		return err
+	}
+
+	f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevel(reqLogLvl)}
+	req.Log = f.NewLogger("quota")
+	req.TurnServerAddr = servers[0].Addr
+	req.Username = username
+	req.Password = password
+	if servers[0].Username != "" {
+		req.Username = servers[0].Username
+		req.Password = servers[0].Password
+	}
+	if tlsInsecure {
+		req.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	switch {
+	case distinct && authSecret == "":
+		return fmt.Errorf("-distinct needs -secret")
+	case distinct:
+		req.Credential = func(index uint64) (*turntest.Credential, error) {
+			return turntest.RestCredential(authSecret, fmt.Sprintf("%s%d", username, index), authTTL)(index)
+		}
+	case authSecret != "":
+		req.Credential = turntest.RestCredential(authSecret, username, authTTL)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req.Ctx = ctx
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	result, err := turntest.DiscoverQuota(req)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Quota of %v\n", req.TurnServerAddr)
+	switch {
+	case !result.Reached:
+		fmt.Printf("  no limit within %d allocations (%v)\n", result.Allocations, result.Elapsed)
+	case result.Code != 0:
+		fmt.Printf("  %d after %d allocations in %v\n", result.Code, result.Allocations, result.Elapsed)
+	default:
+		fmt.Printf("  %s after %d allocations in %v\n", result.Reason, result.Allocations, result.Elapsed)
+	}
+	if result.Recovered {
+		fmt.Printf("  capacity back %v after deallocating\n", result.RecoveryTime)
+	} else if result.Reached {
+		fmt.Printf("  capacity not back %v after deallocating\n", req.RecoveryTimeout)
+	}
+
+	if jsonFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(jsonFile, data, 0644)
+}
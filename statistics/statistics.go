@@ -4,6 +4,9 @@ package statistics
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,6 +24,26 @@ type RequestResults struct {
 	IsSent  bool // sent or receive
 	Bytes   uint64
 	Latency time.Duration // only for receive
+	Server  string        // server the channel is testing, for the per server report
+	Profile string        // traffic profile of the channel, for the per profile report
+
+	Direction string // "up" or "down" in bidirectional channels, for the per direction report
+	Peer      int    // 1 based peer of fan-out channels, for the per peer report
+	Family    string // "ipv4" or "ipv6" relayed address of dual allocation channels, for the per family report
+
+	SetupMethod   string // a fan-out setup request ("CreatePermission" or "ChannelBind") of Peer took Latency, not a traffic result
+	ConnectMethod string // a connection setup step ("Connect" or "TlsHandshake") to Server took Latency, not a traffic result
+
+	TargetBitrate uint64 // only for sent, bits per second the sender aims at, 0 when unknown
+
+	IsRotated bool // credentials were rotated, not a traffic result
+
+	// RTP report of the channel, not a traffic result
+	IsRtpReport bool
+	RtpExpected uint64        // packages expected by the RTP sequence numbers so far, 0 in sender side reports
+	RtpLost     int64         // packages lost so far by the RTP sequence numbers (RFC 3550), negative with duplicates
+	Jitter      time.Duration // interarrival jitter by the RTP timestamps (RFC 3550)
+	Rtt         time.Duration // round trip time by a RTCP receiver report, 0 when unknown
 }
 
 type StatisticsRequestST struct {
@@ -29,6 +52,60 @@ type StatisticsRequestST struct {
 	ChanCount            uint64
 	Ch                   chan RequestResults
 	ExportStatisticsTime time.Duration
+	Summary              *Summary // filled with the final statistics when not nil
+}
+
+// Summary is the final statistics of all channels
+type Summary struct {
+	ChanCount          uint64
+	GotChanCount       int // channels reported anything
+	SuccessedChanCount int // channels received at least once
+	MaxSuccessCount    int // max channels succeeded at the same time
+	SentCount          int
+	SentBytes          uint64
+	RecvCount          int
+	RecvBytes          uint64
+	Kbps               int     // average receiving rate
+	SentKbps           int     // average achieved sending rate
+	TargetKbps         int     // average target sending rate
+	SentPps            float64 // achieved sending rate of all channels together, requests per second with STUN
+	RecvPps            float64 // receiving rate of all channels together, responses per second with STUN
+	Loss               float32 // percent
+	FailedCount        int
+	ErrCodes           map[int]int // error count of each ErrCode
+	AvgLatency         time.Duration
+	RotateCount        int
+	RtpLoss            float32                             // percent by the RTP sequence numbers
+	AvgJitter          time.Duration                       // by the RTP timestamps
+	AvgRtt             time.Duration                       // by the RTCP receiver reports
+	Servers            map[string]*GroupSummary            // by server the channels tested
+	Profiles           map[string]*GroupSummary            // by traffic profile of the channels
+	Directions         map[string]*GroupSummary            // by direction of bidirectional channels
+	Peers              map[string]*GroupSummary            // by peer of fan-out channels
+	Families           map[string]*GroupSummary            // by relayed address family of dual allocation channels
+	Setups             map[string]map[int]*SetupSummary    // by setup method, then by peer count bucket
+	Connects           map[string]map[string]*SetupSummary // by connection setup method, then by server
+}
+
+// SetupSummary is the latency of the setup steps of the peers in a bucket, 1, 2-3, 4-7..., or of the connections to a server
+type SetupSummary struct {
+	Count        int
+	AvgLatency   time.Duration
+	MaxLatency   time.Duration
+	LatencyTotal time.Duration `json:"-"`
+}
+
+// setupBucket is the first peer of the power of 2 bucket of peer, 0 without peer
+func setupBucket(peer int) int {
+	if peer < 1 {
+		return 0
+	}
+
+	bucket := 1
+	for bucket*2 <= peer {
+		bucket *= 2
+	}
+	return bucket
 }
 
 type statisticsChan struct {
@@ -42,6 +119,150 @@ type statisticsChan struct {
 	LastSuccess  bool
 	LatencyCount int           // How many time get latency
 	LatencyTotal time.Duration // total latency
+	RotateCount  int           // how many times credentials were rotated
+	Server       string        // last server reported by the channel
+	Profile      string        // traffic profile reported by the channel
+
+	FirstSentTime  time.Time
+	LastSentTime   time.Time
+	FirstSentBytes uint64 // the first package has no sending time of its own
+	TargetBitrate  uint64
+	FirstRecvTime  time.Time
+	LastRecvTime   time.Time
+
+	RtpExpected uint64
+	RtpLost     int64
+	Jitter      time.Duration
+	Rtt         time.Duration
+
+	Name       string                     // of a direction, a peer or a family of the channel
+	Directions map[string]*statisticsChan // traffic of each direction of a bidirectional channel
+	Peers      map[string]*statisticsChan // traffic to each peer of a fan-out channel
+	Families   map[string]*statisticsChan // traffic through each relayed address of a dual allocation channel
+}
+
+// targetBitrate is what the channel aims at sending, to all of its streams
+func (c *statisticsChan) targetBitrate() uint64 {
+	streams := c.streams()
+	if len(streams) == 0 {
+		return c.TargetBitrate
+	}
+
+	target := uint64(0)
+	for _, stream := range streams {
+		target += stream.TargetBitrate
+	}
+	return target
+}
+
+// streams are the directions, the peers or the families of the channel, none when it has a single stream
+func (c *statisticsChan) streams() []*statisticsChan {
+	subs := c.Directions
+	if len(c.Peers) > 0 {
+		subs = c.Peers
+	} else if len(c.Families) > 0 {
+		subs = c.Families
+	}
+
+	streams := make([]*statisticsChan, 0, len(subs))
+	for _, stream := range subs {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// stream returns the statistics of the direction, the peer or the family of result, nil when it has none
+func (c *statisticsChan) stream(result *RequestResults) *statisticsChan {
+	subs := &c.Directions
+	name := result.Direction
+	if result.Peer > 0 {
+		subs = &c.Peers
+		name = strconv.Itoa(result.Peer)
+	} else if result.Family != "" {
+		subs = &c.Families
+		name = result.Family
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	if *subs == nil {
+		*subs = make(map[string]*statisticsChan)
+	}
+
+	stream, ok := (*subs)[name]
+	if !ok {
+		stream = &statisticsChan{
+			FirstTime: result.Time,
+			Name:      name,
+		}
+		(*subs)[name] = stream
+	}
+	return stream
+}
+
+// rtpSources are the statistics holding the RTP reports of the channel, its streams when it has several
+func (c *statisticsChan) rtpSources() []*statisticsChan {
+	if streams := c.streams(); len(streams) > 0 {
+		return streams
+	}
+	return []*statisticsChan{c}
+}
+
+// count adds a traffic result to the channel
+func (c *statisticsChan) count(result *RequestResults) {
+	c.LastTime = result.Time
+
+	if result.ErrCode != 0 {
+		c.ErrCount++
+		return
+	}
+
+	if result.IsSent {
+		if c.SentCount == 0 {
+			c.FirstSentTime = result.Time
+			c.FirstSentBytes = result.Bytes
+		}
+		c.LastSentTime = result.Time
+		if result.TargetBitrate > 0 {
+			c.TargetBitrate = result.TargetBitrate
+		}
+
+		c.SentCount++
+		c.SentBytes += result.Bytes
+	} else {
+		if c.RecvCount == 0 {
+			c.FirstRecvTime = result.Time
+		}
+		c.LastRecvTime = result.Time
+
+		c.RecvCount++
+		c.RecvBytes += result.Bytes
+
+		if result.Latency > 0 {
+			c.LatencyCount++
+			c.LatencyTotal += result.Latency
+		}
+	}
+}
+
+// sentKbps is the achieved sending rate of the channel
+func (c *statisticsChan) sentKbps() int {
+	since := c.LastSentTime.Sub(c.FirstSentTime).Seconds()
+	if since <= 0 {
+		return 0
+	}
+	return int(8 * float64(c.SentBytes-c.FirstSentBytes) / since / 1024)
+}
+
+// rate is the packages per second of count packages between first and last, the first has no time of its own
+func rate(count int, first time.Time, last time.Time) float64 {
+	since := last.Sub(first).Seconds()
+	if count < 2 || since <= 0 {
+		return 0
+	}
+	return float64(count-1) / since
 }
 
 type statisticsClient struct {
@@ -51,6 +272,9 @@ type statisticsClient struct {
 	successCount    int
 	maxSuccessCount int
 	chans           map[uint64]*statisticsChan
+	setups          map[string]map[int]*SetupSummary    // fan-out setup latency by method and peer bucket
+	connects        map[string]map[string]*SetupSummary // connection setup latency by method and server
+	errCodes        map[int]int                         // error count of each ErrCode
 }
 
 func ReceivingResults(req *StatisticsRequestST) error {
@@ -73,6 +297,9 @@ func ReceivingResults(req *StatisticsRequestST) error {
 		log:       req.Log,
 		chanCount: req.ChanCount,
 		chans:     make(map[uint64]*statisticsChan),
+		errCodes:  make(map[int]int),
+		setups:    make(map[string]map[int]*SetupSummary),
+		connects:  make(map[string]map[string]*SetupSummary),
 	}
 
 	go func() {
@@ -94,7 +321,10 @@ func ReceivingResults(req *StatisticsRequestST) error {
 
 		case <-req.Ctx.Done():
 			client.logDetails()
-			client.logSummary()
+			sum := client.logSummary()
+			if req.Summary != nil {
+				*req.Summary = *sum
+			}
 			return nil
 		}
 	}
@@ -129,10 +359,56 @@ func (c *statisticsClient) addResult(result *RequestResults) {
 		c.chans[result.ChanID] = chanClient
 	}
 
-	chanClient.LastTime = result.Time
+	if result.Server != "" {
+		chanClient.Server = result.Server
+	}
+
+	if result.Profile != "" {
+		chanClient.Profile = result.Profile
+	}
+
+	if result.IsRotated {
+		chanClient.RotateCount++
+		c.log.Debugf("addResult-%v credentials rotated", result.ChanID)
+		return
+	}
+
+	if result.SetupMethod != "" {
+		c.addSetup(result)
+		return
+	}
+
+	if result.ConnectMethod != "" {
+		c.addConnect(result)
+		return
+	}
+
+	stream := chanClient.stream(result)
+
+	if result.IsRtpReport {
+		rtpClient := chanClient
+		if stream != nil {
+			rtpClient = stream
+		}
+
+		if result.RtpExpected > 0 {
+			rtpClient.RtpExpected = result.RtpExpected
+			rtpClient.RtpLost = result.RtpLost
+			rtpClient.Jitter = result.Jitter
+		}
+		if result.Rtt > 0 {
+			rtpClient.Rtt = result.Rtt
+		}
+		return
+	}
+
+	chanClient.count(result)
+	if stream != nil {
+		stream.count(result)
+	}
 
 	if result.ErrCode != 0 {
-		chanClient.ErrCount++
+		c.errCodes[result.ErrCode]++
 
 		if chanClient.LastSuccess {
 			c.successCount--
@@ -151,35 +427,15 @@ func (c *statisticsClient) addResult(result *RequestResults) {
 	if c.successCount > c.maxSuccessCount {
 		c.maxSuccessCount = c.successCount
 	}
-
-	if result.IsSent {
-		chanClient.SentCount++
-		chanClient.SentBytes += result.Bytes
-	} else {
-		chanClient.RecvCount++
-		chanClient.RecvBytes += result.Bytes
-
-		if result.Latency > 0 {
-			chanClient.LatencyCount++
-			chanClient.LatencyTotal += result.Latency
-		}
-	}
 }
 
-func (c *statisticsClient) logSummary() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	gotChanCount := 0
-	successedChanCount := 0
-
-	recvCount := 0
-	recvBytes := uint64(0)
-
-	sentCount := 0
-	sentBytes := uint64(0)
-
-	failedCount := 0
+// summary computes the statistics of all channels, lock must be held
+func (c *statisticsClient) summary() *Summary {
+	sum := &Summary{
+		ChanCount:       c.chanCount,
+		MaxSuccessCount: c.maxSuccessCount,
+		ErrCodes:        make(map[int]int),
+	}
 
 	byteRecv := uint64(0)
 	timeEscape := float64(0)
@@ -187,19 +443,39 @@ func (c *statisticsClient) logSummary() {
 	latencyTotal := time.Duration(0)
 	latencyCount := 0
 
+	sentKbps := 0
+	targetKbps := 0
+	sentChans := 0
+
+	rtpExpected := uint64(0)
+	rtpLost := int64(0)
+	jitterTotal := time.Duration(0)
+	jitterCount := 0
+	rttTotal := time.Duration(0)
+	rttCount := 0
+
 	for _, chanClient := range c.chans {
-		gotChanCount++
+		sum.GotChanCount++
+
+		sum.SentPps += rate(chanClient.SentCount, chanClient.FirstSentTime, chanClient.LastSentTime)
+		sum.RecvPps += rate(chanClient.RecvCount, chanClient.FirstRecvTime, chanClient.LastRecvTime)
+
+		if chanClient.SentCount > 1 {
+			sentKbps += chanClient.sentKbps()
+			targetKbps += int(chanClient.targetBitrate() / 1024)
+			sentChans++
+		}
 
 		if chanClient.RecvCount > 0 {
-			successedChanCount++
+			sum.SuccessedChanCount++
 
-			recvCount += chanClient.RecvCount
-			recvBytes += chanClient.RecvBytes
+			sum.RecvCount += chanClient.RecvCount
+			sum.RecvBytes += chanClient.RecvBytes
 		}
 
 		if chanClient.SentCount > 0 {
-			sentCount += chanClient.SentCount
-			sentBytes += chanClient.SentBytes
+			sum.SentCount += chanClient.SentCount
+			sum.SentBytes += chanClient.SentBytes
 		}
 
 		d := chanClient.LastTime.Sub(chanClient.FirstTime).Seconds()
@@ -209,47 +485,250 @@ func (c *statisticsClient) logSummary() {
 		}
 
 		if chanClient.ErrCount > 0 {
-			failedCount += chanClient.ErrCount
+			sum.FailedCount += chanClient.ErrCount
 		}
 
 		if chanClient.LatencyTotal > 0 && chanClient.LatencyCount > 0 {
 			latencyTotal += chanClient.LatencyTotal
 			latencyCount += chanClient.LatencyCount
 		}
+
+		sum.RotateCount += chanClient.RotateCount
+
+		for _, rtpClient := range chanClient.rtpSources() {
+			if rtpClient.RtpExpected > 0 {
+				rtpExpected += rtpClient.RtpExpected
+				rtpLost += rtpClient.RtpLost
+				jitterTotal += rtpClient.Jitter
+				jitterCount++
+			}
+
+			if rtpClient.Rtt > 0 {
+				rttTotal += rtpClient.Rtt
+				rttCount++
+			}
+		}
+	}
+
+	if rtpExpected > 0 {
+		sum.RtpLoss = float32(rtpLost) / float32(rtpExpected) * 100
+		sum.AvgJitter = jitterTotal / time.Duration(jitterCount)
+	}
+
+	if rttCount > 0 {
+		sum.AvgRtt = rttTotal / time.Duration(rttCount)
+	}
+
+	for code, count := range c.errCodes {
+		sum.ErrCodes[code] = count
 	}
 
-	loss := float32(0)
-	if sentCount > 0 {
-		loss = 100 - float32(recvCount)/float32(sentCount)*100
+	if sum.SentCount > 0 {
+		sum.Loss = 100 - float32(sum.RecvCount)/float32(sum.SentCount)*100
 	}
 
-	kps := 0
 	if timeEscape != 0 {
-		kps = int(8 * float64(byteRecv) / timeEscape / 1024)
+		sum.Kbps = int(8 * float64(byteRecv) / timeEscape / 1024)
+	}
+
+	if latencyCount > 0 {
+		sum.AvgLatency = latencyTotal / time.Duration(latencyCount)
+	}
+
+	if sentChans > 0 {
+		sum.SentKbps = sentKbps / sentChans
+		sum.TargetKbps = targetKbps / sentChans
 	}
-	latency := int(float64(latencyTotal.Milliseconds()) * float64(1) / float64(latencyCount))
+
+	chans := make([]*statisticsChan, 0, len(c.chans))
+	var dirs, peers, families []*statisticsChan
+	for _, chanClient := range c.chans {
+		chans = append(chans, chanClient)
+		for _, dir := range chanClient.Directions {
+			dirs = append(dirs, dir)
+		}
+		for _, peer := range chanClient.Peers {
+			peers = append(peers, peer)
+		}
+		for _, family := range chanClient.Families {
+			families = append(families, family)
+		}
+	}
+
+	byName := func(chanClient *statisticsChan) string { return chanClient.Name }
+	sum.Servers = groupSummaries(chans, func(chanClient *statisticsChan) string { return chanClient.Server })
+	sum.Profiles = groupSummaries(chans, func(chanClient *statisticsChan) string { return chanClient.Profile })
+	sum.Directions = groupSummaries(dirs, byName)
+	sum.Peers = groupSummaries(peers, byName)
+	sum.Families = groupSummaries(families, byName)
+
+	sum.Setups = make(map[string]map[int]*SetupSummary)
+	for method, buckets := range c.setups {
+		sum.Setups[method] = make(map[int]*SetupSummary)
+		for bucket, setup := range buckets {
+			copied := *setup
+			copied.AvgLatency = setup.LatencyTotal / time.Duration(setup.Count)
+			sum.Setups[method][bucket] = &copied
+		}
+	}
+
+	sum.Connects = make(map[string]map[string]*SetupSummary)
+	for method, servers := range c.connects {
+		sum.Connects[method] = make(map[string]*SetupSummary)
+		for server, connect := range servers {
+			copied := *connect
+			copied.AvgLatency = connect.LatencyTotal / time.Duration(connect.Count)
+			sum.Connects[method][server] = &copied
+		}
+	}
+
+	return sum
+}
+
+func (c *statisticsClient) logSummary() *Summary {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	sum := c.summary()
 
 	c.log.Infof("----statistics summary----")
-	c.log.Infof("ChanCount:%v", c.chanCount)
-	c.log.Infof("Got ChanCount:%v", gotChanCount)
-	c.log.Infof("Once Successed ChanCount:%v", successedChanCount)
-	c.log.Infof("Max Successed ChanCount:%v", c.maxSuccessCount)
-	c.log.Infof("Sent Count:%v", sentCount)
-	c.log.Infof("Sent Bytes(KB):%v", sentBytes/1024)
-	c.log.Infof("Recv Count:%v", recvCount)
-	c.log.Infof("Recv Bytes(KB):%v", recvBytes/1024)
-	c.log.Infof("AVG Recv(kbps):%v", kps)
-	c.log.Infof("Loss:%.2v%%", loss)
-	c.log.Infof("Failed Count:%v", failedCount)
-	c.log.Infof("Avg Latency:%v", latency)
+	c.log.Infof("ChanCount:%v", sum.ChanCount)
+	c.log.Infof("Got ChanCount:%v", sum.GotChanCount)
+	c.log.Infof("Once Successed ChanCount:%v", sum.SuccessedChanCount)
+	c.log.Infof("Max Successed ChanCount:%v", sum.MaxSuccessCount)
+	c.log.Infof("Sent Count:%v", sum.SentCount)
+	c.log.Infof("Sent Bytes(KB):%v", sum.SentBytes/1024)
+	c.log.Infof("Recv Count:%v", sum.RecvCount)
+	c.log.Infof("Recv Bytes(KB):%v", sum.RecvBytes/1024)
+	c.log.Infof("AVG Recv(kbps):%v", sum.Kbps)
+	c.log.Infof("AVG Sent(kbps):%v", sum.SentKbps)
+	c.log.Infof("AVG Target(kbps):%v", sum.TargetKbps)
+	c.log.Infof("Sent(pps):%.1f", sum.SentPps)
+	c.log.Infof("Recv(pps):%.1f", sum.RecvPps)
+	if sum.SentCount > 0 {
+		c.log.Infof("Loss:%.2v%%", sum.Loss)
+	} else {
+		c.log.Infof("Loss:-")
+	}
+	c.log.Infof("Failed Count:%v", sum.FailedCount)
+	c.log.Infof("Failed Count By Code:%v", formatErrCodes(sum.ErrCodes))
+	c.log.Infof("Avg Latency:%v", sum.AvgLatency.Milliseconds())
+	c.log.Infof("Credential Rotations:%v", sum.RotateCount)
+	if sum.AvgJitter > 0 || sum.AvgRtt > 0 {
+		c.log.Infof("RTP Loss:%.2v%%", sum.RtpLoss)
+		c.log.Infof("AVG RTP Jitter(ms):%.1f", float64(sum.AvgJitter.Microseconds())/1000)
+		c.log.Infof("AVG RTCP RTT(ms):%.1f", float64(sum.AvgRtt.Microseconds())/1000)
+	}
+
+	c.logGroups("server", sum.Servers)
+	c.logGroups("profile", sum.Profiles)
+	c.logGroups("direction", sum.Directions)
+	c.logGroups("peer", sum.Peers)
+	c.logGroups("family", sum.Families)
+	c.logSetups(sum.Setups)
+	c.logConnects(sum.Connects)
+
+	return sum
+}
+
+// GroupSummary is the statistics of the channels sharing a server or a traffic profile
+type GroupSummary struct {
+	ChanCount          int
+	SuccessedChanCount int
+	SentCount          int
+	RecvCount          int
+	Kbps               int
+	Loss               float32 // percent
+	FailedCount        int
+	AvgLatency         time.Duration
+}
+
+// groupSummaries sums up the channels by key, lock must be held
+func groupSummaries(chans []*statisticsChan, key func(chanClient *statisticsChan) string) map[string]*GroupSummary {
+	groups := make(map[string]*GroupSummary)
+	byteRecv := make(map[string]uint64)
+	timeEscape := make(map[string]float64)
+	latencyTotal := make(map[string]time.Duration)
+	latencyCount := make(map[string]int)
+
+	for _, chanClient := range chans {
+		name := key(chanClient)
+		group, ok := groups[name]
+		if !ok {
+			group = &GroupSummary{}
+			groups[name] = group
+		}
+
+		group.ChanCount++
+		if chanClient.RecvCount > 0 {
+			group.SuccessedChanCount++
+		}
+		group.SentCount += chanClient.SentCount
+		group.RecvCount += chanClient.RecvCount
+		group.FailedCount += chanClient.ErrCount
+
+		d := chanClient.LastTime.Sub(chanClient.FirstTime).Seconds()
+		if chanClient.RecvBytes > 0 && d > 0 {
+			byteRecv[name] += chanClient.RecvBytes
+			timeEscape[name] += d
+		}
+
+		latencyTotal[name] += chanClient.LatencyTotal
+		latencyCount[name] += chanClient.LatencyCount
+	}
+
+	for name, group := range groups {
+		if group.SentCount > 0 {
+			group.Loss = 100 - float32(group.RecvCount)/float32(group.SentCount)*100
+		}
+
+		if timeEscape[name] != 0 {
+			group.Kbps = int(8 * float64(byteRecv[name]) / timeEscape[name] / 1024)
+		}
+
+		if latencyCount[name] > 0 {
+			group.AvgLatency = latencyTotal[name] / time.Duration(latencyCount[name])
+		}
+	}
+
+	return groups
+}
+
+// logGroups logs the summary of each group when channels are spread over several
+func (c *statisticsClient) logGroups(title string, groups map[string]*GroupSummary) {
+	if len(groups) <= 1 {
+		return
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		// peers in numeric order
+		if len(names[i]) != len(names[j]) && isNumber(names[i]) && isNumber(names[j]) {
+			return len(names[i]) < len(names[j])
+		}
+		return names[i] < names[j]
+	})
+
+	c.log.Infof("----statistics by %s----", title)
+	c.log.Infof("%40s│%6s│%6s│%8s│%8s|%6s|%6s|%6s|%6s",
+		title, "Chans", "OkChan", "Sent", "Recv", "Kbps", "Loss", "Errors", "Latency")
+
+	for _, name := range names {
+		group := groups[name]
+		c.log.Infof("%40s│%6d│%6d│%8d│%8d|%6d|%6s|%6d|%6d",
+			name, group.ChanCount, group.SuccessedChanCount, group.SentCount, group.RecvCount, group.Kbps, formatLoss(group.SentCount, group.Loss), group.FailedCount, group.AvgLatency.Milliseconds())
+	}
 }
 
 func (c *statisticsClient) logDetails() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	c.log.Infof("%6s│%6s│%15s│%6s│%15s|%6s|%6s|%6s|%6s",
-		"chanid", "Sent", "SentBytes(K)", "Recv", "RecvBytes(K)", "Kbps", "Loss", "Errors", "Latency")
+	c.log.Infof("%6s│%6s│%15s│%6s│%15s|%6s|%8s|%8s|%6s|%6s|%6s|%6s",
+		"chanid", "Sent", "SentBytes(K)", "Recv", "RecvBytes(K)", "Kbps", "SentKbps", "Target", "Loss", "Errors", "Latency", "Rotate")
 
 	for chanid := uint64(0); chanid < c.chanCount; chanid++ {
 		chanClient, ok := c.chans[chanid]
@@ -270,9 +749,146 @@ func (c *statisticsClient) logDetails() {
 				loss = 100 - float32(chanClient.RecvCount)/float32(chanClient.SentCount)*100
 			}
 
-			c.log.Infof("%6d│%6d│%15d│%6d│%15d|%6d|%5.1f%%|%6d|%6d",
-				chanid, chanClient.SentCount, chanClient.SentBytes/1024, chanClient.RecvCount, chanClient.RecvBytes/1024, kps, loss, chanClient.ErrCount, latency)
+			c.log.Infof("%6d│%6d│%15d│%6d│%15d|%6d|%8d|%8d|%6s|%6d|%6d|%6d",
+				chanid, chanClient.SentCount, chanClient.SentBytes/1024, chanClient.RecvCount, chanClient.RecvBytes/1024, kps,
+				chanClient.sentKbps(), chanClient.targetBitrate()/1024, formatLoss(chanClient.SentCount, loss), chanClient.ErrCount, latency, chanClient.RotateCount)
 		}
 	}
 	c.log.Info("")
 }
+
+// formatLoss formats a loss percent, "-" when nothing was sent from here to tell it by, e.g. remote peers sending
+func formatLoss(sent int, loss float32) string {
+	if sent == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", loss)
+}
+
+// formatErrCodes formats error counts as "code:count" ordered by code
+func formatErrCodes(errCodes map[int]int) string {
+	codes := make([]int, 0, len(errCodes))
+	for code := range errCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	items := make([]string, 0, len(codes))
+	for _, code := range codes {
+		items = append(items, fmt.Sprintf("%d:%d", code, errCodes[code]))
+	}
+
+	return strings.Join(items, " ")
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// addSetup adds the latency of a setup step, lock must be held
+func (c *statisticsClient) addSetup(result *RequestResults) {
+	buckets, ok := c.setups[result.SetupMethod]
+	if !ok {
+		buckets = make(map[int]*SetupSummary)
+		c.setups[result.SetupMethod] = buckets
+	}
+
+	bucket := setupBucket(result.Peer)
+	setup, ok := buckets[bucket]
+	if !ok {
+		setup = &SetupSummary{}
+		buckets[bucket] = setup
+	}
+
+	setup.add(result.Latency)
+}
+
+// addConnect adds the latency of a connection setup step, lock must be held
+func (c *statisticsClient) addConnect(result *RequestResults) {
+	servers, ok := c.connects[result.ConnectMethod]
+	if !ok {
+		servers = make(map[string]*SetupSummary)
+		c.connects[result.ConnectMethod] = servers
+	}
+
+	connect, ok := servers[result.Server]
+	if !ok {
+		connect = &SetupSummary{}
+		servers[result.Server] = connect
+	}
+
+	connect.add(result.Latency)
+}
+
+func (s *SetupSummary) add(latency time.Duration) {
+	s.Count++
+	s.LatencyTotal += latency
+	if latency > s.MaxLatency {
+		s.MaxLatency = latency
+	}
+}
+
+// logSetups logs the setup latency by how many peers the allocations had
+func (c *statisticsClient) logSetups(setups map[string]map[int]*SetupSummary) {
+	if len(setups) == 0 {
+		return
+	}
+
+	methods := make([]string, 0, len(setups))
+	for method := range setups {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	c.log.Infof("----setup latency by peers----")
+	c.log.Infof("%20s│%12s│%8s│%10s│%10s", "method", "peers", "Count", "Avg(ms)", "Max(ms)")
+
+	for _, method := range methods {
+		buckets := make([]int, 0, len(setups[method]))
+		for bucket := range setups[method] {
+			buckets = append(buckets, bucket)
+		}
+		sort.Ints(buckets)
+
+		for _, bucket := range buckets {
+			setup := setups[method][bucket]
+			peers := strconv.Itoa(bucket)
+			if bucket > 1 {
+				peers = fmt.Sprintf("%d-%d", bucket, bucket*2-1)
+			}
+			c.log.Infof("%20s│%12s│%8d│%10.1f│%10.1f", method, peers, setup.Count,
+				float64(setup.AvgLatency.Microseconds())/1000, float64(setup.MaxLatency.Microseconds())/1000)
+		}
+	}
+}
+
+// logConnects logs the connection setup latency by server
+func (c *statisticsClient) logConnects(connects map[string]map[string]*SetupSummary) {
+	if len(connects) == 0 {
+		return
+	}
+
+	methods := make([]string, 0, len(connects))
+	for method := range connects {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	c.log.Infof("----connection setup latency----")
+	c.log.Infof("%20s│%24s│%8s│%10s│%10s", "method", "server", "Count", "Avg(ms)", "Max(ms)")
+
+	for _, method := range methods {
+		servers := make([]string, 0, len(connects[method]))
+		for server := range connects[method] {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+
+		for _, server := range servers {
+			connect := connects[method][server]
+			c.log.Infof("%20s│%24s│%8d│%10.1f│%10.1f", method, server, connect.Count,
+				float64(connect.AvgLatency.Microseconds())/1000, float64(connect.MaxLatency.Microseconds())/1000)
+		}
+	}
+}
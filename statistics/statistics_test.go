@@ -96,3 +96,116 @@ func TestBasic(t *testing.T) {
 	wg.Wait()
 	canceled()
 }
+
+func TestSentRate(t *testing.T) {
+	ctx, canceled := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer canceled()
+
+	f := logging.DefaultLoggerFactory{
+		DefaultLogLevel: logging.LogLevelWarn,
+	}
+
+	ch := make(chan RequestResults, 1000)
+	req := &StatisticsRequestST{
+		Ctx:       ctx,
+		Log:       f.NewLogger("statistics-test"),
+		ChanCount: 1,
+		Ch:        ch,
+		Summary:   &Summary{},
+	}
+
+	// 1024 bytes each 100ms is 80kbps, the target is 100kbps
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		ch <- RequestResults{
+			Time:          start.Add(time.Millisecond * 100 * time.Duration(i)),
+			IsSent:        true,
+			Bytes:         1024,
+			TargetBitrate: 100 * 1024,
+		}
+	}
+
+	ReceivingResults(req)
+
+	if req.Summary.SentKbps != 80 || req.Summary.TargetKbps != 100 {
+		t.Fatalf("sent %d kbps for target %d kbps", req.Summary.SentKbps, req.Summary.TargetKbps)
+	}
+
+	if req.Summary.SentPps < 9.99 || req.Summary.SentPps > 10.01 {
+		t.Fatalf("sent %.2f pps", req.Summary.SentPps)
+	}
+}
+
+// the rates of channels running side by side add up
+func TestPacketRate(t *testing.T) {
+	ctx, canceled := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer canceled()
+
+	f := logging.DefaultLoggerFactory{
+		DefaultLogLevel: logging.LogLevelWarn,
+	}
+
+	ch := make(chan RequestResults, 1000)
+	req := &StatisticsRequestST{
+		Ctx:       ctx,
+		Log:       f.NewLogger("statistics-test"),
+		ChanCount: 2,
+		Ch:        ch,
+		Summary:   &Summary{},
+	}
+
+	// each channel sends 20 per second and gets every other response
+	start := time.Now()
+	for chanId := uint64(0); chanId < 2; chanId++ {
+		for i := 0; i < 21; i++ {
+			sent := start.Add(time.Millisecond * 50 * time.Duration(i))
+			ch <- RequestResults{ChanID: chanId, Time: sent, IsSent: true, Bytes: 128}
+			if i%2 == 0 {
+				ch <- RequestResults{ChanID: chanId, Time: sent.Add(time.Millisecond), Bytes: 128}
+			}
+		}
+	}
+
+	ReceivingResults(req)
+
+	if req.Summary.SentPps < 39.9 || req.Summary.SentPps > 40.1 || req.Summary.RecvPps < 19.9 || req.Summary.RecvPps > 20.1 {
+		t.Fatalf("sent %.2f pps recv %.2f pps", req.Summary.SentPps, req.Summary.RecvPps)
+	}
+}
+
+// connection setup steps are summed by server apart from the fan-out setup steps
+func TestConnects(t *testing.T) {
+	ctx, canceled := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer canceled()
+
+	f := logging.DefaultLoggerFactory{
+		DefaultLogLevel: logging.LogLevelWarn,
+	}
+
+	ch := make(chan RequestResults, 1000)
+	req := &StatisticsRequestST{
+		Ctx:       ctx,
+		Log:       f.NewLogger("statistics-test"),
+		ChanCount: 1,
+		Ch:        ch,
+		Summary:   &Summary{},
+	}
+
+	now := time.Now()
+	ch <- RequestResults{Time: now, Server: "a", ConnectMethod: "Connect", Latency: time.Millisecond * 10}
+	ch <- RequestResults{Time: now, Server: "a", ConnectMethod: "Connect", Latency: time.Millisecond * 30}
+	ch <- RequestResults{Time: now, Server: "b", ConnectMethod: "Connect", Latency: time.Millisecond * 5}
+	ch <- RequestResults{Time: now, Server: "a", SetupMethod: "ChannelBind", Peer: 1, Latency: time.Millisecond}
+
+	ReceivingResults(req)
+
+	connects := req.Summary.Connects["Connect"]
+	if len(connects) != 2 || connects["a"].Count != 2 || connects["a"].AvgLatency != time.Millisecond*20 ||
+		connects["a"].MaxLatency != time.Millisecond*30 || connects["b"].Count != 1 {
+		t.Fatalf("unexpected connects:%+v", req.Summary.Connects)
+	}
+
+	if len(req.Summary.Setups) != 1 || req.Summary.Setups["ChannelBind"][1].Count != 1 {
+		t.Fatalf("unexpected setups:%+v", req.Summary.Setups)
+	}
+}
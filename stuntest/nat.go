@@ -0,0 +1,456 @@
+package stuntest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/xylophone21/go-turn-test/turntest"
+)
+
+// NAT mapping and filtering behaviors (RFC 4787)
+const (
+	NAT_ENDPOINT_INDEPENDENT   = "endpoint-independent"
+	NAT_ADDRESS_DEPENDENT      = "address-dependent"
+	NAT_ADDRESS_PORT_DEPENDENT = "address-and-port-dependent"
+)
+
+const (
+	// RFC 5780 attributes unknown to pion/stun
+	attrResponsePort   stun.AttrType = 0x0027 // RESPONSE-PORT
+	attrResponseOrigin stun.AttrType = 0x802B // RESPONSE-ORIGIN
+
+	changeIpFlag   = 0x04
+	changePortFlag = 0x02
+
+	// transmits of each discovery request, the RTO doubled each time
+	natTransmits = 3
+
+	// first wait of the binding lifetime test, doubled until LifetimeMax
+	lifetimeFirstWait = time.Second
+)
+
+var errNoResponse = errors.New("no response")
+
+type NatRequestST struct {
+	Ctx            context.Context
+	Log            logging.LeveledLogger
+	StunServerAddr string                 // RFC 5780 capable STUN server address (e.g. "stun:stun.abc.com")
+	Family         turntest.AddressFamily // optional, family to reach a dual-stack server by, either by default
+	Rto            time.Duration          // optional, retransmission timeout doubled each time, 500ms by default
+	LifetimeMax    time.Duration          // optional, longest wait of the binding lifetime test, skipped when 0
+}
+
+// NatResult is the NAT behavior found by DiscoverNat
+type NatResult struct {
+	LocalAddress    string        `json:"localAddress"`
+	MappedAddress   string        `json:"mappedAddress"`
+	OtherAddress    string        `json:"otherAddress"`            // alternate IP and port of the server
+	NoNat           bool          `json:"noNat"`                   // the mapped address is the local one
+	Mapping         string        `json:"mapping"`                 // NAT_*, endpoint-independent when NoNat
+	Filtering       string        `json:"filtering"`               // NAT_*, of a NAT or firewall
+	Hairpinning     bool          `json:"hairpinning"`             // a datagram to the mapped address comes back
+	LifetimeAlive   time.Duration `json:"lifetimeAlive,omitempty"` // longest idle time the binding was seen to survive
+	LifetimeExpired time.Duration `json:"lifetimeExpired,omitempty"`
+	LifetimeError   string        `json:"lifetimeError,omitempty"` // why the lifetime could not be tested
+}
+
+// natResponse is a Binding success response with the address it came from
+type natResponse struct {
+	source *net.UDPAddr
+	mapped *net.UDPAddr
+	origin *net.UDPAddr // RESPONSE-ORIGIN, nil when absent
+	other  *net.UDPAddr // OTHER-ADDRESS, nil when absent
+}
+
+// classifyMapping from the mapped addresses toward the primary address, the alternate IP with the
+// primary port, and the alternate address
+func classifyMapping(primary, alternateIp, alternate string) string {
+	switch {
+	case primary == alternateIp:
+		return NAT_ENDPOINT_INDEPENDENT
+	case alternateIp == alternate:
+		return NAT_ADDRESS_DEPENDENT
+	default:
+		return NAT_ADDRESS_PORT_DEPENDENT
+	}
+}
+
+// classifyFiltering from whether responses from the alternate address and from the alternate port got through
+func classifyFiltering(alternateAddress, alternatePort bool) string {
+	switch {
+	case alternateAddress:
+		return NAT_ENDPOINT_INDEPENDENT
+	case alternatePort:
+		return NAT_ADDRESS_DEPENDENT
+	default:
+		return NAT_ADDRESS_PORT_DEPENDENT
+	}
+}
+
+// DiscoverNat classifies the mapping and filtering of the NAT in front of us with the tests of RFC 5780,
+// then checks hairpinning and, when LifetimeMax is set, how long an idle binding lives
+func DiscoverNat(req *NatRequestST) (*NatResult, error) {
+	if req == nil || req.Ctx == nil || req.Log == nil || req.StunServerAddr == "" || req.LifetimeMax < 0 {
+		return nil, fmt.Errorf("[DiscoverNat]Paramters error")
+	}
+
+	if req.Rto <= 0 {
+		req.Rto = defaultRto
+	}
+
+	uri, err := turntest.ParseStunURI(req.StunServerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("[DiscoverNat]ParseStunURI error:%v", err)
+	}
+	if uri.IsSecure() || uri.Transport != turntest.TRANSPORT_UDP {
+		return nil, fmt.Errorf("[DiscoverNat]only STUN over UDP supported:%s", req.StunServerAddr)
+	}
+
+	network := "udp"
+	switch req.Family {
+	case turntest.FAMILY_IPV4:
+		network = "udp4"
+	case turntest.FAMILY_IPV6:
+		network = "udp6"
+	}
+
+	primary, err := net.ResolveUDPAddr(network, uri.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("[DiscoverNat]ResolveUDPAddr error:%v", err)
+	}
+
+	conn, err := listenNat(network, primary)
+	if err != nil {
+		return nil, fmt.Errorf("[DiscoverNat]listen error:%v", err)
+	}
+	defer conn.Close()
+
+	result := &NatResult{LocalAddress: conn.LocalAddr().String()}
+
+	// mapping test I
+	res1, err := natTransact(req, conn, primary)
+	if err != nil {
+		return nil, fmt.Errorf("[DiscoverNat]binding to %v error:%v", primary, err)
+	}
+	if res1.other == nil {
+		return nil, fmt.Errorf("[DiscoverNat]no OTHER-ADDRESS, %v doesn't support RFC 5780", primary)
+	}
+	if res1.other.IP.Equal(primary.IP) || res1.other.Port == primary.Port {
+		return nil, fmt.Errorf("[DiscoverNat]OTHER-ADDRESS %v doesn't differ from %v in both IP and port", res1.other, primary)
+	}
+	result.MappedAddress = res1.mapped.String()
+	result.OtherAddress = res1.other.String()
+	result.NoNat = result.MappedAddress == result.LocalAddress
+
+	if result.NoNat {
+		result.Mapping = NAT_ENDPOINT_INDEPENDENT
+	} else {
+		// mapping tests II and III
+		res2, err := natTransact(req, conn, &net.UDPAddr{IP: res1.other.IP, Port: primary.Port})
+		if err != nil {
+			return nil, fmt.Errorf("[DiscoverNat]binding to the alternate IP error:%v", err)
+		}
+		mapped3 := res2.mapped.String()
+		if res2.mapped.String() != result.MappedAddress {
+			res3, err := natTransact(req, conn, res1.other)
+			if err != nil {
+				return nil, fmt.Errorf("[DiscoverNat]binding to the alternate address error:%v", err)
+			}
+			mapped3 = res3.mapped.String()
+		}
+		result.Mapping = classifyMapping(result.MappedAddress, res2.mapped.String(), mapped3)
+	}
+
+	// filtering tests II and III, from a new socket so that the mapping tests opened no pinhole
+	filtering, err := listenNat(network, primary)
+	if err != nil {
+		return nil, fmt.Errorf("[DiscoverNat]listen error:%v", err)
+	}
+	defer filtering.Close()
+
+	fromAlternate, err := natChangedTransact(req, filtering, primary, changeIpFlag|changePortFlag, res1.other)
+	if err != nil {
+		return nil, fmt.Errorf("[DiscoverNat]filtering test error:%v", err)
+	}
+	fromAlternatePort := false
+	if !fromAlternate {
+		fromAlternatePort, err = natChangedTransact(req, filtering, primary, changePortFlag, &net.UDPAddr{IP: primary.IP, Port: res1.other.Port})
+		if err != nil {
+			return nil, fmt.Errorf("[DiscoverNat]filtering test error:%v", err)
+		}
+	}
+	result.Filtering = classifyFiltering(fromAlternate, fromAlternatePort)
+
+	result.Hairpinning, err = natHairpinning(req, network, conn, res1.mapped)
+	if err != nil {
+		return nil, fmt.Errorf("[DiscoverNat]hairpinning test error:%v", err)
+	}
+
+	if req.LifetimeMax > 0 {
+		natLifetime(req, network, primary, result)
+	}
+
+	return result, nil
+}
+
+// listenNat opens an unconnected socket on the local address toward server, so that
+// responses from the other addresses of the server come in and the mapped address compares to it
+func listenNat(network string, server *net.UDPAddr) (*net.UDPConn, error) {
+	route, err := net.DialUDP(network, nil, server)
+	if err != nil {
+		return nil, err
+	}
+	local := route.LocalAddr().(*net.UDPAddr)
+	route.Close()
+
+	return net.ListenUDP(network, &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+}
+
+// natTransact sends a Binding request with attrs to dest, retransmitting it until a response with
+// its transaction ID comes in, errNoResponse when none does
+func natTransact(req *NatRequestST, conn *net.UDPConn, dest *net.UDPAddr, attrs ...stun.Setter) (*natResponse, error) {
+	setters := append([]stun.Setter{stun.TransactionID, stun.BindingRequest}, attrs...)
+	msg, err := stun.Build(append(setters, stun.Fingerprint)...)
+	if err != nil {
+		return nil, err
+	}
+
+	rto := req.Rto
+	for i := 0; i < natTransmits; i++ {
+		if req.Ctx.Err() != nil {
+			return nil, req.Ctx.Err()
+		}
+
+		if _, err = conn.WriteToUDP(msg.Raw, dest); err != nil {
+			return nil, err
+		}
+
+		res, err := natRead(conn, msg.TransactionID, time.Now().Add(rto))
+		if err != errNoResponse {
+			return res, err
+		}
+		rto *= 2
+	}
+
+	return nil, errNoResponse
+}
+
+// natRead waits until deadline for the response to transaction id on conn
+func natRead(conn *net.UDPConn, id [stun.TransactionIDSize]byte, deadline time.Time) (*natResponse, error) {
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, errNoResponse
+			}
+			return nil, err
+		}
+
+		msg := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if msg.Decode() != nil || msg.TransactionID != id {
+			// a late response to an earlier request, or something else
+			continue
+		}
+
+		if msg.Type.Class == stun.ClassErrorResponse {
+			var code stun.ErrorCodeAttribute
+			code.GetFrom(msg)
+			return nil, fmt.Errorf("error response %d from %v", code.Code, from)
+		}
+
+		var xorAddr stun.XORMappedAddress
+		if err = xorAddr.GetFrom(msg); err != nil {
+			return nil, fmt.Errorf("no XOR-MAPPED-ADDRESS from %v:%v", from, err)
+		}
+
+		return &natResponse{
+			source: from,
+			mapped: &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port},
+			origin: getPlainAddr(msg, attrResponseOrigin),
+			other:  getPlainAddr(msg, stun.AttrOtherAddress),
+		}, nil
+	}
+}
+
+// natChangedTransact asks primary to answer from expected with CHANGE-REQUEST flags, false when
+// no response got through, an error when the server answered from elsewhere
+func natChangedTransact(req *NatRequestST, conn *net.UDPConn, primary *net.UDPAddr, flags byte, expected *net.UDPAddr) (bool, error) {
+	change := stun.RawAttribute{Type: stun.AttrChangeRequest, Value: []byte{0, 0, 0, flags}}
+	res, err := natTransact(req, conn, primary, change)
+	if err == errNoResponse {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	source := res.source
+	if res.origin != nil {
+		source = res.origin
+	}
+	if !source.IP.Equal(expected.IP) || source.Port != expected.Port {
+		return false, fmt.Errorf("asked for a response from %v, got it from %v, CHANGE-REQUEST not supported", expected, source)
+	}
+	return true, nil
+}
+
+// natHairpinning sends a Binding request from a new socket to mapped, the mapped address of conn,
+// and whether it reaches conn
+func natHairpinning(req *NatRequestST, network string, conn *net.UDPConn, mapped *net.UDPAddr) (bool, error) {
+	other, err := net.ListenUDP(network, &net.UDPAddr{IP: conn.LocalAddr().(*net.UDPAddr).IP})
+	if err != nil {
+		return false, err
+	}
+	defer other.Close()
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(req.Rto * (1<<natTransmits - 1)))
+	defer conn.SetReadDeadline(time.Time{})
+
+	received := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				received <- false
+				return
+			}
+			in := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if in.Decode() == nil && in.TransactionID == msg.TransactionID {
+				received <- true
+				return
+			}
+		}
+	}()
+
+	rto := req.Rto
+	for i := 0; i < natTransmits; i++ {
+		if _, err = other.WriteToUDP(msg.Raw, mapped); err != nil {
+			return false, err
+		}
+
+		select {
+		case ok := <-received:
+			return ok, nil
+		case <-time.After(rto):
+		}
+		rto *= 2
+	}
+
+	return <-received, nil
+}
+
+// natLifetime finds how long a binding lives idle: a socket binds, idles for a wait doubled each time,
+// then another socket asks the server for a response to it with RESPONSE-PORT
+func natLifetime(req *NatRequestST, network string, primary *net.UDPAddr, result *NatResult) {
+	sender, err := listenNat(network, primary)
+	if err != nil {
+		result.LifetimeError = err.Error()
+		return
+	}
+	defer sender.Close()
+
+	// a first round without waiting tells whether the server supports RESPONSE-PORT at all
+	alive, err := natBindingAlive(req, network, primary, sender, 0)
+	if err != nil {
+		result.LifetimeError = err.Error()
+		return
+	}
+	if !alive {
+		result.LifetimeError = "no response to RESPONSE-PORT, not supported by the server or filtered"
+		return
+	}
+
+	for wait := lifetimeFirstWait; wait <= req.LifetimeMax; wait *= 2 {
+		alive, err := natBindingAlive(req, network, primary, sender, wait)
+		if err != nil {
+			result.LifetimeError = err.Error()
+			return
+		}
+		if !alive {
+			result.LifetimeExpired = wait
+			return
+		}
+		result.LifetimeAlive = wait
+	}
+}
+
+// natBindingAlive binds a new socket, idles for wait, then tells whether a response sent to
+// its mapped port on behalf of sender still reaches it
+func natBindingAlive(req *NatRequestST, network string, primary *net.UDPAddr, sender *net.UDPConn, wait time.Duration) (bool, error) {
+	conn, err := listenNat(network, primary)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	res, err := natTransact(req, conn, primary)
+	if err != nil {
+		return false, err
+	}
+
+	req.Log.Infof("[DiscoverNat]binding %v idle for %v", res.mapped, wait)
+	select {
+	case <-req.Ctx.Done():
+		return false, req.Ctx.Err()
+	case <-time.After(wait):
+	}
+
+	port := make([]byte, 4)
+	binary.BigEndian.PutUint16(port, uint16(res.mapped.Port))
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.RawAttribute{Type: attrResponsePort, Value: port}, stun.Fingerprint)
+	if err != nil {
+		return false, err
+	}
+
+	// only conn hears the response, sender retransmits blind
+	rto := req.Rto
+	for i := 0; i < natTransmits; i++ {
+		if _, err = sender.WriteToUDP(msg.Raw, primary); err != nil {
+			return false, err
+		}
+
+		_, err := natRead(conn, msg.TransactionID, time.Now().Add(rto))
+		if err == nil {
+			return true, nil
+		}
+		if err != errNoResponse {
+			return false, err
+		}
+		rto *= 2
+	}
+	return false, nil
+}
+
+// getPlainAddr decodes an address attribute in the MAPPED-ADDRESS format, nil when absent or malformed
+func getPlainAddr(m *stun.Message, t stun.AttrType) *net.UDPAddr {
+	v, err := m.Get(t)
+	if err != nil || len(v) < 4 {
+		return nil
+	}
+
+	port := int(binary.BigEndian.Uint16(v[2:4]))
+	switch {
+	case v[1] == 0x01 && len(v) == 4+net.IPv4len:
+		return &net.UDPAddr{IP: net.IP(append([]byte{}, v[4:]...)), Port: port}
+	case v[1] == 0x02 && len(v) == 4+net.IPv6len:
+		return &net.UDPAddr{IP: net.IP(append([]byte{}, v[4:]...)), Port: port}
+	}
+	return nil
+}
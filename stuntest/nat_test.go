@@ -0,0 +1,97 @@
+package stuntest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/testserver"
+)
+
+func makeNatRequestST(t *testing.T, cfg *testserver.NatServerConfig) *NatRequestST {
+	server, err := testserver.StartNatServer(cfg)
+	if err != nil {
+		t.Skipf("testserver.StartNatServer error:%v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	t.Cleanup(cancel)
+
+	f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevelWarn}
+	return &NatRequestST{
+		Ctx:            ctx,
+		Log:            f.NewLogger("nat-test"),
+		StunServerAddr: server.URI(),
+		Rto:            time.Millisecond * 100,
+	}
+}
+
+func TestClassifyNat(t *testing.T) {
+	mappings := []struct {
+		primary, alternateIp, alternate string
+		want                            string
+	}{
+		{"1.1.1.1:1", "1.1.1.1:1", "1.1.1.1:1", NAT_ENDPOINT_INDEPENDENT},
+		{"1.1.1.1:1", "1.1.1.1:2", "1.1.1.1:2", NAT_ADDRESS_DEPENDENT},
+		{"1.1.1.1:1", "1.1.1.1:2", "1.1.1.1:3", NAT_ADDRESS_PORT_DEPENDENT},
+	}
+	for _, m := range mappings {
+		if got := classifyMapping(m.primary, m.alternateIp, m.alternate); got != m.want {
+			t.Fatalf("mapping %v got %s", m, got)
+		}
+	}
+
+	filterings := []struct {
+		alternateAddress, alternatePort bool
+		want                            string
+	}{
+		{true, false, NAT_ENDPOINT_INDEPENDENT},
+		{false, true, NAT_ADDRESS_DEPENDENT},
+		{false, false, NAT_ADDRESS_PORT_DEPENDENT},
+	}
+	for _, f := range filterings {
+		if got := classifyFiltering(f.alternateAddress, f.alternatePort); got != f.want {
+			t.Fatalf("filtering %v got %s", f, got)
+		}
+	}
+}
+
+func TestDiscoverNat(t *testing.T) {
+	req := makeNatRequestST(t, nil)
+	req.LifetimeMax = time.Second * 2
+
+	result, err := DiscoverNat(req)
+	if err != nil {
+		t.Fatalf("DiscoverNat error:%v", err)
+	}
+	t.Logf("%+v", result)
+
+	// loopback, no NAT in the way
+	if !result.NoNat || result.Mapping != NAT_ENDPOINT_INDEPENDENT || result.Filtering != NAT_ENDPOINT_INDEPENDENT || !result.Hairpinning {
+		t.Fatalf("unexpected result:%+v", result)
+	}
+	if result.LifetimeAlive != time.Second*2 || result.LifetimeExpired != 0 || result.LifetimeError != "" {
+		t.Fatalf("unexpected lifetime:%+v", result)
+	}
+}
+
+func TestDiscoverNatChangeRequestIgnored(t *testing.T) {
+	req := makeNatRequestST(t, &testserver.NatServerConfig{IgnoreChangeRequest: true})
+
+	if result, err := DiscoverNat(req); err == nil {
+		t.Fatalf("CHANGE-REQUEST ignored but got:%+v", result)
+	}
+}
+
+func TestDiscoverNatNoOtherAddress(t *testing.T) {
+	server := testserver.StartTest(t, nil)
+
+	req := makeNatRequestST(t, nil)
+	req.StunServerAddr = "stun:" + server.UDPAddr
+
+	if result, err := DiscoverNat(req); err == nil {
+		t.Fatalf("no OTHER-ADDRESS but got:%+v", result)
+	}
+}
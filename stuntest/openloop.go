@@ -0,0 +1,221 @@
+package stuntest
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	defaultRto     = time.Millisecond * 500
+	defaultTimeout = time.Second * 5
+
+	// requests sent at once to catch up when the ticker fell behind
+	maxCatchUp = 100
+)
+
+// pendingRequest is a request of the open loop waiting for its response
+type pendingRequest struct {
+	raw        []byte
+	start      time.Time // first transmit
+	transmits  int
+	retransmit *time.Timer
+	timeout    *time.Timer
+}
+
+type openLoop struct {
+	req         *StunRequestST
+	conn        net.Conn
+	retransmits int // req.Retransmits, none over TCP/TLS where the stream resends
+
+	lock    sync.Mutex
+	pending map[[stun.TransactionIDSize]byte]*pendingRequest
+}
+
+// doStunRequestOpenLoop starts Binding requests at req.Qps from one socket whatever the responses,
+// each one retransmitted and timed out on its own, until the context ends
+func doStunRequestOpenLoop(req *StunRequestST) {
+	conn, err := dialStunConn(req)
+	if err != nil {
+		if req.Ctx.Err() == nil {
+			req.Log.Warnf("[doStunRequestOpenLoop-%d]dialStunConn error:%s", req.ChanId, err)
+			sendErrorRequestResults(req, 100)
+		}
+		return
+	}
+
+	l := &openLoop{
+		req:         req,
+		conn:        conn,
+		retransmits: req.Retransmits,
+		pending:     make(map[[stun.TransactionIDSize]byte]*pendingRequest),
+	}
+	if req.stream {
+		l.retransmits = 0
+	}
+	defer l.close()
+
+	go l.readLoop()
+
+	interval := time.Duration(float64(time.Second) / req.Qps)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	sent := 0
+	for {
+		select {
+		case <-req.Ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			due := int(now.Sub(start)/interval) - sent
+			if due > maxCatchUp {
+				due = maxCatchUp
+			}
+
+			for i := 0; i < due; i++ {
+				if err := l.send(); err != nil {
+					req.Log.Warnf("[doStunRequestOpenLoop-%d]send error:%s", req.ChanId, err)
+					sendErrorRequestResults(req, 101)
+				}
+			}
+
+			// what the ticker couldn't catch up is dropped rather than sent in a burst later
+			sent = int(now.Sub(start) / interval)
+		}
+	}
+}
+
+// send starts a new request
+func (l *openLoop) send() error {
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return err
+	}
+
+	p := &pendingRequest{raw: msg.Raw, start: time.Now(), transmits: 1}
+
+	l.lock.Lock()
+	l.pending[msg.TransactionID] = p
+	p.timeout = time.AfterFunc(l.req.Timeout, func() { l.expire(msg.TransactionID) })
+	if l.retransmits > 0 {
+		p.retransmit = time.AfterFunc(l.req.Rto, func() { l.resend(msg.TransactionID) })
+	}
+	l.lock.Unlock()
+
+	if _, err = l.conn.Write(msg.Raw); err != nil {
+		l.finish(msg.TransactionID)
+		return err
+	}
+
+	sendSuccessRequestResults(l.req, true, nil)
+	return nil
+}
+
+// resend retransmits a request still without response, doubling the RTO each time
+func (l *openLoop) resend(id [stun.TransactionIDSize]byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	p, ok := l.pending[id]
+	if !ok {
+		return
+	}
+
+	if _, err := l.conn.Write(p.raw); err != nil {
+		l.req.Log.Debugf("[openLoop-%d]retransmit error:%s", l.req.ChanId, err)
+	}
+	p.transmits++
+
+	if p.transmits <= l.retransmits {
+		p.retransmit = time.AfterFunc(l.req.Rto<<uint(p.transmits-1), func() { l.resend(id) })
+	}
+}
+
+// expire reports a request which got no response within the timeout
+func (l *openLoop) expire(id [stun.TransactionIDSize]byte) {
+	if p := l.finish(id); p != nil {
+		l.req.Log.Debugf("[openLoop-%d]timeout after %d transmits", l.req.ChanId, p.transmits)
+		sendErrorRequestResults(l.req, ERRCODE_STUN_TIMEOUT)
+	}
+}
+
+// finish ends a pending request, nil when it already ended
+func (l *openLoop) finish(id [stun.TransactionIDSize]byte) *pendingRequest {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	p, ok := l.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(l.pending, id)
+
+	p.timeout.Stop()
+	if p.retransmit != nil {
+		p.retransmit.Stop()
+	}
+	return p
+}
+
+func (l *openLoop) readLoop() {
+	buf := make([]byte, 1500)
+	for {
+		n, err := l.conn.Read(buf)
+		if err != nil {
+			// a broken stream stays broken, the requests still pending time out
+			if l.req.Ctx.Err() != nil || l.req.stream {
+				return
+			}
+
+			// e.g. ICMP port unreachable on the connected socket, the requests time out
+			l.req.Log.Debugf("[openLoop-%d]conn.Read error:%s", l.req.ChanId, err)
+			continue
+		}
+
+		msg := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if err = msg.Decode(); err != nil {
+			l.req.Log.Debugf("[openLoop-%d]msg.Decode error:%s", l.req.ChanId, err)
+			continue
+		}
+
+		p := l.finish(msg.TransactionID)
+		if p == nil {
+			// a response to a retransmit, or too late
+			continue
+		}
+		latency := time.Since(p.start)
+
+		if msg.Type.Class == stun.ClassErrorResponse {
+			sendErrorRequestResults(l.req, ERRCODE_STUN_ERROR_RESPONSE)
+			continue
+		}
+
+		var xorAddr stun.XORMappedAddress
+		if err = xorAddr.GetFrom(msg); err != nil {
+			l.req.Log.Warnf("[openLoop-%d]xorAddr.GetFrom error:%s", l.req.ChanId, err)
+			sendErrorRequestResults(l.req, 201)
+			continue
+		}
+
+		sendSuccessRequestResults(l.req, false, &latency)
+	}
+}
+
+// close stops the timers of the requests still pending, they are neither answered nor timed out
+func (l *openLoop) close() {
+	l.lock.Lock()
+	for id, p := range l.pending {
+		p.timeout.Stop()
+		if p.retransmit != nil {
+			p.retransmit.Stop()
+		}
+		delete(l.pending, id)
+	}
+	l.lock.Unlock()
+
+	l.conn.Close()
+}
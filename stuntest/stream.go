@@ -0,0 +1,95 @@
+package stuntest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/xylophone21/go-turn-test/statistics"
+)
+
+const (
+	SETUP_CONNECT       = "Connect"
+	SETUP_TLS_HANDSHAKE = "TlsHandshake"
+
+	stunHeaderSize = 20
+)
+
+func sendConnectRequestResults(req *StunRequestST, method string, latency time.Duration) {
+	if req.Ch != nil {
+		result := statistics.RequestResults{
+			ChanID:        req.ChanId,
+			Time:          time.Now(),
+			Latency:       latency,
+			Server:        req.StunServerAddr,
+			ConnectMethod: method,
+		}
+
+		req.Ch <- result
+	}
+}
+
+// dialStunConn opens a connection to the STUN server by the transport of its URI, timing the TCP connect
+// and the TLS handshake apart from the Binding requests
+func dialStunConn(req *StunRequestST) (net.Conn, error) {
+	if !req.stream {
+		return net.Dial(req.network, req.stunAddr)
+	}
+
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(req.Ctx, req.network, req.stunAddr)
+	if err != nil {
+		return nil, err
+	}
+	sendConnectRequestResults(req, SETUP_CONNECT, time.Since(start))
+
+	if req.secure {
+		cfg := &tls.Config{}
+		if req.TlsConfig != nil {
+			cfg = req.TlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = req.serverName
+		}
+
+		start = time.Now()
+		tlsConn := tls.Client(conn, cfg)
+		if err = tlsConn.HandshakeContext(req.Ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		sendConnectRequestResults(req, SETUP_TLS_HANDSHAKE, time.Since(start))
+		conn = tlsConn
+	}
+
+	return &stunStreamConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// stunStreamConn reads one STUN message at a time from a TCP or TLS stream, as each Read of a UDP socket does
+type stunStreamConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads the next message into b, a message longer than b is dropped whole with io.ErrShortBuffer,
+// so that the stream stays in sync
+func (c *stunStreamConn) Read(b []byte) (int, error) {
+	header, err := c.r.Peek(stunHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+
+	size := stunHeaderSize + int(binary.BigEndian.Uint16(header[2:4]))
+	if len(b) < size {
+		if _, err = c.r.Discard(size); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+
+	return io.ReadFull(c.r, b[:size])
+}
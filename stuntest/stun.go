@@ -2,6 +2,8 @@ package stuntest
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -9,14 +11,35 @@ import (
 	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/xylophone21/go-turn-test/statistics"
+	"github.com/xylophone21/go-turn-test/turntest"
+)
+
+const (
+	ERRCODE_STUN_TIMEOUT        = 202 // no response, retransmits included
+	ERRCODE_STUN_ERROR_RESPONSE = 203 // error response from the server
+
+	stunPackageBytes = 128 // bytes reported for each request or response, so that kbps = qps
 )
 
 type StunRequestST struct {
 	Ctx            context.Context
 	Log            logging.LeveledLogger
 	ChanId         uint64
-	StunServerAddr string // STUN server address (e.g. "stun.abc.com:3478")
+	StunServerAddr string                 // STUN server address (e.g. "stun.abc.com:3478", "stun:stun.abc.com?transport=tcp" or "stuns:stun.abc.com:443")
+	TlsConfig      *tls.Config            // optional, for stuns: servers
+	Family         turntest.AddressFamily // optional, family to reach a dual-stack server by, either by default
+	ReuseSocket    bool                   // one socket for all requests of the channel, a new 5-tuple each request otherwise, the open loop always reuses
+	Qps            float64                // optional, requests per second started whatever the responses (open loop), one at a time when 0
+	Rto            time.Duration          // optional, open loop retransmission timeout doubled each time, 500ms by default, also the wait before dialing again after a failure
+	Retransmits    int                    // optional, open loop retransmits of a request without response, none when 0 and over TCP, the closed loop retransmits by the schedule of pion/stun
+	Timeout        time.Duration          // optional, open loop wait for a response since the first transmit, 5s by default, the closed loop times out by the schedule of pion/stun
 	Ch             chan statistics.RequestResults
+
+	stunAddr   string // "host:port" parsed from StunServerAddr
+	serverName string // host parsed from StunServerAddr, to verify the certificate of stuns: servers by
+	network    string // udp or tcp, with 4 or 6 by Family
+	stream     bool   // over TCP or TLS, framed by stunStreamConn and not retransmitted
+	secure     bool   // over TLS
 }
 
 func sendErrorRequestResults(req *StunRequestST, errCode int) {
@@ -25,6 +48,7 @@ func sendErrorRequestResults(req *StunRequestST, errCode int) {
 			ChanID:  req.ChanId,
 			Time:    time.Now(),
 			ErrCode: errCode,
+			Server:  req.StunServerAddr,
 		}
 
 		req.Ch <- result
@@ -38,10 +62,13 @@ func sendSuccessRequestResults(req *StunRequestST, isSent bool, latency *time.Du
 			Time:    time.Now(),
 			ErrCode: 0,
 			IsSent:  isSent,
-			Bytes:   128, //128bytes each package, so kbps = qps
+			Bytes:   stunPackageBytes,
+			Server:  req.StunServerAddr,
 		}
 
-		if !isSent {
+		if isSent {
+			result.TargetBitrate = uint64(req.Qps * stunPackageBytes * 8)
+		} else {
 			result.Latency = *latency
 		}
 
@@ -51,19 +78,90 @@ func sendSuccessRequestResults(req *StunRequestST, isSent bool, latency *time.Du
 	}
 }
 
-func doStunRequest(req *StunRequestST) {
-	var wg sync.WaitGroup
-	wg.Add(1)
+func dialStunClient(req *StunRequestST) (*stun.Client, error) {
+	conn, err := dialStunConn(req)
+	if err != nil {
+		// the request ending cuts the connect or the handshake short, that is no failure of the server
+		if req.Ctx.Err() == nil {
+			req.Log.Warnf("[dialStunClient-%d]dialStunConn error:%s", req.ChanId, err)
+			sendErrorRequestResults(req, 100)
+		}
+		return nil, err
+	}
+
+	// the kernel resends lost segments of TCP, a stream request only times out
+	var options []stun.ClientOption
+	if req.stream {
+		options = append(options, stun.WithNoRetransmit)
+	}
 
-	c, err := stun.Dial("udp", req.StunServerAddr)
+	c, err := stun.NewClient(conn, options...)
 	if err != nil {
-		req.Log.Warnf("[doStunRequest-%d]stun.Dial error:%s", req.ChanId, err)
+		conn.Close()
+		req.Log.Warnf("[dialStunClient-%d]stun.NewClient error:%s", req.ChanId, err)
 		sendErrorRequestResults(req, 100)
+		return nil, err
+	}
+
+	c.SetRTO(time.Second * 5)
+	return c, nil
+}
+
+// doStunRequest sends one Binding request from a new 5-tuple
+func doStunRequest(req *StunRequestST) {
+	c, err := dialStunClient(req)
+	if err != nil {
+		redialWait(req)
 		return
 	}
 	defer c.Close()
 
-	c.SetRTO(time.Second * 5)
+	doBinding(req, c)
+}
+
+// redialWait waits an RTO before dialing again after a failure, so that a server refusing or closing
+// the connections doesn't turn the loop into a busy one
+func redialWait(req *StunRequestST) {
+	timer := time.NewTimer(req.Rto)
+	defer timer.Stop()
+
+	select {
+	case <-req.Ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// doStunRequestReuse sends Binding requests one at a time over one client, so that the server sees
+// a single flow, dialing again only when the client breaks
+func doStunRequestReuse(req *StunRequestST) {
+	var c *stun.Client
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	for req.Ctx.Err() == nil {
+		if c == nil {
+			var err error
+			if c, err = dialStunClient(req); err != nil {
+				redialWait(req)
+				continue
+			}
+		}
+
+		if err := doBinding(req, c); err != nil {
+			c.Close()
+			c = nil
+			redialWait(req)
+		}
+	}
+}
+
+// doBinding sends a Binding request over c and waits for its result, an error means c can't send
+func doBinding(req *StunRequestST, c *stun.Client) error {
+	var wg sync.WaitGroup
+	wg.Add(1)
 
 	msg := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
 	var start time.Time
@@ -72,20 +170,32 @@ func doStunRequest(req *StunRequestST) {
 		defer wg.Done()
 		end := time.Now()
 
+		if errors.Is(res.Error, stun.ErrTransactionTimeOut) {
+			req.Log.Warnf("[doBinding-%d]handler error:%s", req.ChanId, res.Error)
+			sendErrorRequestResults(req, ERRCODE_STUN_TIMEOUT)
+			return
+		}
+
 		if res.Error != nil {
-			req.Log.Warnf("[doStunRequest-%d]handler error:%s", req.ChanId, err)
+			req.Log.Warnf("[doBinding-%d]handler error:%s", req.ChanId, res.Error)
 			sendErrorRequestResults(req, 200)
 			return
 		}
+
+		if res.Message.Type.Class == stun.ClassErrorResponse {
+			req.Log.Warnf("[doBinding-%d]error response", req.ChanId)
+			sendErrorRequestResults(req, ERRCODE_STUN_ERROR_RESPONSE)
+			return
+		}
 		var xorAddr stun.XORMappedAddress
 		if getErr := xorAddr.GetFrom(res.Message); getErr != nil {
-			req.Log.Warnf("[doStunRequest-%d]xorAddr.GetFrom error:%s", req.ChanId, getErr)
+			req.Log.Warnf("[doBinding-%d]xorAddr.GetFrom error:%s", req.ChanId, getErr)
 			sendErrorRequestResults(req, 201)
 			return
 		}
 
 		if res.Message.TransactionID != msg.TransactionID {
-			req.Log.Warnf("[doStunRequest-%d]TransactionID differ", req.ChanId)
+			req.Log.Warnf("[doBinding-%d]TransactionID differ", req.ChanId)
 			sendErrorRequestResults(req, 201)
 			return
 		}
@@ -95,14 +205,15 @@ func doStunRequest(req *StunRequestST) {
 	}
 
 	start = time.Now()
-	if err = c.Start(msg, handler); err != nil {
-		req.Log.Warnf("[doStunRequest-%d]c.Start error:%s", req.ChanId, err)
+	if err := c.Start(msg, handler); err != nil {
+		req.Log.Warnf("[doBinding-%d]c.Start error:%s", req.ChanId, err)
 		sendErrorRequestResults(req, 101)
-		return
+		return err
 	}
 	sendSuccessRequestResults(req, true, nil)
 
 	wg.Wait()
+	return nil
 }
 
 func StunRequest(req *StunRequestST) error {
@@ -111,11 +222,51 @@ func StunRequest(req *StunRequestST) error {
 		return err
 	}
 
-	if req.Ctx == nil || req.Log == nil || req.StunServerAddr == "" {
+	if req.Ctx == nil || req.Log == nil || req.StunServerAddr == "" || req.Qps < 0 || req.Retransmits < 0 || req.Qps == 0 && req.Retransmits > 0 {
 		err := fmt.Errorf("[StunRequest-%d]Paramters error", req.ChanId)
 		return err
 	}
 
+	if req.Rto <= 0 {
+		req.Rto = defaultRto
+	}
+
+	if req.Timeout <= 0 {
+		req.Timeout = defaultTimeout
+	}
+
+	uri, err := turntest.ParseStunURI(req.StunServerAddr)
+	if err != nil {
+		return fmt.Errorf("[StunRequest-%d]ParseStunURI error:%v", req.ChanId, err)
+	}
+
+	req.stunAddr = uri.Addr()
+	req.serverName = uri.Host
+	req.stream = uri.Transport == turntest.TRANSPORT_TCP
+	req.secure = uri.IsSecure()
+
+	req.network = "udp"
+	if req.stream {
+		req.network = "tcp"
+	}
+
+	switch req.Family {
+	case turntest.FAMILY_IPV4:
+		req.network += "4"
+	case turntest.FAMILY_IPV6:
+		req.network += "6"
+	}
+
+	if req.Qps > 0 {
+		doStunRequestOpenLoop(req)
+		return nil
+	}
+
+	if req.ReuseSocket {
+		doStunRequestReuse(req)
+		return nil
+	}
+
 	for {
 		// timeout or canceled, return
 		select {
@@ -1,26 +1,30 @@
 package stuntest
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"os"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/xylophone21/go-turn-test/statistics"
+	"github.com/xylophone21/go-turn-test/testdata"
+	"github.com/xylophone21/go-turn-test/testserver"
+	"github.com/xylophone21/go-turn-test/turntest"
 )
 
-var basicStunUrl string
-
-func init() {
-	basicStunUrl = os.Getenv("stunUrl")
-}
-
-func makeStunRequestST(StunServerAddr string) *StunRequestST {
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*15)
+func makeStunRequestST(StunServerAddr string) (*StunRequestST, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 
 	f := logging.DefaultLoggerFactory{
-		DefaultLogLevel: logging.LogLevelTrace,
+		DefaultLogLevel: logging.LogLevelWarn,
 	}
 	log := f.NewLogger("stun-test")
 
@@ -29,25 +33,346 @@ func makeStunRequestST(StunServerAddr string) *StunRequestST {
 	req.Log = log
 	req.ChanId = 888
 	req.StunServerAddr = StunServerAddr
-	req.Ch = make(chan statistics.RequestResults)
+	req.Ch = make(chan statistics.RequestResults, 1000)
 
 	log.Infof("StunServerAddr=%s", StunServerAddr)
 
+	return &req, cancel
+}
+
+// collect runs the request until its context ends and collects the results it reported
+func collect(t *testing.T, req *StunRequestST) testserver.Results {
+	var err error
+	results := testserver.Collect(req.Ch, func() { err = StunRequest(req) })
+	if err != nil {
+		t.Fatalf("StunRequest error:%v", err)
+	}
+
+	t.Logf("%v", results)
+	return results
+}
+
+// setups results the setup steps of method
+func connectSteps(results testserver.Results, method string) int {
+	return results.Count(func(result *statistics.RequestResults) bool { return result.ConnectMethod == method })
+}
+
+func TestBasic(t *testing.T) {
+	server := testserver.StartTest(t, nil)
+
+	req, cancel := makeStunRequestST("stun:" + server.UDPAddr)
+	defer cancel()
+
+	results := collect(t, req)
+	if results.Recv() < 10 || results.Recv() != results.Sent() || len(results.ErrCodes()) != 0 {
+		t.Fatalf("unexpected results:%v", results)
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	server, err := testserver.Start(&testserver.ServerConfig{DualStack: true})
+	if err != nil {
+		t.Skipf("no IPv6 loopback, testserver.Start error:%v", err)
+	}
+	defer server.Close()
+
+	req, cancel := makeStunRequestST("stun:" + server.UDP6Addr)
+	defer cancel()
+	req.Family = turntest.FAMILY_IPV6
+
+	results := collect(t, req)
+	if results.Recv() < 10 || results.Recv() != results.Sent() || len(results.ErrCodes()) != 0 {
+		t.Fatalf("unexpected results:%v", results)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	if testdata.BasicStunUrl == "" {
+		t.Skip("stunUrl not set")
+	}
+
+	req, cancel := makeStunRequestST(testdata.BasicStunUrl)
+	defer cancel()
+
+	results := collect(t, req)
+	if results.Recv() == 0 {
+		t.Fatalf("no response:%v", results)
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := testserver.StartTest(t, nil)
+
+	streams := []struct {
+		uri   string
+		tls   bool
+		reuse bool
+		qps   float64
+	}{
+		{"stun:" + server.TCPAddr + "?transport=tcp", false, false, 0},
+		{"stuns:" + server.TLSAddr, true, false, 0},
+		{"stuns:" + server.TLSAddr, true, true, 0},
+		{"stuns:" + server.TLSAddr, true, false, 50},
+	}
+
+	for _, stream := range streams {
+		req, cancel := makeStunRequestST(stream.uri)
+		req.TlsConfig = server.TlsConfig
+		req.ReuseSocket = stream.reuse
+		req.Qps = stream.qps
+		if stream.qps > 0 {
+			req.Retransmits = 2
+		}
+
+		results := collect(t, req)
+		cancel()
+		if stream.qps > 0 && req.Retransmits != 2 {
+			t.Fatalf("%+v retransmits of the request changed to %d", stream, req.Retransmits)
+		}
+		if results.Recv() < 10 || results.Recv() < results.Sent()-1 || len(results.ErrCodes()) != 0 {
+			t.Fatalf("%+v unexpected results:%v", stream, results)
+		}
+
+		// a connection for each request, the last one may end with the context before sending, or one for all
+		connects := connectSteps(results, SETUP_CONNECT)
+		if stream.reuse || stream.qps > 0 {
+			if connects != 1 {
+				t.Fatalf("%+v %d connections", stream, connects)
+			}
+		} else if connects < results.Sent() || connects > results.Sent()+1 {
+			t.Fatalf("%+v %d connections for %d requests", stream, connects, results.Sent())
+		}
+
+		if handshakes := connectSteps(results, SETUP_TLS_HANDSHAKE); stream.tls && handshakes != connects || !stream.tls && handshakes != 0 {
+			t.Fatalf("%+v %d handshakes for %d connections", stream, handshakes, connects)
+		}
+	}
+}
+
+// a server accepting connections but never answering the handshake doesn't outlive the request,
+// and the handshake cut short by the request ending is no error
+func TestStreamHandshakeCanceled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error:%v", err)
+	}
+	defer listener.Close()
+
 	go func() {
-		for ret := range req.Ch {
-			if ret.ErrCode != 0 {
-				req.Log.Infof("get:%v", ret.ErrCode)
-			} else {
-				req.Log.Infof("IsSent=%v Latency=%v", ret.IsSent, ret.Latency)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
 			}
+			defer conn.Close()
 		}
+	}()
+
+	req, cancel := makeStunRequestST("stuns:" + listener.Addr().String())
+	defer cancel()
+
+	start := time.Now()
+	results := collect(t, req)
+	if elapsed := time.Since(start); elapsed > time.Second*3 || results.Sent() != 0 || len(results.ErrCodes()) != 0 {
+		t.Fatalf("handshake not canceled after %v:%v", elapsed, results)
+	}
+}
+
+func TestStreamUntrusted(t *testing.T) {
+	server := testserver.StartTest(t, nil)
+
+	req, cancel := makeStunRequestST("stuns:" + server.TLSAddr)
+	defer cancel()
+
+	results := collect(t, req)
+	if results.Sent() != 0 || results.ErrCodes()[100] == 0 || connectSteps(results, SETUP_TLS_HANDSHAKE) != 0 {
+		t.Fatalf("self-signed certificate trusted:%v", results)
+	}
+}
+
+// a server refusing the connections is dialed again an RTO later, not in a busy loop
+func TestRedialWait(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error:%v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	for _, reuse := range []bool{false, true} {
+		req, cancel := makeStunRequestST("stun:" + addr + "?transport=tcp")
+		req.ReuseSocket = reuse
 
+		// 2s of 500ms RTOs
+		results := collect(t, req)
+		cancel()
+		if refused := results.ErrCodes()[100]; refused == 0 || refused > 5 {
+			t.Fatalf("reuse %v dialed %d times", reuse, refused)
+		}
+	}
+}
+
+// the closed loop retransmits by the schedule of pion/stun
+func TestRetransmitsNeedQps(t *testing.T) {
+	req, cancel := makeStunRequestST("stun:127.0.0.1:3478")
+	defer cancel()
+	req.Retransmits = 2
+
+	if StunRequest(req) == nil {
+		t.Fatalf("retransmits without qps accepted")
+	}
+}
+
+func TestOpenLoop(t *testing.T) {
+	server := testserver.StartTest(t, nil)
+
+	req, cancel := makeStunRequestST("stun:" + server.UDPAddr)
+	defer cancel()
+	req.Qps = 200
+
+	// 2 seconds at 200 qps, the last ones may be unanswered when the context ends
+	results := collect(t, req)
+	if results.Sent() < 300 || results.Sent() > 420 || results.Recv() < results.Sent()-10 || len(results.ErrCodes()) != 0 {
+		t.Fatalf("unexpected results:%v", results)
+	}
+}
+
+type fakeServer struct {
+	conn     net.PacketConn
+	received int32 // datagrams
+
+	lock    sync.Mutex
+	sources map[string]bool // 5-tuples the datagrams came from
+}
+
+// startFakeServer results the datagrams it gets and their sources, answering each by reply when not nil
+func startFakeServer(t *testing.T, reply func(req *stun.Message, from net.Addr) *stun.Message) *fakeServer {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error:%v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &fakeServer{conn: conn, sources: make(map[string]bool)}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.received, 1)
+			s.lock.Lock()
+			s.sources[from.String()] = true
+			s.lock.Unlock()
+
+			msg := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if reply == nil || msg.Decode() != nil {
+				continue
+			}
+			if res := reply(msg, from); res != nil {
+				conn.WriteTo(res.Raw, from)
+			}
+		}
 	}()
 
-	return &req
+	return s
 }
 
-func TestBasic(t *testing.T) {
-	req := makeStunRequestST(basicStunUrl)
-	StunRequest(req)
+func (s *fakeServer) addr() string {
+	return "stun:" + s.conn.LocalAddr().String()
+}
+
+func (s *fakeServer) sourceCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.sources)
+}
+
+func TestOpenLoopTimeout(t *testing.T) {
+	server := startFakeServer(t, nil)
+
+	req, cancel := makeStunRequestST(server.addr())
+	defer cancel()
+	req.Qps = 20
+	req.Rto = time.Millisecond * 100
+	req.Retransmits = 2
+	req.Timeout = time.Millisecond * 500
+
+	results := collect(t, req)
+	timeouts := results.ErrCodes()[ERRCODE_STUN_TIMEOUT]
+	if results.Recv() != 0 || timeouts < results.Sent()-15 || len(results.ErrCodes()) != 1 {
+		t.Fatalf("unexpected results:%v", results)
+	}
+
+	// retransmitted at 100ms and 300ms, then timed out at 500ms
+	if got := int(atomic.LoadInt32(&server.received)); got < results.Sent()*3-30 || got > results.Sent()*3 {
+		t.Fatalf("%d datagrams for %d requests", got, results.Sent())
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	server := startFakeServer(t, func(req *stun.Message, from net.Addr) *stun.Message {
+		return stun.MustBuild(req, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), stun.CodeServerError)
+	})
+
+	for _, qps := range []float64{0, 50} {
+		req, cancel := makeStunRequestST(server.addr())
+		req.Qps = qps
+
+		results := collect(t, req)
+		cancel()
+		if results.Recv() != 0 || results.ErrCodes()[ERRCODE_STUN_ERROR_RESPONSE] < 10 || len(results.ErrCodes()) != 1 {
+			t.Fatalf("qps %v unexpected results:%v", qps, results)
+		}
+	}
+}
+
+func TestReuseSocket(t *testing.T) {
+	for _, reuse := range []bool{false, true} {
+		server := startFakeServer(t, func(req *stun.Message, from net.Addr) *stun.Message {
+			addr := from.(*net.UDPAddr)
+			return stun.MustBuild(req, stun.BindingSuccess, &stun.XORMappedAddress{IP: addr.IP, Port: addr.Port})
+		})
+
+		req, cancel := makeStunRequestST(server.addr())
+		req.ReuseSocket = reuse
+
+		results := collect(t, req)
+		cancel()
+		if results.Recv() < 10 || results.Recv() != results.Sent() || len(results.ErrCodes()) != 0 {
+			t.Fatalf("reuse %v unexpected results:%v", reuse, results)
+		}
+
+		// each request from a new 5-tuple, the kernel may hand a port out again, or all from one
+		if sources := server.sourceCount(); reuse && sources != 1 || !reuse && sources < results.Sent()/2 {
+			t.Fatalf("reuse %v %d sources for %d requests", reuse, sources, results.Sent())
+		}
+	}
+}
+
+// a message too long for the buffer is dropped whole and the next one reads fine
+func TestStreamShortBuffer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	long := stun.MustBuild(stun.TransactionID, stun.BindingSuccess, stun.NewSoftware(strings.Repeat("x", 200)))
+	short := stun.MustBuild(stun.TransactionID, stun.BindingSuccess)
+	go func() {
+		server.Write(long.Raw)
+		server.Write(short.Raw)
+	}()
+
+	conn := &stunStreamConn{Conn: client, r: bufio.NewReader(client)}
+	buf := make([]byte, 100)
+	if _, err := conn.Read(buf); err != io.ErrShortBuffer {
+		t.Fatalf("long message read:%v", err)
+	}
+
+	n, err := conn.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], short.Raw) {
+		t.Fatalf("stream out of sync, read %d bytes:%v", n, err)
+	}
 }
@@ -8,6 +8,7 @@ var BasicTurnUsername string
 var BasicTurnPassword string
 var AwsDeviceId string
 var AwsToken string
+var AwsApiUrl string
 
 func init() {
 	BasicStunUrl = os.Getenv("stunUrl")
@@ -16,4 +17,5 @@ func init() {
 	BasicTurnPassword = os.Getenv("turnPassword")
 	AwsDeviceId = os.Getenv("deviceId")
 	AwsToken = os.Getenv("token")
+	AwsApiUrl = os.Getenv("apiUrl")
 }
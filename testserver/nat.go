@@ -0,0 +1,158 @@
+package testserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// the alternate IP of the NAT behavior discovery server, 127.0.0.0/8 is all loopback on Linux
+	alternateLoopbackIp = "127.0.0.2"
+
+	natServerTries = 20
+
+	// RFC 5780 attributes unknown to pion/stun
+	attrResponsePort   stun.AttrType = 0x0027 // RESPONSE-PORT
+	attrResponseOrigin stun.AttrType = 0x802B // RESPONSE-ORIGIN
+
+	changeIpFlag   = 0x04
+	changePortFlag = 0x02
+)
+
+type NatServerConfig struct {
+	IgnoreChangeRequest bool // answer from the socket asked whatever CHANGE-REQUEST says, as plain STUN servers do
+}
+
+// NatServer is a STUN server for NAT behavior discovery (RFC 5780) answering Binding requests on
+// 127.0.0.1 and 127.0.0.2, each with a primary and an alternate port
+type NatServer struct {
+	Addr      string // "127.0.0.1:port" primary address
+	OtherAddr string // "127.0.0.2:port" alternate IP and alternate port
+
+	cfg   NatServerConfig
+	conns map[natSocket]*net.UDPConn
+}
+
+// natSocket is one of the four sockets of a NatServer
+type natSocket struct {
+	alternateIp   bool
+	alternatePort bool
+}
+
+// StartNatServer listens on the same pair of ports on both loopback IPs
+func StartNatServer(cfg *NatServerConfig) (*NatServer, error) {
+	if cfg == nil {
+		cfg = &NatServerConfig{}
+	}
+
+	for try := 0; try < natServerTries; try++ {
+		s, err := listenNatServer(cfg)
+		if err == nil {
+			return s, nil
+		}
+	}
+
+	return nil, errors.New("no free pair of ports on both loopback IPs")
+}
+
+func listenNatServer(cfg *NatServerConfig) (*NatServer, error) {
+	s := &NatServer{cfg: *cfg, conns: make(map[natSocket]*net.UDPConn)}
+
+	// the ports the kernel picks on the primary IP, hoping they are free on the alternate one too
+	var ports []int
+	for _, alternatePort := range []bool{false, true} {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(loopbackIp)})
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.conns[natSocket{alternatePort: alternatePort}] = conn
+		ports = append(ports, conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+
+	for i, alternatePort := range []bool{false, true} {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(alternateLoopbackIp), Port: ports[i]})
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.conns[natSocket{alternateIp: true, alternatePort: alternatePort}] = conn
+	}
+
+	s.Addr = net.JoinHostPort(loopbackIp, strconv.Itoa(ports[0]))
+	s.OtherAddr = net.JoinHostPort(alternateLoopbackIp, strconv.Itoa(ports[1]))
+
+	for socket, conn := range s.conns {
+		go s.serve(socket, conn)
+	}
+	return s, nil
+}
+
+// URI returns the stun: URI of the primary address
+func (s *NatServer) URI() string {
+	return "stun:" + s.Addr
+}
+
+func (s *NatServer) Close() error {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// serve answers the Binding requests to socket, from the socket CHANGE-REQUEST asks for
+func (s *NatServer) serve(socket natSocket, conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if req.Decode() != nil || req.Type != stun.BindingRequest {
+			continue
+		}
+
+		changeIp, changePort := false, false
+		if v, err := req.Get(stun.AttrChangeRequest); err == nil && len(v) == 4 && !s.cfg.IgnoreChangeRequest {
+			changeIp = v[3]&changeIpFlag != 0
+			changePort = v[3]&changePortFlag != 0
+		}
+
+		to := from
+		if v, err := req.Get(attrResponsePort); err == nil && len(v) == 4 {
+			to = &net.UDPAddr{IP: from.IP, Port: int(binary.BigEndian.Uint16(v))}
+		}
+
+		answer := s.conns[natSocket{alternateIp: socket.alternateIp != changeIp, alternatePort: socket.alternatePort != changePort}]
+		res, err := stun.Build(req, stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: from.IP, Port: from.Port},
+			plainAddr{Type: attrResponseOrigin, Addr: answer.LocalAddr().(*net.UDPAddr)},
+			plainAddr{Type: stun.AttrOtherAddress, Addr: s.conns[natSocket{alternateIp: true, alternatePort: true}].LocalAddr().(*net.UDPAddr)},
+			stun.Fingerprint)
+		if err != nil {
+			continue
+		}
+		answer.WriteToUDP(res.Raw, to)
+	}
+}
+
+// plainAddr is an IPv4 address attribute in the MAPPED-ADDRESS format
+type plainAddr struct {
+	Type stun.AttrType
+	Addr *net.UDPAddr
+}
+
+func (a plainAddr) AddTo(m *stun.Message) error {
+	v := make([]byte, 8)
+	v[1] = 0x01
+	binary.BigEndian.PutUint16(v[2:], uint16(a.Addr.Port))
+	copy(v[4:], a.Addr.IP.To4())
+	m.Add(a.Type, v)
+	return nil
+}
@@ -0,0 +1,287 @@
+package testserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+const (
+	ProviderPath = "/v1/call"
+
+	defaultProviderTTL = time.Hour
+)
+
+// ProviderReply scripts one answer of the provider, the zero value is a normal success
+type ProviderReply struct {
+	Status  int           // HTTP status, 200 when zero
+	Code    int           // "code" of the response body, 0 is success
+	Message string        // "message" of the response body
+	Delay   time.Duration // wait before answering
+	Expired bool          // hand out credentials which expired already
+}
+
+type ProviderConfig struct {
+	Listen   string        // HTTP listening address, "127.0.0.1:0" when empty
+	Token    string        // optional, requests with another token get code 401
+	TTL      time.Duration // lifetime of the handed out credentials, default 1 hour
+	TLS      bool          // also hand out the turns: URI of the TURN server
+	Replies  []ProviderReply
+	LogLevel logging.LogLevel // of the embedded TURN server
+}
+
+type providerRequest struct {
+	DeviceId string `json:"deviceId"`
+	Token    string `json:"token"`
+}
+
+type providerServer struct {
+	Urls     []string `json:"urls"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Expired  int64    `json:"expired,omitempty"`
+}
+
+type providerResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		SessionId        string           `json:"sessionId"`
+		AppIceServers    []providerServer `json:"AppIceServers"`
+		DeviceIceServers []providerServer `json:"DeviceIceServers"`
+	} `json:"data"`
+}
+
+// Provider stands in for the ICE server provider behind the /v1/call API,
+// handing out TURN REST API credentials of its own embedded TURN server
+type Provider struct {
+	URL    string  // API url to request, "http://host:port/v1/call"
+	Server *Server // the TURN server the credentials are for
+
+	cfg      ProviderConfig
+	secret   string
+	lock     sync.Mutex
+	replies  []ProviderReply
+	calls    int
+	listener net.Listener
+	http     *http.Server
+}
+
+// StartProvider runs the provider API and its TURN server
+func StartProvider(cfg *ProviderConfig) (*Provider, error) {
+	if cfg == nil {
+		cfg = &ProviderConfig{}
+	}
+
+	p := &Provider{
+		cfg:     *cfg,
+		replies: append([]ProviderReply{}, cfg.Replies...),
+	}
+
+	if p.cfg.Listen == "" {
+		p.cfg.Listen = loopbackIp + ":0"
+	}
+	if p.cfg.TTL <= 0 {
+		p.cfg.TTL = defaultProviderTTL
+	}
+
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	p.secret = hex.EncodeToString(secret)
+
+	var err error
+	p.Server, err = Start(&ServerConfig{AuthSecret: p.secret, LogLevel: cfg.LogLevel})
+	if err != nil {
+		return nil, err
+	}
+
+	p.listener, err = net.Listen("tcp", p.cfg.Listen)
+	if err != nil {
+		p.Server.Close()
+		return nil, err
+	}
+
+	p.URL = "http://" + p.listener.Addr().String() + ProviderPath
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ProviderPath, p.handleCall)
+	p.http = &http.Server{Handler: mux}
+	go p.http.Serve(p.listener)
+
+	return p, nil
+}
+
+// Close stops the API and the TURN server
+func (p *Provider) Close() error {
+	p.http.Close()
+	return p.Server.Close()
+}
+
+// SetReplies replaces the scripted replies still to come
+func (p *Provider) SetReplies(replies ...ProviderReply) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.replies = append([]ProviderReply{}, replies...)
+}
+
+// Calls returns how many requests the API got
+func (p *Provider) Calls() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.calls
+}
+
+// nextReply pops the next scripted reply, success once the script is over
+func (p *Provider) nextReply() ProviderReply {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.calls++
+	if len(p.replies) == 0 {
+		return ProviderReply{}
+	}
+
+	reply := p.replies[0]
+	p.replies = p.replies[1:]
+	return reply
+}
+
+func (p *Provider) handleCall(w http.ResponseWriter, r *http.Request) {
+	reply := p.nextReply()
+
+	if reply.Delay > 0 {
+		select {
+		case <-time.After(reply.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request providerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if reply.Status != 0 && reply.Status != http.StatusOK {
+		http.Error(w, http.StatusText(reply.Status), reply.Status)
+		return
+	}
+
+	var response providerResponse
+	response.Code = reply.Code
+	response.Message = reply.Message
+
+	if response.Code == 0 && p.cfg.Token != "" && request.Token != p.cfg.Token {
+		response.Code = http.StatusUnauthorized
+		response.Message = "bad token"
+	}
+
+	if response.Code == 0 {
+		response.Message = "success"
+		response.Data.SessionId = strconv.FormatInt(time.Now().UnixNano(), 16)
+		response.Data.AppIceServers = p.iceServers(request.DeviceId, reply.Expired)
+		response.Data.DeviceIceServers = p.iceServers(request.DeviceId, reply.Expired)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&response)
+}
+
+// iceServers lists the STUN server and the TURN servers with fresh REST API credentials
+func (p *Provider) iceServers(deviceId string, expired bool) []providerServer {
+	expiredAt := time.Now().Add(p.cfg.TTL)
+	if expired {
+		expiredAt = time.Now().Add(-time.Minute)
+	}
+
+	username := strconv.FormatInt(expiredAt.Unix(), 10)
+	if deviceId != "" {
+		username += ":" + deviceId
+	}
+
+	turn := providerServer{
+		Urls:     []string{p.Server.UDPURI(), p.Server.TCPURI()},
+		Username: username,
+		Password: restPassword(p.secret, username),
+		Expired:  expiredAt.Unix(),
+	}
+	if p.cfg.TLS {
+		turn.Urls = append(turn.Urls, p.Server.TLSURI())
+	}
+
+	stun := providerServer{
+		Urls: []string{"stun:" + p.Server.UDPAddr},
+	}
+
+	return []providerServer{stun, turn}
+}
+
+// restPassword is the TURN REST API password of username
+func restPassword(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseProviderScript parses replies like "ok,code=1001,status=500,delay=3s+expired",
+// each comma separated item is one reply combining "+" separated settings
+func ParseProviderScript(script string) ([]ProviderReply, error) {
+	if script == "" {
+		return nil, nil
+	}
+
+	var replies []ProviderReply
+	for _, item := range strings.Split(script, ",") {
+		var reply ProviderReply
+		for _, setting := range strings.Split(item, "+") {
+			kv := strings.SplitN(strings.TrimSpace(setting), "=", 2)
+			value := ""
+			if len(kv) == 2 {
+				value = kv[1]
+			}
+
+			var err error
+			switch kv[0] {
+			case "ok":
+			case "expired":
+				reply.Expired = true
+			case "status":
+				reply.Status, err = strconv.Atoi(value)
+			case "code":
+				reply.Code, err = strconv.Atoi(value)
+				reply.Message = "scripted error"
+			case "delay":
+				reply.Delay, err = time.ParseDuration(value)
+			default:
+				err = fmt.Errorf("unknown setting")
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("bad reply %q in script:%v", setting, err)
+			}
+		}
+		replies = append(replies, reply)
+	}
+
+	return replies, nil
+}
@@ -0,0 +1,108 @@
+package testserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xylophone21/go-turn-test/statistics"
+)
+
+// Collect keeps collecting this long after run returns, so that the reading goroutines see their sockets closed
+const collectLinger = time.Millisecond * 200
+
+// testingT is the part of testing.TB StartTest uses, so that the mock provider command doesn't link the testing package
+type testingT interface {
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+// StartTest starts a server closed at the end of the test, failing the test when it can't
+func StartTest(t testingT, cfg *ServerConfig) *Server {
+	server, err := Start(cfg)
+	if err != nil {
+		t.Fatalf("testserver.Start error:%v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server
+}
+
+// Results are what a request reported to its channel, for tests to count what they check
+type Results []statistics.RequestResults
+
+// Collect runs run and gathers the results reported to ch meanwhile
+func Collect(ch <-chan statistics.RequestResults, run func()) Results {
+	var results Results
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case result := <-ch:
+				results = append(results, result)
+
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	run()
+
+	time.Sleep(collectLinger)
+	close(done)
+	<-stopped
+
+	return results
+}
+
+// Count counts the results matching match
+func (r Results) Count(match func(result *statistics.RequestResults) bool) int {
+	count := 0
+	for i := range r {
+		if match(&r[i]) {
+			count++
+		}
+	}
+	return count
+}
+
+// Received are the results of received packages, without errors, setups, connects, rotations and RTP reports
+func (r Results) Received() Results {
+	var received Results
+	for _, result := range r {
+		if result.ErrCode == 0 && !result.IsSent && result.SetupMethod == "" && result.ConnectMethod == "" && !result.IsRotated && !result.IsRtpReport {
+			received = append(received, result)
+		}
+	}
+	return received
+}
+
+// Sent counts the packages or requests sent
+func (r Results) Sent() int {
+	return r.Count(func(result *statistics.RequestResults) bool {
+		return result.ErrCode == 0 && result.IsSent
+	})
+}
+
+// Recv counts the packages or responses received
+func (r Results) Recv() int {
+	return len(r.Received())
+}
+
+// ErrCodes counts the errors by code
+func (r Results) ErrCodes() map[int]int {
+	codes := make(map[int]int)
+	for _, result := range r {
+		if result.ErrCode != 0 {
+			codes[result.ErrCode]++
+		}
+	}
+	return codes
+}
+
+func (r Results) String() string {
+	return fmt.Sprintf("sent:%d recv:%d errors:%v", r.Sent(), r.Recv(), r.ErrCodes())
+}
@@ -0,0 +1,326 @@
+// Package testserver 本地 TURN 服务器, 用于无外部依赖的测试
+package testserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+)
+
+const (
+	defaultRealm = "go-turn-test"
+	loopbackIp   = "127.0.0.1"
+	loopbackIp6  = "::1"
+)
+
+type ServerConfig struct {
+	Users      map[string]string // long-term credentials, username => password
+	AuthSecret string            // TURN REST API shared secret, accepting "timestamp[:user]" usernames
+	OAuthKeys  map[string][]byte // RFC 7635 kid => mac_key, the access token itself is not verified
+	Realm      string
+	DualStack  bool // also listens UDP on ::1
+	RelayIPv6  bool // relays on ::1, pion/turn ignores REQUESTED-ADDRESS-FAMILY and would relay on 127.0.0.1
+	MaxRelays  int  // optional, relays at once over all listeners, pion/turn answers allocations beyond by 508
+	LogLevel   logging.LogLevel
+}
+
+type Server struct {
+	UDPAddr   string      // "127.0.0.1:port" of the UDP listener, also answering STUN binding requests
+	TCPAddr   string      // "127.0.0.1:port" of the TCP listener
+	TLSAddr   string      // "127.0.0.1:port" of the TLS listener
+	UDP6Addr  string      // "[::1]:port" of the UDP listener on IPv6 loopback when DualStack
+	TlsConfig *tls.Config // client config trusting the server certificate
+
+	realm  string
+	server *turn.Server
+}
+
+// Start runs a TURN server with UDP, TCP and TLS listeners on loopback
+func Start(cfg *ServerConfig) (*Server, error) {
+	if cfg == nil {
+		cfg = &ServerConfig{}
+	}
+
+	realm := cfg.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+
+	serverTls, clientTls, err := NewTlsConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	// whatever is open when an error comes is closed
+	var opened []io.Closer
+	fail := func(err error) (*Server, error) {
+		for _, c := range opened {
+			c.Close()
+		}
+		return nil, err
+	}
+
+	udpConn, err := net.ListenPacket("udp4", loopbackIp+":0")
+	if err != nil {
+		return fail(err)
+	}
+	opened = append(opened, udpConn)
+
+	tcpListener, err := net.Listen("tcp4", loopbackIp+":0")
+	if err != nil {
+		return fail(err)
+	}
+	opened = append(opened, tcpListener)
+
+	tlsListener, err := tls.Listen("tcp4", loopbackIp+":0", serverTls)
+	if err != nil {
+		return fail(err)
+	}
+	opened = append(opened, tlsListener)
+
+	// one generator for all listeners, so that MaxRelays counts them all
+	relays := newRelayAddressGenerator(cfg)
+
+	packetConfigs := []turn.PacketConnConfig{
+		{PacketConn: udpConn, RelayAddressGenerator: relays},
+	}
+
+	var udp6Addr string
+	if cfg.DualStack {
+		udp6Conn, err := net.ListenPacket("udp6", "["+loopbackIp6+"]:0")
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, udp6Conn)
+		udp6Addr = udp6Conn.LocalAddr().String()
+		packetConfigs = append(packetConfigs, turn.PacketConnConfig{PacketConn: udp6Conn, RelayAddressGenerator: relays})
+	}
+
+	f := logging.DefaultLoggerFactory{
+		DefaultLogLevel: cfg.LogLevel,
+	}
+	if cfg.LogLevel == 0 {
+		f.DefaultLogLevel = logging.LogLevelError
+	}
+	log := f.NewLogger("testserver")
+
+	s := &Server{
+		UDPAddr:   udpConn.LocalAddr().String(),
+		TCPAddr:   tcpListener.Addr().String(),
+		TLSAddr:   tlsListener.Addr().String(),
+		UDP6Addr:  udp6Addr,
+		TlsConfig: clientTls,
+		realm:     realm,
+	}
+
+	s.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:         realm,
+		LoggerFactory: &f,
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return authenticate(cfg, log, username, realm)
+		},
+		PacketConnConfigs: packetConfigs,
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: relays},
+			{Listener: tlsListener, RelayAddressGenerator: relays},
+		},
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	return s, nil
+}
+
+// Close stops all the listeners and allocations
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// UDPURI returns the turn: URI of the UDP listener
+func (s *Server) UDPURI() string {
+	return "turn:" + s.UDPAddr
+}
+
+// UDP6URI returns the turn: URI of the UDP listener on IPv6 loopback, empty unless DualStack
+func (s *Server) UDP6URI() string {
+	if s.UDP6Addr == "" {
+		return ""
+	}
+	return "turn:" + s.UDP6Addr
+}
+
+// TCPURI returns the turn: URI of the TCP listener
+func (s *Server) TCPURI() string {
+	return "turn:" + s.TCPAddr + "?transport=tcp"
+}
+
+// TLSURI returns the turns: URI of the TLS listener
+func (s *Server) TLSURI() string {
+	return "turns:" + s.TLSAddr
+}
+
+// Realm returns the realm the server challenges with
+func (s *Server) Realm() string {
+	return s.realm
+}
+
+func newRelayAddressGenerator(cfg *ServerConfig) turn.RelayAddressGenerator {
+	var relays turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP(loopbackIp),
+		Address:      loopbackIp,
+	}
+	if cfg.RelayIPv6 {
+		relays = &ipv6RelayAddressGenerator{}
+	}
+
+	if cfg.MaxRelays > 0 {
+		relays = &limitedRelayAddressGenerator{RelayAddressGenerator: relays, max: int32(cfg.MaxRelays)}
+	}
+	return relays
+}
+
+var errRelayCapacity = errors.New("no relay capacity left")
+
+// limitedRelayAddressGenerator refuses relays beyond max open ones
+type limitedRelayAddressGenerator struct {
+	turn.RelayAddressGenerator
+	max  int32
+	open int32
+}
+
+func (g *limitedRelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if atomic.AddInt32(&g.open, 1) > g.max {
+		atomic.AddInt32(&g.open, -1)
+		return nil, nil, errRelayCapacity
+	}
+
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		atomic.AddInt32(&g.open, -1)
+		return nil, nil, err
+	}
+	return &countedPacketConn{PacketConn: conn, open: &g.open}, addr, nil
+}
+
+// countedPacketConn gives its relay back when pion/turn closes it with the allocation
+type countedPacketConn struct {
+	net.PacketConn
+	open      *int32
+	closeOnce sync.Once
+}
+
+func (c *countedPacketConn) Close() error {
+	c.closeOnce.Do(func() { atomic.AddInt32(c.open, -1) })
+	return c.PacketConn.Close()
+}
+
+// ipv6RelayAddressGenerator relays on ::1 though pion/turn always asks for udp4
+type ipv6RelayAddressGenerator struct{}
+
+func (g *ipv6RelayAddressGenerator) Validate() error {
+	return nil
+}
+
+func (g *ipv6RelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, err := net.ListenPacket("udp6", net.JoinHostPort(loopbackIp6, strconv.Itoa(requestedPort)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.LocalAddr(), nil
+}
+
+func (g *ipv6RelayAddressGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, fmt.Errorf("TCP relay not supported")
+}
+
+// authenticate returns the integrity key of username by long-term, REST API or OAuth credentials
+func authenticate(cfg *ServerConfig, log logging.LeveledLogger, username string, realm string) ([]byte, bool) {
+	if password, ok := cfg.Users[username]; ok {
+		return turn.GenerateAuthKey(username, realm, password), true
+	}
+
+	if key, ok := cfg.OAuthKeys[username]; ok {
+		return key, true
+	}
+
+	if cfg.AuthSecret == "" {
+		log.Warnf("unknown username %q", username)
+		return nil, false
+	}
+
+	expired, err := strconv.ParseInt(strings.SplitN(username, ":", 2)[0], 10, 64)
+	if err != nil {
+		log.Warnf("bad REST API username %q", username)
+		return nil, false
+	}
+
+	if expired < time.Now().Unix() {
+		log.Warnf("expired REST API username %q", username)
+		return nil, false
+	}
+
+	return turn.GenerateAuthKey(username, realm, restPassword(cfg.AuthSecret, username)), true
+}
+
+// newCertificate makes a self-signed certificate for the loopback address
+// NewTlsConfigs makes a self-signed certificate for loopback, returning a server config with it and a client
+// config trusting it
+func NewTlsConfigs() (*tls.Config, *tls.Config, error) {
+	cert, err := newCertificate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	return &tls.Config{Certificates: []tls.Certificate{*cert}}, &tls.Config{RootCAs: roots}, nil
+}
+
+func newCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "go-turn-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP(loopbackIp)},
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("CreateCertificate error:%v", err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
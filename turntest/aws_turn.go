@@ -3,24 +3,31 @@ package turntest
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
+	"sync"
 	"time"
 )
 
 const (
 	apiurl     = "https://uat.web-rtc.ipcuat.tcljd.cn/v1/call"
 	awsStunUrl = "stun.kinesisvideo.cn-north-1.amazonaws.com.cn:443"
+	apiTimeout = time.Second * 10
+
+	// the provider isn't asked again this long after a failed or expired response
+	awsRetryWait = time.Second * 5
 )
 
 var awsDeviceId string
 var awsToken string
 
 type RequestBody struct {
-	DeviceId string `json:"deviceId"`
-	Token    string `json:"token"`
+	DeviceId string        `json:"deviceId"`
+	Token    string        `json:"token"`
+	ApiUrl   string        `json:"-"` // optional, the UAT api when empty
+	Timeout  time.Duration `json:"-"` // optional, 10 seconds when zero
 }
 
 type server struct {
@@ -61,50 +68,153 @@ func AllocAwsTurns(request *RequestBody) (*AwsTurnsServers, error) {
 	requestBody := new(bytes.Buffer)
 	json.NewEncoder(requestBody).Encode(request)
 
-	req, err := http.NewRequest("POST", apiurl, requestBody)
+	url := request.ApiUrl
+	if url == "" {
+		url = apiurl
+	}
+
+	req, err := http.NewRequest("POST", url, requestBody)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client := &http.Client{Timeout: request.Timeout}
+	if client.Timeout <= 0 {
+		client.Timeout = apiTimeout
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[AllocAwsTurns]http status %d", resp.StatusCode)
+	}
+
 	var respBody responseBody
 	err = json.Unmarshal(body, &respBody)
 	if err != nil {
 		return nil, err
 	}
 
+	if respBody.Code != 0 {
+		return nil, fmt.Errorf("[AllocAwsTurns]code %d:%s", respBody.Code, respBody.Message)
+	}
+
 	ret := AwsTurnsServers{}
 
 	for i := 0; i < len(respBody.Data.AppIceServers); i++ {
 		for j := 0; j < len(respBody.Data.AppIceServers[i].Urls); j++ {
 			urlStr := respBody.Data.AppIceServers[i].Urls[j]
-			u, _ := url.Parse(urlStr)
-			if u.Scheme == "turn" {
+			u, err := ParseIceURI(urlStr)
+			if err != nil {
+				continue
+			}
+
+			if u.Scheme == SCHEME_TURN || u.Scheme == SCHEME_TURNS {
 				turn := AwsTurnServers{
-					TurnServerAddr: u.Opaque,
+					TurnServerAddr: u.String(),
 					Username:       respBody.Data.AppIceServers[i].Username,
 					Password:       respBody.Data.AppIceServers[i].Password,
-					Expired:        time.Unix(respBody.Data.AppIceServers[i].Expired, 0),
+				}
+				if respBody.Data.AppIceServers[i].Expired > 0 {
+					turn.Expired = time.Unix(respBody.Data.AppIceServers[i].Expired, 0)
 				}
 				ret.TurnServerAddrs = append(ret.TurnServerAddrs, turn)
 
-			} else if u.Scheme == "stun" {
+			} else if request.ApiUrl == "" {
 				//todo, api issue
 				ret.StunServerAddr = awsStunUrl
+			} else {
+				ret.StunServerAddr = u.String()
 			}
 		}
 	}
 
 	return &ret, nil
 }
+
+// AwsCredentialCache shares the provider responses between the channels: one fetch at a time,
+// kept until the credentials are about to expire, and a failed fetch kept for awsRetryWait
+type AwsCredentialCache struct {
+	request *RequestBody
+
+	lock     sync.Mutex // held during the fetch, so the other channels wait for its result
+	servers  *AwsTurnsServers
+	err      error
+	failedAt time.Time
+}
+
+func NewAwsCredentialCache(request *RequestBody) *AwsCredentialCache {
+	return &AwsCredentialCache{request: request}
+}
+
+// Servers returns the cached response, fetching a new one when its credentials are about to expire
+func (c *AwsCredentialCache) Servers() (*AwsTurnsServers, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.servers != nil && awsFresh(c.servers) {
+		return c.servers, nil
+	}
+
+	if c.err != nil && time.Since(c.failedAt) < awsRetryWait {
+		return nil, c.err
+	}
+
+	servers, err := AllocAwsTurns(c.request)
+	if err == nil && len(servers.TurnServerAddrs) == 0 {
+		err = fmt.Errorf("[AwsCredentialCache]no turn server")
+	}
+	if err == nil && !awsFresh(servers) {
+		err = fmt.Errorf("[AwsCredentialCache]credentials from the provider expire within %v", credentialRenewAhead)
+	}
+	if err != nil {
+		c.servers = nil
+		c.err = err
+		c.failedAt = time.Now()
+		return nil, err
+	}
+
+	c.servers = servers
+	c.err = nil
+	return servers, nil
+}
+
+// Credential returns a CredentialFunc keeping the channel on the index-th TURN server of the responses
+func (c *AwsCredentialCache) Credential(index int) CredentialFunc {
+	return func(chanId uint64) (*Credential, error) {
+		awsTurn, err := c.Servers()
+		if err != nil {
+			return nil, err
+		}
+
+		turn := awsTurn.TurnServerAddrs[index%len(awsTurn.TurnServerAddrs)]
+		cred := &Credential{
+			TurnServerAddr: turn.TurnServerAddr,
+			Username:       turn.Username,
+			Password:       turn.Password,
+			Expired:        turn.Expired,
+		}
+
+		return cred, nil
+	}
+}
+
+// awsFresh tells whether all the credentials of servers are good beyond credentialRenewAhead
+func awsFresh(servers *AwsTurnsServers) bool {
+	renewAt := time.Now().Add(credentialRenewAhead)
+	for _, turn := range servers.TurnServerAddrs {
+		if !turn.Expired.IsZero() && !turn.Expired.After(renewAt) {
+			return false
+		}
+	}
+	return true
+}
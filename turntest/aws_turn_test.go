@@ -1,21 +1,45 @@
 package turntest
 
 import (
-	"fmt"
+	"net/http"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/xylophone21/go-turn-test/testdata"
+	"github.com/xylophone21/go-turn-test/testserver"
 )
 
-func TestAlloc(t *testing.T) {
-	req := &RequestBody{
-		DeviceId: testdata.AwsDeviceId,
-		Token:    testdata.AwsToken,
+// awsRequestBody asks the real provider when deviceId and token are set, a local mock provider otherwise
+func awsRequestBody(t *testing.T) (*RequestBody, *testserver.Provider) {
+	if testdata.AwsDeviceId != "" {
+		return &RequestBody{
+			DeviceId: testdata.AwsDeviceId,
+			Token:    testdata.AwsToken,
+			ApiUrl:   testdata.AwsApiUrl,
+		}, nil
 	}
+
+	provider, err := testserver.StartProvider(&testserver.ProviderConfig{Token: "token"})
+	if err != nil {
+		t.Fatalf("StartProvider error:%v", err)
+	}
+	t.Cleanup(func() { provider.Close() })
+
+	return &RequestBody{
+		DeviceId: "device",
+		Token:    "token",
+		ApiUrl:   provider.URL,
+		Timeout:  time.Second,
+	}, provider
+}
+
+func TestAlloc(t *testing.T) {
+	req, _ := awsRequestBody(t)
+
 	ret, err := AllocAwsTurns(req)
 	if err != nil {
-		t.Fail()
+		t.Fatalf("AllocAwsTurns error:%v", err)
 	}
 
 	if ret.StunServerAddr == "" {
@@ -44,5 +68,79 @@ func TestAlloc(t *testing.T) {
 		}
 	}
 
-	fmt.Print(ret)
+	t.Log(ret)
+}
+
+func TestAllocErrors(t *testing.T) {
+	provider, err := testserver.StartProvider(&testserver.ProviderConfig{Token: "token"})
+	if err != nil {
+		t.Fatalf("StartProvider error:%v", err)
+	}
+	defer provider.Close()
+
+	req := &RequestBody{DeviceId: "device", Token: "token", ApiUrl: provider.URL, Timeout: time.Millisecond * 500}
+
+	provider.SetReplies(
+		testserver.ProviderReply{Status: http.StatusInternalServerError},
+		testserver.ProviderReply{Code: 1001, Message: "no device"},
+		testserver.ProviderReply{Delay: time.Second},
+	)
+	for i := 0; i < 3; i++ {
+		if _, err := AllocAwsTurns(req); err == nil {
+			t.Fatalf("reply %d should fail", i)
+		}
+	}
+
+	if _, err := AllocAwsTurns(&RequestBody{DeviceId: "device", Token: "bad", ApiUrl: provider.URL}); err == nil {
+		t.Fatalf("bad token should fail")
+	}
+
+	provider.SetReplies(testserver.ProviderReply{Expired: true})
+	ret, err := AllocAwsTurns(req)
+	if err != nil || len(ret.TurnServerAddrs) == 0 || ret.TurnServerAddrs[0].Expired.After(time.Now()) {
+		t.Fatalf("expired credentials expected, got %v %v", ret, err)
+	}
+
+	if provider.Calls() != 5 {
+		t.Fatalf("%d calls", provider.Calls())
+	}
+}
+
+func TestAwsCredentialCache(t *testing.T) {
+	provider, err := testserver.StartProvider(&testserver.ProviderConfig{Token: "token"})
+	if err != nil {
+		t.Fatalf("StartProvider error:%v", err)
+	}
+	defer provider.Close()
+
+	req := &RequestBody{DeviceId: "device", Token: "token", ApiUrl: provider.URL, Timeout: time.Second}
+
+	// the channels renewing at once share one fetch
+	cache := NewAwsCredentialCache(req)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if cred, err := cache.Credential(i)(uint64(i)); err != nil || cred.Username == "" {
+				t.Errorf("Credential error:%v %v", err, cred)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if provider.Calls() != 1 {
+		t.Fatalf("%d calls for 10 channels", provider.Calls())
+	}
+
+	// expired credentials are an error, and the provider isn't asked again right away
+	provider.SetReplies(testserver.ProviderReply{Expired: true})
+	cache = NewAwsCredentialCache(req)
+	for i := 0; i < 3; i++ {
+		if cred, err := cache.Credential(0)(0); err == nil {
+			t.Fatalf("expired credentials accepted:%v", cred)
+		}
+	}
+	if provider.Calls() != 2 {
+		t.Fatalf("%d calls", provider.Calls())
+	}
 }
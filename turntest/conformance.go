@@ -0,0 +1,611 @@
+package turntest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+)
+
+// CheckStatus is the outcome of a conformance check
+type CheckStatus string
+
+const (
+	CHECK_PASS CheckStatus = "pass"
+	CHECK_FAIL CheckStatus = "fail"
+	CHECK_SKIP CheckStatus = "skip" // couldn't be checked, e.g. what it depends on failed
+
+	// features checked by CheckConformance, in the order they run
+	CHECK_CHALLENGE             = "challenge"             // 401 with NONCE and REALM to a request without credentials
+	CHECK_STALE_NONCE           = "stale-nonce"           // 438 with a new NONCE to a nonce the server never gave, which then works
+	CHECK_WRONG_CREDENTIALS     = "wrong-credentials"     // 401 to a wrong password
+	CHECK_ALLOCATION_MISMATCH   = "allocation-mismatch"   // 437 to a second Allocate on an allocated 5-tuple
+	CHECK_UNSUPPORTED_TRANSPORT = "unsupported-transport" // 442 to REQUESTED-TRANSPORT TCP over UDP
+	CHECK_DONT_FRAGMENT         = "dont-fragment"         // DONT-FRAGMENT honored, or rejected by 420 with UNKNOWN-ATTRIBUTES
+	CHECK_LIFETIME              = "lifetime"              // LIFETIME below the default raised to it, far above capped
+	CHECK_PERMISSION            = "permission"            // nothing relayed to or from a peer without permission
+	CHECK_CHANNEL_NUMBER        = "channel-number"        // ChannelBind outside 0x4000-0x7FFF or of a bound number to another peer rejected by 400
+	CHECK_EVEN_PORT             = "even-port"             // EVEN-PORT gets an even relayed port (RFC 8656 section 7.2)
+	CHECK_RESERVATION_TOKEN     = "reservation-token"     // RESERVATION-TOKEN claims the odd port reserved next to it
+
+	// allocations without reservation besides the reserving one, so that random ports hardly pass as even
+	evenPortTries = 3
+
+	// how long a check waits for relayed data
+	checkReadTimeout = time.Second
+
+	// lifetimes asked for by the lifetime check, the maximum is recommended to be an hour
+	checkShortLifetime = time.Second
+	checkLongLifetime  = time.Hour * 100
+)
+
+// CheckResult is the outcome of checking one feature of a TURN server
+type CheckResult struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail,omitempty"` // what was seen, or why it failed or was skipped
+
+	// robustness checks only, whether the server still answered afterwards
+	Responsive *bool `json:"responsive,omitempty"`
+}
+
+type ConformanceRequestST struct {
+	Ctx            context.Context
+	Log            logging.LeveledLogger
+	TurnServerAddr string      // TURN server addrees (e.g. "turn.abc.com:3478" or "turns:turn.abc.com:443?transport=tcp")
+	TlsConfig      *tls.Config // optional, for turns: servers
+	Username       string
+	Password       string
+	ClientFamily   AddressFamily // optional, family of our sockets to the TURN server, IPv4 by default
+	MaxAllocations int           // optional, allocations the quota robustness check makes waiting for 486, 100 by default
+}
+
+// conformanceCheck checks some features, each reported as a CheckResult named by names
+type conformanceCheck struct {
+	names []string
+	run   func(req *ConformanceRequestST) []CheckResult
+}
+
+var conformanceChecks = []conformanceCheck{
+	single(CHECK_CHALLENGE, checkChallenge),
+	single(CHECK_STALE_NONCE, checkStaleNonce),
+	single(CHECK_WRONG_CREDENTIALS, checkWrongCredentials),
+	single(CHECK_ALLOCATION_MISMATCH, checkAllocationMismatch),
+	single(CHECK_UNSUPPORTED_TRANSPORT, checkUnsupportedTransport),
+	single(CHECK_DONT_FRAGMENT, checkDontFragment),
+	single(CHECK_LIFETIME, checkLifetime),
+	single(CHECK_PERMISSION, checkPermission),
+	single(CHECK_CHANNEL_NUMBER, checkChannelNumber),
+	{names: []string{CHECK_EVEN_PORT, CHECK_RESERVATION_TOKEN}, run: checkEvenPort},
+}
+
+// single is the conformanceCheck of a check reporting one feature
+func single(name string, run func(req *ConformanceRequestST, result *CheckResult)) conformanceCheck {
+	return conformanceCheck{
+		names: []string{name},
+		run: func(req *ConformanceRequestST) []CheckResult {
+			result := CheckResult{Name: name, Status: CHECK_FAIL}
+			run(req, &result)
+			return []CheckResult{result}
+		},
+	}
+}
+
+// CheckNames returns the names of all the conformance checks in the order they run
+func CheckNames() []string {
+	return catalogNames(conformanceChecks)
+}
+
+func catalogNames(catalog []conformanceCheck) []string {
+	var names []string
+	for _, check := range catalog {
+		names = append(names, check.names...)
+	}
+	return names
+}
+
+// CheckConformance checks the features of names against the TURN server of req, all of them when names is empty
+func CheckConformance(req *ConformanceRequestST, names ...string) ([]CheckResult, error) {
+	if req == nil || req.Ctx == nil || req.Log == nil || req.TurnServerAddr == "" {
+		return nil, fmt.Errorf("[CheckConformance]Paramters error")
+	}
+
+	return runChecks(req, "CheckConformance", conformanceChecks, names)
+}
+
+// runChecks runs the checks of catalog reporting any of names, all of them without names
+func runChecks(req *ConformanceRequestST, caller string, catalog []conformanceCheck, names []string) ([]CheckResult, error) {
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var results []CheckResult
+	for _, check := range catalog {
+		run := len(names) == 0
+		for _, name := range check.names {
+			if wanted[name] {
+				run = true
+				delete(wanted, name)
+			}
+		}
+
+		if !run {
+			continue
+		}
+
+		if req.Ctx.Err() != nil {
+			return results, req.Ctx.Err()
+		}
+
+		for _, result := range check.run(req) {
+			req.Log.Infof("[%s]%s %s %s", caller, result.Name, result.Status, result.Detail)
+			results = append(results, result)
+		}
+	}
+
+	for name := range wanted {
+		return results, fmt.Errorf("[%s]unknown check %q", caller, name)
+	}
+
+	return results, nil
+}
+
+// trunRequest is req as the TrunRequestST the clients of the checks are dialed by
+func (req *ConformanceRequestST) trunRequest() *TrunRequestST {
+	return &TrunRequestST{
+		Ctx:            req.Ctx,
+		Log:            req.Log,
+		TurnServerAddr: req.TurnServerAddr,
+		TlsConfig:      req.TlsConfig,
+		Username:       req.Username,
+		Password:       req.Password,
+		ClientFamily:   req.ClientFamily,
+	}
+}
+
+// dialCheckClient dials a rawClient for the check of result, skipping it when that fails
+func dialCheckClient(req *ConformanceRequestST, result *CheckResult) *rawClient {
+	raw, err := dialRawClient(req.trunRequest())
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("dial error:%v", err)
+		return nil
+	}
+	return raw
+}
+
+// allocateCheckClient dials a rawClient and allocates for the check of result, skipping it when that fails
+func allocateCheckClient(req *ConformanceRequestST, result *CheckResult, attrs ...stun.Setter) *rawClient {
+	raw := dialCheckClient(req, result)
+	if raw == nil {
+		return nil
+	}
+
+	if _, err := raw.allocate(attrs...); err != nil {
+		raw.Close()
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("allocate error:%v", err)
+		return nil
+	}
+	return raw
+}
+
+// outcome describes the response to a request, or why there was none
+func outcome(res *stun.Message, err error) string {
+	if res == nil {
+		return fmt.Sprintf("no response:%v", err)
+	}
+	if err = responseError(res); err != nil {
+		return err.Error()
+	}
+	return "success"
+}
+
+// expectCode passes result when res is an error response of code, failing it with what came otherwise
+func expectCode(result *CheckResult, res *stun.Message, err error, code stun.ErrorCode) bool {
+	if res != nil && errorCodeOf(responseError(res)) == code {
+		result.Status = CHECK_PASS
+		return true
+	}
+
+	result.Status = CHECK_FAIL
+	result.Detail = fmt.Sprintf("%s instead of %d", outcome(res, err), code)
+	return false
+}
+
+func unauthenticatedAllocate(raw *rawClient) (*stun.Message, error) {
+	msg, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest), requestedTransportAttr(protoUDP), stun.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return raw.perform(msg)
+}
+
+func checkChallenge(req *ConformanceRequestST, result *CheckResult) {
+	raw := dialCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	res, err := unauthenticatedAllocate(raw)
+	if !expectCode(result, res, err, stun.CodeUnauthorized) {
+		return
+	}
+
+	var realm stun.Realm
+	var nonce stun.Nonce
+	if realm.GetFrom(res) != nil || nonce.GetFrom(res) != nil {
+		result.Status = CHECK_FAIL
+		result.Detail = "401 without REALM or NONCE"
+		return
+	}
+	result.Detail = fmt.Sprintf("realm %q", realm)
+}
+
+// challengedCheckClient dials a rawClient which learned a nonce from a 401, skipping the check of result when that fails
+func challengedCheckClient(req *ConformanceRequestST, result *CheckResult) *rawClient {
+	raw := dialCheckClient(req, result)
+	if raw == nil {
+		return nil
+	}
+
+	res, err := unauthenticatedAllocate(raw)
+	if err != nil || raw.learnNonce(res) != nil {
+		raw.Close()
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("no nonce, %s", outcome(res, err))
+		return nil
+	}
+	return raw
+}
+
+func checkStaleNonce(req *ConformanceRequestST, result *CheckResult) {
+	raw := challengedCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	raw.lock.Lock()
+	raw.nonce = stun.NewNonce("stale-" + raw.nonce.String())
+	raw.lock.Unlock()
+
+	res, err := raw.requestOnce(stun.MethodAllocate, requestedTransportAttr(protoUDP))
+	if !expectCode(result, res, err, stun.CodeStaleNonce) {
+		return
+	}
+
+	if err = raw.learnNonce(res); err != nil {
+		result.Status = CHECK_FAIL
+		result.Detail = "438 without NONCE"
+		return
+	}
+
+	// the new nonce works, as the client retries with it
+	res, err = raw.requestOnce(stun.MethodAllocate, requestedTransportAttr(protoUDP))
+	if res == nil || responseError(res) != nil {
+		result.Status = CHECK_FAIL
+		result.Detail = fmt.Sprintf("%s with the nonce of the 438", outcome(res, err))
+		return
+	}
+
+	raw.refresh(0)
+}
+
+func checkWrongCredentials(req *ConformanceRequestST, result *CheckResult) {
+	raw := dialCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	raw.password = req.Password + "-wrong"
+	res, err := raw.request(stun.MethodAllocate, requestedTransportAttr(protoUDP))
+	if !expectCode(result, res, err, stun.CodeUnauthorized) && res != nil && responseError(res) == nil {
+		result.Detail = "allocated with a wrong password"
+		raw.refresh(0)
+	}
+}
+
+func checkAllocationMismatch(req *ConformanceRequestST, result *CheckResult) {
+	raw := allocateCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	res, err := raw.request(stun.MethodAllocate, requestedTransportAttr(protoUDP))
+	expectCode(result, res, err, stun.CodeAllocMismatch)
+}
+
+func checkUnsupportedTransport(req *ConformanceRequestST, result *CheckResult) {
+	raw := dialCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	res, err := raw.request(stun.MethodAllocate, requestedTransportAttr(protoTCP))
+	if expectCode(result, res, err, stun.CodeUnsupportedTransProto) || res == nil || responseError(res) != nil {
+		return
+	}
+	raw.refresh(0)
+
+	// TCP allocations over TCP are RFC 6062
+	if raw.reliable {
+		result.Status = CHECK_SKIP
+		result.Detail = "TCP allocation granted over a TCP connection (RFC 6062)"
+	}
+}
+
+func checkDontFragment(req *ConformanceRequestST, result *CheckResult) {
+	raw := dialCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	res, err := raw.request(stun.MethodAllocate, requestedTransportAttr(protoUDP), stun.RawAttribute{Type: stun.AttrDontFragment})
+	if res != nil && responseError(res) == nil {
+		raw.refresh(0)
+		result.Status = CHECK_PASS
+		result.Detail = "supported"
+		return
+	}
+
+	if !expectCode(result, res, err, stun.CodeUnknownAttribute) {
+		return
+	}
+
+	var unknown stun.UnknownAttributes
+	if unknown.GetFrom(res) == nil {
+		for _, t := range unknown {
+			if t == stun.AttrDontFragment {
+				result.Detail = "not supported, rejected by 420"
+				return
+			}
+		}
+	}
+
+	result.Status = CHECK_FAIL
+	result.Detail = "420 without DONT-FRAGMENT in UNKNOWN-ATTRIBUTES"
+}
+
+func checkLifetime(req *ConformanceRequestST, result *CheckResult) {
+	var granted []time.Duration
+	for _, lifetime := range []time.Duration{checkShortLifetime, checkLongLifetime} {
+		raw := dialCheckClient(req, result)
+		if raw == nil {
+			return
+		}
+
+		res, err := raw.allocate(lifetimeAttr(lifetime))
+		raw.Close()
+		if err != nil {
+			result.Status = CHECK_SKIP
+			result.Detail = fmt.Sprintf("allocate error:%v", err)
+			return
+		}
+		granted = append(granted, lifetimeFrom(res))
+	}
+
+	result.Detail = fmt.Sprintf("granted %v for %v, %v for %v", granted[0], checkShortLifetime, granted[1], checkLongLifetime)
+	if granted[0] >= rawDefaultLifetime && granted[1] < checkLongLifetime {
+		result.Status = CHECK_PASS
+	}
+}
+
+func checkPermission(req *ConformanceRequestST, result *CheckResult) {
+	raw := allocateCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	relayed := raw.relayedAddrs()[0]
+	relayConn := newRawRelayConn(raw, relayed)
+
+	ip, err := peerIp(&relayClient{Raw: raw}, relayed)
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("peer ip error:%v", err)
+		return
+	}
+
+	family := familyOf(relayed.IP)
+	peer, err := net.ListenPacket(family.udpNetwork(), family.wildcard())
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("peer listen error:%v", err)
+		return
+	}
+	defer peer.Close()
+	peerAddr := &net.UDPAddr{IP: ip, Port: peer.LocalAddr().(*net.UDPAddr).Port}
+
+	// relays both ways, true for each way the data came through
+	relay := func() (bool, bool) {
+		raw.send([]byte("to peer"), peerAddr)
+		peer.SetReadDeadline(time.Now().Add(checkReadTimeout))
+		_, _, err := peer.ReadFrom(make([]byte, 1500))
+		toPeer := err == nil
+
+		peer.WriteTo([]byte("from peer"), relayed)
+		relayConn.SetReadDeadline(time.Now().Add(checkReadTimeout))
+		_, _, err = relayConn.ReadFrom(make([]byte, 1500))
+		fromPeer := err == nil
+
+		return toPeer, fromPeer
+	}
+
+	toPeer, fromPeer := relay()
+
+	if err = raw.createPermission(peerAddr); err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("CreatePermission error:%v", err)
+		return
+	}
+
+	permittedTo, permittedFrom := relay()
+	switch {
+	case !permittedTo || !permittedFrom:
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("%s not reached even with permission", peerAddr)
+	case toPeer || fromPeer:
+		result.Detail = fmt.Sprintf("relayed without permission, to peer:%v from peer:%v", toPeer, fromPeer)
+	default:
+		result.Status = CHECK_PASS
+	}
+}
+
+func checkChannelNumber(req *ConformanceRequestST, result *CheckResult) {
+	raw := allocateCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	relayed := raw.relayedAddrs()[0]
+	ip, err := peerIp(&relayClient{Raw: raw}, relayed)
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("peer ip error:%v", err)
+		return
+	}
+
+	bind := func(number uint16, port int) (*stun.Message, error) {
+		peer := &net.UDPAddr{IP: ip, Port: port}
+		return raw.request(stun.MethodChannelBind, channelNumberAttr(number), xorAddrAttr{Type: stun.AttrXORPeerAddress, Addr: peer})
+	}
+
+	res, err := bind(minChannelNumber, 40000)
+	if res == nil || responseError(res) != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("0x%04X %s", minChannelNumber, outcome(res, err))
+		return
+	}
+
+	var failures []string
+	for _, bad := range []struct {
+		name   string
+		number uint16
+		port   int
+	}{
+		{"below range", minChannelNumber - 1, 40001},
+		{"above range", maxChannelNumber + 1, 40002},
+		{"bound to another peer", minChannelNumber, 40003},
+	} {
+		res, err := bind(bad.number, bad.port)
+		if res == nil || errorCodeOf(responseError(res)) != stun.CodeBadRequest {
+			failures = append(failures, fmt.Sprintf("0x%04X %s:%s", bad.number, bad.name, outcome(res, err)))
+		}
+	}
+
+	if len(failures) == 0 {
+		result.Status = CHECK_PASS
+		return
+	}
+	result.Detail = strings.Join(failures, ", ")
+}
+
+// evenPortAttr is EVEN-PORT, 1 byte padded by the message unlike the other TURN attributes
+func evenPortAttr(reserve bool) stun.RawAttribute {
+	v := []byte{0}
+	if reserve {
+		v[0] = 0x80
+	}
+	return stun.RawAttribute{Type: stun.AttrEvenPort, Value: v}
+}
+
+// allocateEvenPort allocates with EVEN-PORT by a new client, closed by the caller
+func allocateEvenPort(req *ConformanceRequestST, reserve bool) (*rawClient, *stun.Message, error) {
+	raw, err := dialRawClient(req.trunRequest())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := raw.allocate(evenPortAttr(reserve))
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+
+	return raw, res, nil
+}
+
+// checkEvenPort allocates an even port reserving the next one, then claims the reserved port by the
+// RESERVATION-TOKEN from a second 5-tuple, as RTP and RTCP pairing would
+func checkEvenPort(req *ConformanceRequestST) []CheckResult {
+	evenPort := CheckResult{Name: CHECK_EVEN_PORT, Status: CHECK_FAIL}
+	reservation := CheckResult{Name: CHECK_RESERVATION_TOKEN, Status: CHECK_SKIP}
+
+	first, res, err := allocateEvenPort(req, true)
+	if err != nil {
+		evenPort.Detail = fmt.Sprintf("allocate error:%v", err)
+		reservation.Detail = "no even port allocation to claim the reservation of"
+		return []CheckResult{evenPort, reservation}
+	}
+	defer first.Close()
+
+	relayed := first.relayedAddrs()[0]
+	ports := []int{relayed.Port}
+	for i := 0; i < evenPortTries; i++ {
+		raw, _, err := allocateEvenPort(req, false)
+		if err != nil {
+			evenPort.Detail = fmt.Sprintf("allocate without reservation error:%v", err)
+			break
+		}
+		ports = append(ports, raw.relayedAddrs()[0].Port)
+		raw.Close()
+	}
+
+	if evenPort.Detail == "" {
+		evenPort.Status = CHECK_PASS
+		evenPort.Detail = fmt.Sprintf("relayed ports %v", ports)
+		for _, port := range ports {
+			if port%2 != 0 {
+				evenPort.Status = CHECK_FAIL
+				evenPort.Detail = fmt.Sprintf("relayed ports %v, some are odd", ports)
+			}
+		}
+	}
+
+	reservation.Status = CHECK_FAIL
+	token, err := res.Get(stun.AttrReservationToken)
+	if err != nil || len(token) != 8 {
+		reservation.Detail = "no 8 bytes RESERVATION-TOKEN in the response"
+		return []CheckResult{evenPort, reservation}
+	}
+
+	second, err := dialRawClient(req.trunRequest())
+	if err != nil {
+		reservation.Status = CHECK_SKIP
+		reservation.Detail = fmt.Sprintf("dial error:%v", err)
+		return []CheckResult{evenPort, reservation}
+	}
+	defer second.Close()
+
+	_, err = second.allocate(stun.RawAttribute{Type: stun.AttrReservationToken, Value: token})
+	if err != nil {
+		reservation.Detail = fmt.Sprintf("allocate with the token error:%v", err)
+		return []CheckResult{evenPort, reservation}
+	}
+
+	reserved := &net.UDPAddr{IP: relayed.IP, Port: relayed.Port + 1}
+	claimed := second.relayedAddrs()[0]
+	if claimed.IP.Equal(reserved.IP) && claimed.Port == reserved.Port {
+		reservation.Status = CHECK_PASS
+		reservation.Detail = fmt.Sprintf("relayed %s", claimed)
+	} else {
+		reservation.Detail = fmt.Sprintf("relayed %s instead of the reserved %s", claimed, reserved)
+	}
+
+	return []CheckResult{evenPort, reservation}
+}
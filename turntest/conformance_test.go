@@ -0,0 +1,87 @@
+package turntest
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// checks wait for data that should not come through, longer than makeTrunRequestST allows
+func makeConformanceRequestST(server string) (*ConformanceRequestST, func()) {
+	req, trunCancel := makeTrunRequestST("", server, testUsername, testPassword)
+	trunCancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+
+	return &ConformanceRequestST{
+		Ctx:            ctx,
+		Log:            req.Log,
+		TurnServerAddr: req.TurnServerAddr,
+		Username:       req.Username,
+		Password:       req.Password,
+	}, cancel
+}
+
+// statuses checks the results of CheckConformance and returns their status by name
+func statuses(t *testing.T, results []CheckResult, err error) map[string]CheckStatus {
+	if err != nil {
+		t.Fatalf("CheckConformance error:%v", err)
+	}
+
+	ret := make(map[string]CheckStatus)
+	for _, result := range results {
+		t.Logf("%s %s %s", result.Name, result.Status, result.Detail)
+		ret[result.Name] = result.Status
+	}
+	return ret
+}
+
+// pion/turn keeps the even port itself as reserved and never looks the token up
+func TestEvenPort(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeConformanceRequestST(server.UDPURI())
+	defer cancel()
+
+	results, err := CheckConformance(req, CHECK_RESERVATION_TOKEN)
+	got := statuses(t, results, err)
+	if len(got) != 2 || got[CHECK_EVEN_PORT] != CHECK_PASS || got[CHECK_RESERVATION_TOKEN] != CHECK_FAIL {
+		t.Fatalf("unexpected results:%v", got)
+	}
+
+	if _, err := CheckConformance(req, "no-such-check"); err == nil {
+		t.Fatalf("unknown check accepted")
+	}
+}
+
+// pion/turn answers a wrong password by 400, binds any channel number and grants short lifetimes as asked,
+// the rest of the catalog passes
+func TestConformanceCatalog(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeConformanceRequestST(server.UDPURI())
+	defer cancel()
+
+	results, err := CheckConformance(req)
+	got := statuses(t, results, err)
+	if len(got) != len(CheckNames()) {
+		t.Fatalf("%d results for %d checks", len(got), len(CheckNames()))
+	}
+
+	want := map[string]CheckStatus{
+		CHECK_WRONG_CREDENTIALS: CHECK_FAIL,
+		CHECK_CHANNEL_NUMBER:    CHECK_FAIL,
+		CHECK_LIFETIME:          CHECK_FAIL,
+		CHECK_RESERVATION_TOKEN: CHECK_FAIL,
+	}
+	for name, status := range got {
+		if expected, ok := want[name]; !ok && status != CHECK_PASS || ok && status != expected {
+			t.Errorf("%s got %s", name, status)
+		}
+	}
+
+	if _, err := json.Marshal(results); err != nil {
+		t.Fatalf("json.Marshal error:%v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package turntest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+var errFamilyIgnored = errors.New("not allocated and no ADDRESS-ERROR-CODE, ADDITIONAL-ADDRESS-FAMILY ignored")
+
+// additionalFamilyAttr asks for a relayed address of f besides the IPv4 one (RFC 8656 section 18.11)
+func additionalFamilyAttr(f AddressFamily) stun.RawAttribute {
+	return stun.RawAttribute{Type: attrAdditionalFamily, Value: []byte{byte(f), 0, 0, 0}}
+}
+
+// dualRelayed sorts the relayed addresses of a dual allocation response by family,
+// with the error of each family missing by its ADDRESS-ERROR-CODE (RFC 8656 section 18.12)
+func dualRelayed(res *stun.Message) (map[AddressFamily]*net.UDPAddr, map[AddressFamily]error) {
+	relayed := make(map[AddressFamily]*net.UDPAddr)
+	for _, addr := range xorAddrsFrom(res, stun.AttrXORRelayedAddress) {
+		relayed[familyOf(addr.IP)] = addr
+	}
+
+	failed := make(map[AddressFamily]error)
+	for _, attr := range res.Attributes {
+		if attr.Type != attrAddressErrorCode || len(attr.Value) < 4 {
+			continue
+		}
+
+		code := stun.ErrorCode(int(attr.Value[2]&0x7)*100 + int(attr.Value[3]))
+		failed[AddressFamily(attr.Value[0])] = &turnError{Method: stun.MethodAllocate, Code: code, Reason: string(attr.Value[4:])}
+	}
+
+	for _, family := range []AddressFamily{FAMILY_IPV4, FAMILY_IPV6} {
+		if _, ok := relayed[family]; ok {
+			delete(failed, family)
+		} else if _, ok := failed[family]; !ok {
+			failed[family] = errFamilyIgnored
+		}
+	}
+
+	return relayed, failed
+}
+
+// doTrunRequestDual asks for IPv4 and IPv6 relayed addresses in one Allocate and sends through each to a peer socket
+// of its family, a family the server didn't allocate is reported while the other one keeps going
+func doTrunRequestDual(req *TrunRequestST) error {
+	relay, err := allocRawRelayClient(req, additionalFamilyAttr(FAMILY_IPV6))
+	if err != nil {
+		req.Log.Warnf("[doTrunRequestDual-%d]allocRawRelayClient error:%s", req.ChanId, err)
+		sendErrorRequestResults(req, allocErrCode(req, err, 100))
+		return err
+	}
+	defer freeRelayClient(relay)
+
+	relayed, failed := dualRelayed(relay.Allocated)
+
+	var peers []net.PacketConn
+	defer func() {
+		for _, conn := range peers {
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(req.Ctx)
+	defer cancel()
+
+	// the server relays through the address of the family of the peer, so one relay conn serves both
+	timeSend := time.Now()
+	errCh := make(chan error, 2)
+	for _, family := range []AddressFamily{FAMILY_IPV4, FAMILY_IPV6} {
+		familyReq := *req
+		familyReq.Ctx = ctx
+		familyReq.family = family.String()
+
+		if err := failed[family]; err != nil {
+			req.Log.Warnf("[doTrunRequestDual-%d]%s relayed address error:%s", req.ChanId, family, err)
+			sendErrorRequestResults(&familyReq, ERRCODE_RELAY_FAMILY)
+			continue
+		}
+
+		mappedIp, err := peerIp(relay, relayed[family])
+		if err != nil {
+			req.Log.Warnf("[doTrunRequestDual-%d]%s peerIp error:%s", req.ChanId, family, err)
+			sendErrorRequestResults(&familyReq, 102)
+			continue
+		}
+
+		var lc net.ListenConfig
+		conn, err := lc.ListenPacket(ctx, family.udpNetwork(), family.wildcard())
+		if err != nil {
+			req.Log.Warnf("[doTrunRequestDual-%d]%s lc.ListenPacket error:%s", req.ChanId, family, err)
+			sendErrorRequestResults(&familyReq, 101)
+			continue
+		}
+		peers = append(peers, conn)
+
+		peerAddr := &net.UDPAddr{IP: mappedIp, Port: conn.LocalAddr().(*net.UDPAddr).Port}
+
+		go readAndVerifyDataback(&familyReq, conn, timeSend)
+		go func(familyReq *TrunRequestST, peerAddr net.Addr) {
+			err := sendData(familyReq, relay.RelayConn, peerAddr, timeSend)
+			cancel()
+			errCh <- err
+		}(&familyReq, peerAddr)
+	}
+
+	if len(peers) == 0 {
+		return fmt.Errorf("[doTrunRequestDual-%d]no relayed address to send through", req.ChanId)
+	}
+
+	for range peers {
+		if familyErr := <-errCh; err == nil {
+			err = familyErr
+		}
+	}
+
+	drainAfterRotation(req)
+	return err
+}
@@ -0,0 +1,71 @@
+package turntest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/stun"
+	"github.com/xylophone21/go-turn-test/statistics"
+	"github.com/xylophone21/go-turn-test/testserver"
+)
+
+func TestDualRelayed(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 50000}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50002}
+
+	both := stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+		xorAddrAttr{Type: stun.AttrXORRelayedAddress, Addr: v4},
+		xorAddrAttr{Type: stun.AttrXORRelayedAddress, Addr: v6})
+	relayed, failed := dualRelayed(both)
+	if len(failed) != 0 || !relayed[FAMILY_IPV4].IP.Equal(v4.IP) || !relayed[FAMILY_IPV6].IP.Equal(v6.IP) {
+		t.Fatalf("both families:%v %v", relayed, failed)
+	}
+
+	// 440 Address Family not Supported for IPv6
+	partial := stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+		xorAddrAttr{Type: stun.AttrXORRelayedAddress, Addr: v4},
+		stun.RawAttribute{Type: attrAddressErrorCode, Value: append([]byte{byte(FAMILY_IPV6), 0, 4, 40}, "no v6"...)})
+	relayed, failed = dualRelayed(partial)
+	if len(relayed) != 1 || errorCodeOf(failed[FAMILY_IPV6]) != stun.CodeAddrFamilyNotSupported || failed[FAMILY_IPV4] != nil {
+		t.Fatalf("partial:%v %v", relayed, failed)
+	}
+
+	ignored := stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+		xorAddrAttr{Type: stun.AttrXORRelayedAddress, Addr: v4})
+	if _, failed = dualRelayed(ignored); failed[FAMILY_IPV6] != errFamilyIgnored {
+		t.Fatalf("ignored:%v", failed)
+	}
+}
+
+// pion/turn ignores ADDITIONAL-ADDRESS-FAMILY, the family it doesn't relay on is reported and the other one still works
+func TestDualAllocation(t *testing.T) {
+	for _, relayIPv6 := range []bool{false, true} {
+		server := startFamilyServer(t, &testserver.ServerConfig{RelayIPv6: relayIPv6})
+
+		req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+		req.DualAllocation = true
+
+		results := collect(req, TrunRequest)
+		cancel()
+
+		works, fails := FAMILY_IPV4.String(), FAMILY_IPV6.String()
+		if relayIPv6 {
+			works, fails = fails, works
+		}
+		worked := results.Received().Count(func(result *statistics.RequestResults) bool { return result.Family == works })
+		failed := results.Received().Count(func(result *statistics.RequestResults) bool { return result.Family == fails })
+
+		t.Logf("%v %s:%d %s:%d", results, works, worked, fails, failed)
+		if worked < results.Sent()*9/10 || failed != 0 || results.ErrCodes()[ERRCODE_RELAY_FAMILY] == 0 {
+			t.Fatalf("%s should work and %s be reported:%v", works, fails, results)
+		}
+	}
+
+	req, cancel := makeTrunRequestST("", "127.0.0.1:3478", testUsername, testPassword)
+	defer cancel()
+	req.DualAllocation = true
+	req.RelayFamily = FAMILY_IPV6
+	if TrunRequest(req) == nil || TrunRequest2Cloud(req) == nil {
+		t.Fatalf("dual allocation with a relay family or 2-cloud accepted")
+	}
+}
@@ -0,0 +1,124 @@
+package turntest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pion/stun"
+)
+
+// AddressFamily is an IP address family, valued as in REQUESTED-ADDRESS-FAMILY (RFC 6156)
+type AddressFamily int32
+
+const (
+	FAMILY_ANY  AddressFamily = 0 // IPv4 sockets, the relay family is left to the server
+	FAMILY_IPV4 AddressFamily = 1
+	FAMILY_IPV6 AddressFamily = 2
+
+	// the server refused or ignored the family asked for by REQUESTED-ADDRESS-FAMILY or ADDITIONAL-ADDRESS-FAMILY
+	ERRCODE_RELAY_FAMILY = 111
+)
+
+var errRelayFamily = errors.New("relayed address of another family")
+
+var familyNames = map[AddressFamily]string{
+	FAMILY_ANY:  "any",
+	FAMILY_IPV4: "ipv4",
+	FAMILY_IPV6: "ipv6",
+}
+
+func (f AddressFamily) String() string {
+	if name, ok := familyNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("family-%d", int32(f))
+}
+
+// ParseAddressFamily parses a family name, "ipv4" or "4", "ipv6" or "6", "" or "any"
+func ParseAddressFamily(name string) (AddressFamily, error) {
+	switch strings.ToLower(name) {
+	case "", "any":
+		return FAMILY_ANY, nil
+	case "ipv4", "4":
+		return FAMILY_IPV4, nil
+	case "ipv6", "6":
+		return FAMILY_IPV6, nil
+	}
+	return FAMILY_ANY, fmt.Errorf("unknown address family %q", name)
+}
+
+// udpNetwork is the network to listen or resolve UDP on, udp4 unless IPv6 as pion/turn does
+func (f AddressFamily) udpNetwork() string {
+	if f == FAMILY_IPV6 {
+		return "udp6"
+	}
+	return "udp4"
+}
+
+// tcpNetwork is the network to dial TCP on, either family when any
+func (f AddressFamily) tcpNetwork() string {
+	switch f {
+	case FAMILY_IPV4:
+		return "tcp4"
+	case FAMILY_IPV6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// wildcard is the any address with any port to listen on
+func (f AddressFamily) wildcard() string {
+	if f == FAMILY_IPV6 {
+		return "[::]:0"
+	}
+	return "0.0.0.0:0"
+}
+
+// familyOf returns the family of ip
+func familyOf(ip net.IP) AddressFamily {
+	if ip.To4() != nil {
+		return FAMILY_IPV4
+	}
+	return FAMILY_IPV6
+}
+
+func requestedFamilyAttr(f AddressFamily) stun.RawAttribute {
+	return stun.RawAttribute{Type: stun.AttrRequestedAddressFamily, Value: []byte{byte(f), 0, 0, 0}}
+}
+
+// toUDPAddr returns addr as *net.UDPAddr
+func toUDPAddr(addr net.Addr) (*net.UDPAddr, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr, nil
+	}
+	return net.ResolveUDPAddr("udp", addr.String())
+}
+
+// peerIp is the IP the TURN server sees our own peer sockets from: the mapped IP of the TURN client when
+// of the family of relayed, else the source IP towards relayed as IPv6 is seldom behind NAT
+func peerIp(relay *relayClient, relayed *net.UDPAddr) (net.IP, error) {
+	mappedAddr, err := relay.sendBindingRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	mapped, err := toUDPAddr(mappedAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if familyOf(mapped.IP) == familyOf(relayed.IP) {
+		return mapped.IP, nil
+	}
+
+	// connecting UDP sends nothing, it only picks the route
+	conn, err := net.DialUDP(familyOf(relayed.IP).udpNetwork(), nil, relayed)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,77 @@
+package turntest
+
+import (
+	"testing"
+
+	"github.com/xylophone21/go-turn-test/testserver"
+)
+
+func TestParseAddressFamily(t *testing.T) {
+	cases := map[string]AddressFamily{"": FAMILY_ANY, "any": FAMILY_ANY, "IPv4": FAMILY_IPV4, "4": FAMILY_IPV4, "ipv6": FAMILY_IPV6, "6": FAMILY_IPV6}
+	for name, want := range cases {
+		if f, err := ParseAddressFamily(name); err != nil || f != want {
+			t.Fatalf("%q got %v error:%v", name, f, err)
+		}
+	}
+
+	if _, err := ParseAddressFamily("ipx"); err == nil {
+		t.Fatalf("ipx should fail")
+	}
+}
+
+func startFamilyServer(t *testing.T, cfg *testserver.ServerConfig) *testserver.Server {
+	cfg.Users = map[string]string{testUsername: testPassword}
+	server, err := testserver.Start(cfg)
+	if err != nil {
+		t.Skipf("no IPv6 loopback, testserver.Start error:%v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server
+}
+
+// an IPv6 client relaying to IPv4 peers
+func TestIPv6Client(t *testing.T) {
+	server := startFamilyServer(t, &testserver.ServerConfig{DualStack: true})
+
+	for _, run := range []func(req *TrunRequestST) error{TrunRequest, TrunRequest2Cloud} {
+		req, cancel := makeTrunRequestST("", server.UDP6URI(), testUsername, testPassword)
+		req.ClientFamily = FAMILY_IPV6
+
+		checkDelivered(t, collect(req, run))
+		cancel()
+	}
+}
+
+// an IPv4 client relaying to IPv6 peers
+func TestIPv6Relay(t *testing.T) {
+	server := startFamilyServer(t, &testserver.ServerConfig{RelayIPv6: true})
+
+	for _, run := range []func(req *TrunRequestST) error{TrunRequest, TrunRequest2Cloud} {
+		req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+		req.RelayFamily = FAMILY_IPV6
+
+		checkDelivered(t, collect(req, run))
+		cancel()
+	}
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+	defer cancel()
+	req.RelayFamily = FAMILY_IPV6
+	req.PeerCount = 2
+
+	checkDelivered(t, collect(req, TrunRequest))
+}
+
+func TestRelayFamilyIgnored(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+	defer cancel()
+	req.RelayFamily = FAMILY_IPV6
+
+	results := collect(req, TrunRequest)
+	if results.Recv() != 0 || results.ErrCodes()[ERRCODE_RELAY_FAMILY] == 0 {
+		t.Fatalf("IPv4 relay should be reported, got %v", results)
+	}
+}
@@ -0,0 +1,168 @@
+package turntest
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/xylophone21/go-turn-test/statistics"
+)
+
+const (
+	SETUP_CREATE_PERMISSION = "CreatePermission"
+	SETUP_CHANNEL_BIND      = "ChannelBind"
+)
+
+func sendSetupRequestResults(req *TrunRequestST, method string, peer int, latency time.Duration) {
+	if req.Ch != nil {
+		result := statistics.RequestResults{
+			ChanID:      req.ChanId,
+			Time:        time.Now(),
+			Latency:     latency,
+			Server:      req.TurnServerAddr,
+			Profile:     req.Profile.String(),
+			Peer:        peer,
+			SetupMethod: method,
+		}
+
+		req.Ch <- result
+	}
+}
+
+// fanoutPeerIp is the ip of peer i, a loopback address of its own when mappedIp is the IPv4 loopback so that
+// each peer adds a permission, else mappedIp shared by all the peers. It tells if the ip is distinct.
+func fanoutPeerIp(mappedIp net.IP, i int) (net.IP, bool) {
+	if ip4 := mappedIp.To4(); ip4 != nil && ip4.IsLoopback() && i < 254 {
+		return net.IPv4(127, 0, 0, byte(i+1)), true
+	}
+	return mappedIp, false
+}
+
+// fanoutDistinct tells if the peers get distinct ips, logging whether CreatePermission is timed per peer. Only Linux
+// binds the whole 127.0.0.0/8 by default, elsewhere the peers share the ip unless the loopback has the aliases.
+func fanoutDistinct(req *TrunRequestST, mappedIp net.IP) bool {
+	if req.PeerCount <= 1 {
+		return true
+	}
+
+	ip, distinct := fanoutPeerIp(mappedIp, req.PeerCount-1)
+	if !distinct {
+		req.Log.Warnf("[doTrunRequestFanout-%d]peers share ip %v, permission scaling is not measured", req.ChanId, mappedIp)
+		return false
+	}
+
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		req.Log.Warnf("[doTrunRequestFanout-%d]can't bind %v, peers share ip %v, permission scaling is not measured:%s",
+			req.ChanId, ip, mappedIp, err)
+		return false
+	}
+	conn.Close()
+
+	req.Log.Infof("[doTrunRequestFanout-%d]peers on distinct ips up to %v, permission timed per peer", req.ChanId, ip)
+	return true
+}
+
+// doTrunRequestFanout sends from one allocation to PeerCount peers of its own like a group call without SFU,
+// timing the ChannelBind of each peer as the tables of the server grow. Permissions are per ip (RFC 8656 9),
+// so CreatePermission is timed for each peer only when the peers have distinct ips, on the loopback.
+func doTrunRequestFanout(req *TrunRequestST) error {
+	relay, err := allocRawRelayClient(req)
+	if err != nil {
+		req.Log.Warnf("[doTrunRequestFanout-%d]allocRawRelayClient error:%s", req.ChanId, err)
+		sendErrorRequestResults(req, allocErrCode(req, err, 100))
+		return err
+	}
+	defer freeRelayClient(relay)
+
+	// Send BindingRequest to learn our external IP
+	mappedIp, err := peerIp(relay, relay.Raw.relayedAddrs()[0])
+	if err != nil {
+		req.Log.Warnf("[doTrunRequestFanout-%d]peerIp error:%s", req.ChanId, err)
+		sendErrorRequestResults(req, 102)
+		return err
+	}
+	peerFamily := familyOf(mappedIp)
+
+	var peers []net.PacketConn
+	defer func() {
+		for _, conn := range peers {
+			conn.Close()
+		}
+	}()
+
+	distinctIps := fanoutDistinct(req, mappedIp)
+
+	var lc net.ListenConfig
+	peerAddrs := make([]*net.UDPAddr, req.PeerCount)
+	for i := range peerAddrs {
+		ip, distinct := fanoutPeerIp(mappedIp, i)
+		if !distinctIps {
+			ip, distinct = mappedIp, false
+		}
+		listenAddr := peerFamily.wildcard()
+		if distinct {
+			listenAddr = net.JoinHostPort(ip.String(), "0")
+		}
+
+		conn, err := lc.ListenPacket(req.Ctx, peerFamily.udpNetwork(), listenAddr)
+		if err != nil {
+			req.Log.Warnf("[doTrunRequestFanout-%d]lc.ListenPacket error:%s", req.ChanId, err)
+			sendErrorRequestResults(req, 101)
+			return err
+		}
+		peers = append(peers, conn)
+
+		// the public ip with the port of the peer, as doTrunRequest does
+		peerAddrs[i] = &net.UDPAddr{IP: ip, Port: conn.LocalAddr().(*net.UDPAddr).Port}
+
+		// a shared ip has one permission, refreshing it would time nothing new
+		if distinct || i == 0 {
+			start := time.Now()
+			err = relay.Raw.createPermission(peerAddrs[i])
+			if err != nil {
+				req.Log.Warnf("[doTrunRequestFanout-%d]createPermission of peer %d error:%s", req.ChanId, i+1, err)
+				sendErrorRequestResults(req, 106)
+				return err
+			}
+			sendSetupRequestResults(req, SETUP_CREATE_PERMISSION, i+1, time.Since(start))
+		}
+
+		start := time.Now()
+		_, err = relay.Raw.channelBind(peerAddrs[i])
+		if err != nil {
+			req.Log.Warnf("[doTrunRequestFanout-%d]channelBind of peer %d error:%s", req.ChanId, i+1, err)
+			sendErrorRequestResults(req, 107)
+			return err
+		}
+		sendSetupRequestResults(req, SETUP_CHANNEL_BIND, i+1, time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(req.Ctx)
+	defer cancel()
+
+	// each peer gets a stream of its own, the first one failing stops the others
+	timeSend := time.Now()
+	errCh := make(chan error, len(peers))
+	for i, conn := range peers {
+		peerReq := *req
+		peerReq.Ctx = ctx
+		peerReq.peer = i + 1
+
+		go readAndVerifyDataback(&peerReq, conn, timeSend)
+		go func(peerReq *TrunRequestST, peerAddr net.Addr) {
+			err := sendData(peerReq, relay.RelayConn, peerAddr, timeSend)
+			cancel()
+			errCh <- err
+		}(&peerReq, peerAddrs[i])
+	}
+
+	for range peers {
+		if peerErr := <-errCh; err == nil {
+			err = peerErr
+		}
+	}
+
+	drainAfterRotation(req)
+	return err
+}
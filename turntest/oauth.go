@@ -0,0 +1,117 @@
+package turntest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// error code in statistics when the server rejects our access token (RFC 7635 section 6.2)
+	ERRCODE_TOKEN_EXPIRED = 110
+)
+
+type OAuthTokenRequest struct {
+	GrantType string        `json:"grant_type"`
+	ClientId  string        `json:"client_id"`
+	Audience  string        `json:"audience"` // TURN server the token is for
+	Timeout   time.Duration `json:"-"`        // optional, 10 seconds when zero
+}
+
+// OAuthToken is a RFC 7635 access token issued by the authorization server
+type OAuthToken struct {
+	AccessToken string    `json:"access_token"` // base64 of the self-contained token
+	TokenType   string    `json:"token_type"`
+	ExpiresIn   int64     `json:"expires_in"` // seconds
+	Kid         string    `json:"kid"`        // key id, sent as USERNAME
+	Key         string    `json:"key"`        // base64 of mac_key, keying MESSAGE-INTEGRITY
+	Alg         string    `json:"alg"`
+	Expired     time.Time `json:"-"`
+}
+
+// FetchOAuthToken gets an access token from the authorization endpoint apiUrl
+func FetchOAuthToken(apiUrl string, request *OAuthTokenRequest) (*OAuthToken, error) {
+	requestBody := new(bytes.Buffer)
+	json.NewEncoder(requestBody).Encode(request)
+
+	req, err := http.NewRequest("POST", apiUrl, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: request.Timeout}
+	if client.Timeout <= 0 {
+		client.Timeout = apiTimeout
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authorization server status %d: %s", resp.StatusCode, body)
+	}
+
+	var token OAuthToken
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.AccessToken == "" || token.Kid == "" || token.Key == "" {
+		return nil, fmt.Errorf("authorization server response without access_token, kid or key")
+	}
+
+	token.Expired = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return &token, nil
+}
+
+// renewToken fetches a new access token when there is none yet or the current one is about to expire
+func renewToken(req *TrunRequestST) error {
+	if req.OAuthUrl == "" {
+		return nil
+	}
+
+	if req.Token != nil && time.Now().Before(req.Token.Expired.Add(-credentialRenewAhead)) {
+		return nil
+	}
+
+	token, err := FetchOAuthToken(req.OAuthUrl, &OAuthTokenRequest{
+		GrantType: "client_credentials",
+		ClientId:  req.OAuthClientId,
+		Audience:  req.TurnServerAddr,
+	})
+	if err != nil {
+		return err
+	}
+
+	req.Log.Debugf("[renewToken-%d]kid=%s expired=%v", req.ChanId, token.Kid, token.Expired)
+	req.Token = token
+
+	return nil
+}
+
+// allocErrCode returns the statistics code of an allocation error, defCode unless it needs a distinct one
+func allocErrCode(req *TrunRequestST, err error, defCode int) int {
+	if req.Token != nil && errorCodeOf(err) == stun.CodeUnauthorized {
+		return ERRCODE_TOKEN_EXPIRED
+	}
+	if errors.Is(err, errRelayFamily) || errorCodeOf(err) == stun.CodeAddrFamilyNotSupported {
+		return ERRCODE_RELAY_FAMILY
+	}
+	return defCode
+}
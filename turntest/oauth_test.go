@@ -0,0 +1,72 @@
+package turntest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+func TestFetchOAuthToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request OAuthTokenRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.ClientId != "client" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(&OAuthToken{
+			AccessToken: "dG9rZW4=",
+			TokenType:   "pop",
+			ExpiresIn:   60,
+			Kid:         "kid",
+			Key:         "a2V5",
+		})
+	}))
+	defer server.Close()
+
+	token, err := FetchOAuthToken(server.URL, &OAuthTokenRequest{ClientId: "client"})
+	if err != nil {
+		t.Fatalf("FetchOAuthToken error:%v", err)
+	}
+
+	if token.Kid != "kid" || time.Until(token.Expired) < time.Second*50 {
+		t.Fatalf("token error:%v", token)
+	}
+
+	_, err = FetchOAuthToken(server.URL, &OAuthTokenRequest{ClientId: "other"})
+	if err == nil {
+		t.Fatalf("FetchOAuthToken should fail")
+	}
+
+	req := &TrunRequestST{Token: token}
+	unauthorized := fmt.Errorf("allocate:%w", &turnError{Method: stun.MethodAllocate, Code: stun.CodeUnauthorized})
+	if allocErrCode(req, unauthorized, 100) != ERRCODE_TOKEN_EXPIRED {
+		t.Fatalf("allocErrCode should be ERRCODE_TOKEN_EXPIRED")
+	}
+
+	if allocErrCode(&TrunRequestST{}, unauthorized, 100) != 100 {
+		t.Fatalf("allocErrCode should be 100 without token")
+	}
+}
+
+// an authorization server not answering fails the fetch after the timeout
+func TestFetchOAuthTokenTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	start := time.Now()
+	_, err := FetchOAuthToken(server.URL, &OAuthTokenRequest{ClientId: "client", Timeout: time.Millisecond * 200})
+	if elapsed := time.Since(start); err == nil || elapsed > time.Second*3 {
+		t.Fatalf("FetchOAuthToken not timed out after %v:%v", elapsed, err)
+	}
+}
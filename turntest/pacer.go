@@ -0,0 +1,111 @@
+package turntest
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// the bucket holds at least this much sending time, so timer slack is caught up instead of lost
+	minPacerDepth = time.Millisecond * 10
+	minPacerCost  = time.Microsecond
+)
+
+// pacer spaces packets by a token bucket (GCRA), it schedules on absolute times so oversleeping
+// or slow writes are caught up by the following packets, up to Burst packets back-to-back
+type pacer struct {
+	bitrate  int64         // bits per second, or packet interval when 0
+	interval time.Duration // per packet
+	burst    int
+	tat      time.Time // theoretical arrival time of the next packet
+}
+
+func newPacer(req *TrunRequestST) *pacer {
+	return &pacer{
+		bitrate:  req.Bitrate,
+		interval: packetInterval(req),
+		burst:    req.Burst,
+	}
+}
+
+// packetInterval is the time between packets when pacing by packets, PacketRate or PackageWait
+func packetInterval(req *TrunRequestST) time.Duration {
+	if req.PacketRate > 0 {
+		return time.Duration(float64(time.Second) / req.PacketRate)
+	}
+	return req.PackageWait
+}
+
+// targetBitrate is the bits per second req aims at sending packets of size bytes
+func targetBitrate(req *TrunRequestST, size uint64) uint64 {
+	if req.Profile != PROFILE_FIXED {
+		return uint64(profileBitrate(req))
+	}
+
+	if req.Bitrate > 0 {
+		return uint64(req.Bitrate)
+	}
+
+	interval := packetInterval(req)
+	if interval <= 0 {
+		return 0
+	}
+	return uint64(float64(size*8) * float64(time.Second) / float64(interval))
+}
+
+// cost is the sending time of a packet of size bytes
+func (p *pacer) cost(size int) time.Duration {
+	cost := p.interval
+	if p.bitrate > 0 {
+		cost = time.Duration(int64(size) * 8 * int64(time.Second) / p.bitrate)
+	}
+
+	if cost < minPacerCost {
+		cost = minPacerCost
+	}
+	return cost
+}
+
+// wait blocks until a packet of size bytes may be sent, it returns false when ctx is done first
+func (p *pacer) wait(ctx context.Context, size int) bool {
+	if wait := p.reserve(time.Now(), size); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// reserve takes the tokens of a packet of size bytes at now, it returns how long to wait before sending it
+func (p *pacer) reserve(now time.Time, size int) time.Duration {
+	cost := p.cost(size)
+
+	tolerance := cost * time.Duration(p.burst-1)
+	if tolerance < minPacerDepth {
+		tolerance = minPacerDepth
+	}
+
+	if p.tat.IsZero() {
+		// start with an empty bucket
+		p.tat = now.Add(tolerance)
+	} else if p.tat.Before(now) {
+		// the bucket is full, the rest of the stall is lost
+		p.tat = now
+	}
+
+	due := p.tat.Add(-tolerance)
+	p.tat = p.tat.Add(cost)
+
+	return due.Sub(now)
+}
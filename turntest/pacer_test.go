@@ -0,0 +1,90 @@
+package turntest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// countPaced counts the packets the pacer lets through during d of a virtual clock, sending takes no time
+// and every stallEvery packets the sender stalls for stall
+func countPaced(p *pacer, size int, d time.Duration, stallEvery int, stall time.Duration) int {
+	now := time.Unix(0, 0)
+	end := now.Add(d)
+
+	count := 0
+	for {
+		if wait := p.reserve(now, size); wait > 0 {
+			now = now.Add(wait)
+		}
+		if !now.Before(end) {
+			return count
+		}
+
+		count++
+		if stallEvery > 0 && count%stallEvery == 0 {
+			now = now.Add(stall)
+		}
+	}
+}
+
+func checkRate(t *testing.T, got int, want int) {
+	if got != want {
+		t.Fatalf("got %d packets, want %d", got, want)
+	}
+}
+
+func TestPacerBitrate(t *testing.T) {
+	// 2mbps of 1000 bytes packets is 250 packets a second
+	p := newPacer(&TrunRequestST{Bitrate: 2000000})
+	checkRate(t, countPaced(p, 1000, time.Second, 0, 0), 250)
+
+	if target := targetBitrate(&TrunRequestST{Bitrate: 2000000}, 1000); target != 2000000 {
+		t.Fatalf("target %d", target)
+	}
+}
+
+func TestPacerPacketRate(t *testing.T) {
+	// far below the sleep granularity
+	p := newPacer(&TrunRequestST{PacketRate: 10000})
+	checkRate(t, countPaced(p, 100, time.Second, 0, 0), 10000)
+
+	if target := targetBitrate(&TrunRequestST{PackageWait: time.Millisecond * 10}, 100); target != 80000 {
+		t.Fatalf("target %d", target)
+	}
+}
+
+func TestPacerCatchUp(t *testing.T) {
+	// 5ms stalls are within the bucket and caught up
+	p := newPacer(&TrunRequestST{PacketRate: 1000})
+	checkRate(t, countPaced(p, 100, time.Second, 20, time.Millisecond*5), 1000)
+
+	// 100ms stalls overflow a 20 packets bucket, 80 packets are lost by each of the 3 stalls
+	p = newPacer(&TrunRequestST{PacketRate: 1000, Burst: 20})
+	checkRate(t, countPaced(p, 100, time.Second, 200, time.Millisecond*100), 760)
+}
+
+// wait sleeps out reserve on the real clock, loosely as the machine may be loaded
+func TestPacerWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+
+	p := newPacer(&TrunRequestST{PacketRate: 1000})
+	count := 0
+	for p.wait(ctx, 100) {
+		count++
+	}
+	if count < 250 || count > 600 {
+		t.Fatalf("got %d packets, want about 500", count)
+	}
+}
+
+func TestPacerCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := newPacer(&TrunRequestST{PackageWait: time.Second})
+	if p.wait(ctx, 100) {
+		t.Fatalf("canceled pacer should not send")
+	}
+}
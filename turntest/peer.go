@@ -0,0 +1,742 @@
+package turntest
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/xylophone21/go-turn-test/impair"
+)
+
+const (
+	peerTimeout        = time.Second * 10 // for a remote peer to answer a control message
+	peerBindingTimeout = time.Millisecond * 500
+	peerBindingRetries = 3
+
+	// types of the control messages
+	PEER_MSG_REGISTER = "register" // peer -> tester, first message of a peer, with the token of the tester
+	PEER_MSG_JOB      = "job"      // tester -> peer, set up the far end of a channel
+	PEER_MSG_READY    = "ready"    // peer -> tester, with the address the peer sends from
+	PEER_MSG_START    = "start"    // tester -> peer, our relay permits the peer now
+	PEER_MSG_STARTED  = "started"  // peer -> tester, the peer permits our relay now
+	PEER_MSG_STOP     = "stop"     // tester -> peer, the channel is over
+	PEER_MSG_ERROR    = "error"    // peer -> tester, the job failed, tester -> peer, the register is refused
+)
+
+// peerMessage is one JSON line of the control channel between the tester and a remote peer
+type peerMessage struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name,omitempty"`    // register
+	Token   string   `json:"token,omitempty"`   // register
+	Id      uint64   `json:"id,omitempty"`      // of the job
+	Job     *peerJob `json:"job,omitempty"`     // job
+	Addr    string   `json:"addr,omitempty"`    // ready
+	Message string   `json:"message,omitempty"` // error
+}
+
+// peerJob tells a remote peer how to be the far end of a channel, the credentials are only handed to peers
+// presenting the token, short-lived ones with a TURN REST API secret
+type peerJob struct {
+	ChanId         uint64         `json:"chanId"`
+	TwoCloud       bool           `json:"twoCloud"` // the peer allocates a relay of its own, otherwise it talks to our relay from its own socket
+	Echo           bool           `json:"echo"`     // reflect the packages, otherwise send them to RelayAddr
+	RelayAddr      string         `json:"relayAddr"`
+	StunServerAddr string         `json:"stunServerAddr"`
+	TurnServerAddr string         `json:"turnServerAddr"`
+	Username       string         `json:"username"`
+	Password       string         `json:"password"`
+	PackageSize    int32          `json:"packageSize"`
+	PackageWait    time.Duration  `json:"packageWait"`
+	Bitrate        int64          `json:"bitrate"`
+	PacketRate     float64        `json:"packetRate"`
+	Burst          int            `json:"burst"`
+	Profile        TrafficProfile `json:"profile"`
+	Rtp            bool           `json:"rtp"`
+	RelayFamily    AddressFamily  `json:"relayFamily,omitempty"` // of the peer's relay in 2-cloud
+}
+
+// peerConn sends JSON lines to the other end of the control channel
+type peerConn struct {
+	conn net.Conn
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func newPeerConn(conn net.Conn) *peerConn {
+	return &peerConn{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+	}
+}
+
+func (c *peerConn) send(msg *peerMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(peerTimeout))
+	return c.enc.Encode(msg)
+}
+
+type PeerHubConfig struct {
+	Addr      string      // TCP address to listen for remote peers on (e.g. ":7000")
+	Token     string      // shared with the peers, which must present it before getting any job
+	TlsConfig *tls.Config // optional, with the certificate to serve the control channel over TLS by
+	Log       logging.LeveledLogger
+}
+
+// PeerHub accepts remote peers on the control channel and hands them the far ends of the channels
+type PeerHub struct {
+	jobs     uint64 // first for 64 bits atomic alignment
+	log      logging.LeveledLogger
+	token    string
+	listener net.Listener
+
+	lock  sync.Mutex
+	peers []*remotePeer
+	next  int
+}
+
+// remotePeer is a registered peer seen from the tester
+type remotePeer struct {
+	*peerConn
+	name    string
+	closed  chan struct{}
+	lock    sync.Mutex
+	replies map[uint64]chan *peerMessage // by job id
+}
+
+// ListenPeers listens for remote peers on cfg.Addr, only the ones presenting cfg.Token register
+func ListenPeers(cfg *PeerHubConfig) (*PeerHub, error) {
+	if cfg == nil || cfg.Addr == "" || cfg.Token == "" || cfg.Log == nil {
+		return nil, fmt.Errorf("[ListenPeers]Paramters error")
+	}
+
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TlsConfig != nil {
+		listener = tls.NewListener(listener, cfg.TlsConfig)
+	}
+
+	hub := &PeerHub{
+		log:      cfg.Log,
+		token:    cfg.Token,
+		listener: listener,
+	}
+	go hub.accept()
+
+	return hub, nil
+}
+
+// Addr is the control address peers register with
+func (h *PeerHub) Addr() net.Addr {
+	return h.listener.Addr()
+}
+
+// Count returns how many peers are registered
+func (h *PeerHub) Count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.peers)
+}
+
+// WaitPeers blocks until count peers are registered or ctx is done
+func (h *PeerHub) WaitPeers(ctx context.Context, count int) error {
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+
+	for h.Count() < count {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d of %d peers registered:%v", h.Count(), count, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// Close stops listening and drops the peers
+func (h *PeerHub) Close() error {
+	err := h.listener.Close()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, peer := range h.peers {
+		peer.conn.Close()
+	}
+	return err
+}
+
+func (h *PeerHub) accept() {
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+		go h.serve(conn)
+	}
+}
+
+// serve reads the messages of a peer until it goes away
+func (h *PeerHub) serve(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	conn.SetReadDeadline(time.Now().Add(peerTimeout))
+	if !scanner.Scan() {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var msg peerMessage
+	if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil || msg.Type != PEER_MSG_REGISTER {
+		h.log.Warnf("[PeerHub]bad register from %v", conn.RemoteAddr())
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(msg.Token), []byte(h.token)) != 1 {
+		h.log.Warnf("[PeerHub]bad token of peer %s from %v", msg.Name, conn.RemoteAddr())
+		newPeerConn(conn).send(&peerMessage{Type: PEER_MSG_ERROR, Message: "bad token"})
+		return
+	}
+
+	peer := &remotePeer{
+		peerConn: newPeerConn(conn),
+		name:     msg.Name,
+		closed:   make(chan struct{}),
+		replies:  make(map[uint64]chan *peerMessage),
+	}
+	h.add(peer)
+	defer h.remove(peer)
+
+	h.log.Infof("[PeerHub]peer %s registered from %v", peer.name, conn.RemoteAddr())
+
+	for scanner.Scan() {
+		var msg peerMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			h.log.Warnf("[PeerHub]bad message from %s:%s", peer.name, err)
+			continue
+		}
+		peer.reply(&msg)
+	}
+
+	h.log.Infof("[PeerHub]peer %s left", peer.name)
+}
+
+func (h *PeerHub) add(peer *remotePeer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.peers = append(h.peers, peer)
+}
+
+func (h *PeerHub) remove(peer *remotePeer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, p := range h.peers {
+		if p == peer {
+			h.peers = append(h.peers[:i], h.peers[i+1:]...)
+			break
+		}
+	}
+	close(peer.closed)
+}
+
+// pick returns the peers in turn
+func (h *PeerHub) pick() *remotePeer {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.peers) == 0 {
+		return nil
+	}
+
+	h.next = (h.next + 1) % len(h.peers)
+	return h.peers[h.next]
+}
+
+// reply passes msg to the session of its job
+func (p *remotePeer) reply(msg *peerMessage) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if ch, ok := p.replies[msg.Id]; ok {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// peerSession is a job on a remote peer seen from the tester
+type peerSession struct {
+	peer    *remotePeer
+	id      uint64
+	replies chan *peerMessage
+}
+
+// open hands job to one of the peers and waits until it is ready, returning the address the peer sends from
+func (h *PeerHub) open(ctx context.Context, job *peerJob) (*peerSession, net.Addr, error) {
+	peer := h.pick()
+	if peer == nil {
+		return nil, nil, fmt.Errorf("no remote peer registered")
+	}
+
+	s := &peerSession{
+		peer:    peer,
+		id:      atomic.AddUint64(&h.jobs, 1),
+		replies: make(chan *peerMessage, 4),
+	}
+
+	peer.lock.Lock()
+	peer.replies[s.id] = s.replies
+	peer.lock.Unlock()
+
+	err := peer.send(&peerMessage{Type: PEER_MSG_JOB, Id: s.id, Job: job})
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+
+	msg, err := s.wait(ctx, PEER_MSG_READY)
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", msg.Addr)
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+
+	return s, addr, nil
+}
+
+// start tells the peer our relay permits it and waits until the peer permits our relay
+func (s *peerSession) start(ctx context.Context) error {
+	err := s.peer.send(&peerMessage{Type: PEER_MSG_START, Id: s.id})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.wait(ctx, PEER_MSG_STARTED)
+	return err
+}
+
+func (s *peerSession) wait(ctx context.Context, msgType string) (*peerMessage, error) {
+	timer := time.NewTimer(peerTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-s.replies:
+		if msg.Type == PEER_MSG_ERROR {
+			return nil, fmt.Errorf("peer %s:%s", s.peer.name, msg.Message)
+		}
+		if msg.Type != msgType {
+			return nil, fmt.Errorf("peer %s answered %s, want %s", s.peer.name, msg.Type, msgType)
+		}
+		return msg, nil
+
+	case <-s.peer.closed:
+		return nil, fmt.Errorf("peer %s left", s.peer.name)
+
+	case <-timer.C:
+		return nil, fmt.Errorf("peer %s didn't answer %s", s.peer.name, msgType)
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// close ends the job on the peer
+func (s *peerSession) close() {
+	s.peer.send(&peerMessage{Type: PEER_MSG_STOP, Id: s.id})
+
+	s.peer.lock.Lock()
+	delete(s.peer.replies, s.id)
+	s.peer.lock.Unlock()
+}
+
+// doTrunRequestPeer runs req with a remote peer as the far end, in 1-cloud the peer's own socket
+// talks to our relay, in 2-cloud the peer allocates a relay of its own
+func doTrunRequestPeer(req *TrunRequestST, twoCloud bool) error {
+	allocCode, peerCode, permitCode := 100, 105, 103
+	if twoCloud {
+		allocCode, peerCode, permitCode = 200, 205, 202
+	}
+
+	relay, err := allocRelayClient(req)
+	if err != nil {
+		sendErrorRequestResults(req, allocErrCode(req, err, allocCode))
+		return err
+	}
+	defer freeRelayClient(relay)
+
+	job := &peerJob{
+		ChanId:         req.ChanId,
+		TwoCloud:       twoCloud,
+		Echo:           req.Echo,
+		RelayAddr:      relay.RelayConn.LocalAddr().String(),
+		StunServerAddr: req.StunServerAddr,
+		TurnServerAddr: req.TurnServerAddr,
+		Username:       req.Username,
+		Password:       req.Password,
+		PackageSize:    req.PackageSize,
+		PackageWait:    req.PackageWait,
+		Bitrate:        req.Bitrate,
+		PacketRate:     req.PacketRate,
+		Burst:          req.Burst,
+		Profile:        req.Profile,
+		Rtp:            req.Rtp,
+		RelayFamily:    req.RelayFamily,
+	}
+
+	session, peerAddr, err := req.Peers.open(req.Ctx, job)
+	if err != nil {
+		req.Log.Warnf("[doTrunRequestPeer-%d]open remote peer error:%s", req.ChanId, err)
+		sendErrorRequestResults(req, peerCode)
+		return err
+	}
+	defer session.close()
+
+	// added the peer to permission list in turn server
+	_, err = relay.RelayConn.WriteTo([]byte("Hello"), peerAddr)
+	if err != nil {
+		req.Log.Warnf("[doTrunRequestPeer-%d]relayConn.WriteTo error:%s", req.ChanId, err)
+		sendErrorRequestResults(req, permitCode)
+		return err
+	}
+
+	err = session.start(req.Ctx)
+	if err != nil {
+		req.Log.Warnf("[doTrunRequestPeer-%d]start remote peer error:%s", req.ChanId, err)
+		sendErrorRequestResults(req, peerCode)
+		return err
+	}
+
+	timeSend := time.Now()
+	go readAndVerifyDataback(req, relay.RelayConn, timeSend)
+
+	if req.Echo {
+		err = sendData(req, relay.RelayConn, peerAddr, timeSend)
+	} else {
+		// the peer sends, so there are no sent results here and the loss shows as "-", Rtp still tells
+		// the loss by the sequence numbers, latencies are only right when the clocks of both hosts are in sync
+		<-req.Ctx.Done()
+	}
+
+	drainAfterRotation(req)
+	freeRelayClient(relay)
+
+	return err
+}
+
+type PeerConfig struct {
+	Tester    string         // control address of the tester (e.g. "tester.abc.com:7000")
+	Token     string         // shared with the tester
+	TesterTls *tls.Config    // optional, to reach the tester over TLS by
+	Name      string         // how the tester logs us
+	TlsConfig *tls.Config    // optional, for turns: servers
+	Impair    *impair.Config // optional, impairs the packets our UDP sockets send
+	Log       logging.LeveledLogger
+}
+
+// RunPeer registers with the tester and serves as the far end of the channels it hands out,
+// until ctx is done or the control connection drops
+func RunPeer(ctx context.Context, cfg *PeerConfig) error {
+	var conn net.Conn
+	var err error
+	if cfg.TesterTls != nil {
+		d := tls.Dialer{Config: cfg.TesterTls}
+		conn, err = d.DialContext(ctx, "tcp", cfg.Tester)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", cfg.Tester)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	tester := newPeerConn(conn)
+	err = tester.send(&peerMessage{Type: PEER_MSG_REGISTER, Name: cfg.Name, Token: cfg.Token})
+	if err != nil {
+		return err
+	}
+
+	cfg.Log.Infof("[RunPeer]registered with %v", conn.RemoteAddr())
+
+	// the tasks leave when stopped or done
+	var lock sync.Mutex
+	tasks := make(map[uint64]*peerTask)
+	takeTask := func(id uint64, remove bool) *peerTask {
+		lock.Lock()
+		defer lock.Unlock()
+
+		task := tasks[id]
+		if remove {
+			delete(tasks, id)
+		}
+		return task
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var msg peerMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			cfg.Log.Warnf("[RunPeer]bad message:%s", err)
+			continue
+		}
+
+		switch msg.Type {
+		case PEER_MSG_JOB:
+			if msg.Job == nil || takeTask(msg.Id, false) != nil {
+				continue
+			}
+			task := newPeerTask(ctx, cfg, tester, msg.Id, msg.Job)
+			lock.Lock()
+			tasks[msg.Id] = task
+			lock.Unlock()
+
+			go func() {
+				task.run()
+				lock.Lock()
+				if tasks[task.id] == task {
+					delete(tasks, task.id)
+				}
+				lock.Unlock()
+			}()
+
+		case PEER_MSG_START:
+			if task := takeTask(msg.Id, false); task != nil {
+				task.start()
+			}
+
+		case PEER_MSG_STOP:
+			if task := takeTask(msg.Id, true); task != nil {
+				task.cancel()
+			}
+
+		case PEER_MSG_ERROR:
+			return fmt.Errorf("tester refused us:%s", msg.Message)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("tester closed the control connection")
+}
+
+// peerTask is a job seen from the peer
+type peerTask struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	cfg     *PeerConfig
+	tester  *peerConn
+	id      uint64
+	job     *peerJob
+	started chan struct{}
+	once    sync.Once // for a START sent again
+}
+
+func newPeerTask(ctx context.Context, cfg *PeerConfig, tester *peerConn, id uint64, job *peerJob) *peerTask {
+	t := &peerTask{
+		cfg:     cfg,
+		tester:  tester,
+		id:      id,
+		job:     job,
+		started: make(chan struct{}),
+	}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+
+	return t
+}
+
+// start lets the task send, once however many times the tester says so
+func (t *peerTask) start() {
+	t.once.Do(func() { close(t.started) })
+}
+
+func (t *peerTask) run() {
+	defer t.cancel()
+
+	err := t.serve()
+	if err != nil {
+		t.cfg.Log.Warnf("[peerTask-%d]%s", t.job.ChanId, err)
+		t.tester.send(&peerMessage{Type: PEER_MSG_ERROR, Id: t.id, Message: err.Error()})
+	}
+}
+
+func (t *peerTask) serve() error {
+	job := t.job
+	req := &TrunRequestST{
+		Ctx:            t.ctx,
+		Log:            t.cfg.Log,
+		ChanId:         job.ChanId,
+		PackageSize:    job.PackageSize,
+		PackageWait:    job.PackageWait,
+		Bitrate:        job.Bitrate,
+		PacketRate:     job.PacketRate,
+		Burst:          job.Burst,
+		Profile:        job.Profile,
+		Rtp:            job.Rtp,
+		Echo:           job.Echo,
+		RelayFamily:    job.RelayFamily,
+		StunServerAddr: job.StunServerAddr,
+		TurnServerAddr: job.TurnServerAddr,
+		TlsConfig:      t.cfg.TlsConfig,
+		Username:       job.Username,
+		Password:       job.Password,
+		Impair:         t.cfg.Impair,
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", job.RelayAddr)
+	if err != nil {
+		return err
+	}
+
+	var conn net.PacketConn
+	var addr net.Addr
+	if job.TwoCloud {
+		relay, err := allocRelayClient(req)
+		if err != nil {
+			return fmt.Errorf("allocate error:%v", err)
+		}
+		defer freeRelayClient(relay)
+
+		conn = relay.RelayConn
+		addr = relay.RelayConn.LocalAddr()
+	} else {
+		// of the family of the tester's relay, as TURN relays within one family
+		family := familyOf(relayAddr.IP)
+		var lc net.ListenConfig
+		conn, err = lc.ListenPacket(t.ctx, family.udpNetwork(), family.wildcard())
+		if err != nil {
+			return err
+		}
+		conn = impair.Wrap(conn, req.Impair)
+		defer conn.Close()
+
+		addr, err = peerBinding(conn, req.StunServerAddr)
+		if err != nil {
+			return fmt.Errorf("binding error:%v", err)
+		}
+	}
+
+	err = t.tester.send(&peerMessage{Type: PEER_MSG_READY, Id: t.id, Addr: addr.String()})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-t.started:
+	case <-t.ctx.Done():
+		return nil
+	case <-time.After(peerTimeout):
+		return fmt.Errorf("not started")
+	}
+
+	// added the tester's relay to permission list in turn server, or opened our NAT to it
+	_, err = conn.WriteTo([]byte("Hello"), relayAddr)
+	if err != nil {
+		return err
+	}
+
+	err = t.tester.send(&peerMessage{Type: PEER_MSG_STARTED, Id: t.id})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-t.ctx.Done()
+		conn.Close()
+	}()
+
+	if job.Echo {
+		echoPackages(req, conn)
+		return nil
+	}
+
+	sendData(req, conn, relayAddr, time.Now())
+	return nil
+}
+
+// peerBinding learns the address the STUN server stunServerAddr sees conn from
+func peerBinding(conn net.PacketConn, stunServerAddr string) (net.Addr, error) {
+	uri, err := ParseStunURI(stunServerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := toUDPAddr(conn.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := net.ResolveUDPAddr(familyOf(local.IP).udpNetwork(), uri.Addr())
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 1500)
+	for i := 0; i < peerBindingRetries; i++ {
+		_, err = conn.WriteTo(msg.Raw, server)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(peerBindingTimeout))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+
+			res := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if res.Decode() != nil || res.TransactionID != msg.TransactionID {
+				continue
+			}
+
+			var mapped stun.XORMappedAddress
+			if err = mapped.GetFrom(res); err != nil {
+				return nil, err
+			}
+			return &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no binding response from %v", server)
+}
@@ -0,0 +1,152 @@
+package turntest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/testserver"
+)
+
+const testPeerToken = "peer-token"
+
+// startPeers runs a peer hub with a registered local peer, over TLS when tlsConfigs
+func startPeers(t *testing.T, tlsConfigs bool) *PeerHub {
+	f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevelWarn}
+
+	hubCfg := &PeerHubConfig{Addr: "127.0.0.1:0", Token: testPeerToken, Log: f.NewLogger("hub")}
+	peerCfg := &PeerConfig{Token: testPeerToken, Name: "test-peer", Log: f.NewLogger("peer")}
+	if tlsConfigs {
+		serverTls, clientTls, err := testserver.NewTlsConfigs()
+		if err != nil {
+			t.Fatalf("NewTlsConfigs error:%v", err)
+		}
+		hubCfg.TlsConfig = serverTls
+		peerCfg.TesterTls = clientTls
+	}
+
+	hub, err := ListenPeers(hubCfg)
+	if err != nil {
+		t.Fatalf("ListenPeers error:%v", err)
+	}
+	t.Cleanup(func() { hub.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	peerCfg.Tester = hub.Addr().String()
+	go RunPeer(ctx, peerCfg)
+
+	if err = hub.WaitPeers(ctx, 1); err != nil {
+		t.Fatalf("WaitPeers error:%v", err)
+	}
+
+	return hub
+}
+
+func TestRemotePeer(t *testing.T) {
+	server := startTestServer(t)
+	hub := startPeers(t, false)
+
+	cases := []struct {
+		name string
+		run  func(req *TrunRequestST) error
+		echo bool
+	}{
+		{"1cloud", TrunRequest, false},
+		{"1cloud-echo", TrunRequest, true},
+		{"2cloud", TrunRequest2Cloud, false},
+		{"2cloud-echo", TrunRequest2Cloud, true},
+	}
+
+	for _, c := range cases {
+		req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+		req.Peers = hub
+		req.Echo = c.echo
+
+		results := collect(req, c.run)
+		cancel()
+
+		t.Logf("%s %v", c.name, results)
+		if results.Recv() < 10 || len(results.ErrCodes()) != 0 {
+			t.Fatalf("%s not delivered:%v", c.name, results)
+		}
+		if c.echo && results.Recv() < results.Sent()*9/10 {
+			t.Fatalf("%s not echoed:%v", c.name, results)
+		}
+	}
+}
+
+func TestNoRemotePeer(t *testing.T) {
+	server := startTestServer(t)
+
+	f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevelWarn}
+	hub, err := ListenPeers(&PeerHubConfig{Addr: "127.0.0.1:0", Token: testPeerToken, Log: f.NewLogger("hub")})
+	if err != nil {
+		t.Fatalf("ListenPeers error:%v", err)
+	}
+	defer hub.Close()
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+	defer cancel()
+	req.Peers = hub
+
+	results := collect(req, TrunRequest)
+	if results.ErrCodes()[105] == 0 || results.Recv() != 0 {
+		t.Fatalf("unexpected results without peers:%v", results)
+	}
+}
+
+func TestRemotePeerTls(t *testing.T) {
+	server := startTestServer(t)
+	hub := startPeers(t, true)
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+	req.Peers = hub
+	req.Echo = true
+
+	results := collect(req, TrunRequest)
+	cancel()
+	if results.Recv() < results.Sent()*9/10 || len(results.ErrCodes()) != 0 {
+		t.Fatalf("not echoed:%v", results)
+	}
+}
+
+// a peer without the token gets no job, nor any credentials
+func TestRemotePeerBadToken(t *testing.T) {
+	f := logging.DefaultLoggerFactory{DefaultLogLevel: logging.LogLevelError}
+	if _, err := ListenPeers(&PeerHubConfig{Addr: "127.0.0.1:0", Log: f.NewLogger("hub")}); err == nil {
+		t.Fatalf("hub without token")
+	}
+
+	hub, err := ListenPeers(&PeerHubConfig{Addr: "127.0.0.1:0", Token: testPeerToken, Log: f.NewLogger("hub")})
+	if err != nil {
+		t.Fatalf("ListenPeers error:%v", err)
+	}
+	defer hub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	err = RunPeer(ctx, &PeerConfig{Tester: hub.Addr().String(), Token: "wrong", Log: f.NewLogger("peer")})
+	if err == nil || !strings.Contains(err.Error(), "bad token") || hub.Count() != 0 {
+		t.Fatalf("peer with a bad token registered:%v", err)
+	}
+}
+
+// a START sent again, e.g. by a retrying tester, changes nothing
+func TestPeerTaskStartTwice(t *testing.T) {
+	task := newPeerTask(context.Background(), &PeerConfig{}, nil, 1, &peerJob{})
+	defer task.cancel()
+
+	task.start()
+	task.start()
+
+	select {
+	case <-task.started:
+	default:
+		t.Fatalf("task not started")
+	}
+}
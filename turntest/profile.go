@@ -0,0 +1,168 @@
+package turntest
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+type TrafficProfile int32
+
+const (
+	PROFILE_FIXED  TrafficProfile = 0 // PackageSize packages paced by PackageWait, Bitrate or PacketRate
+	PROFILE_AUDIO  TrafficProfile = 1 // Opus like, a small package each 20ms
+	PROFILE_VIDEO  TrafficProfile = 2 // 30 fps of variable frames with a keyframe burst every 2 seconds
+	PROFILE_SCREEN TrafficProfile = 3 // 5 fps of tiny frames with large bursts when the content changes
+
+	maxMediaPackageSize = 1200 // frames are split into packages of at most this size, like RTP over a 1280 MTU
+	framePacingFactor   = 3    // packages of a frame are paced at this times the bitrate, like the WebRTC pacer
+
+	audioFrameTime      = time.Millisecond * 20
+	audioDefaultBitrate = 32000
+
+	videoFps            = 30
+	videoGop            = 60 // frames from keyframe to keyframe
+	videoKeyframeRatio  = 8  // keyframe size to average delta frame size
+	videoDefaultBitrate = 1500000
+
+	screenFps            = 5
+	screenChangeRate     = 0.1  // share of frames with changed content
+	screenStaticRatio    = 0.05 // static frame size to average frame size
+	screenDefaultBitrate = 500000
+)
+
+var profileNames = map[TrafficProfile]string{
+	PROFILE_FIXED:  "fixed",
+	PROFILE_AUDIO:  "audio",
+	PROFILE_VIDEO:  "video",
+	PROFILE_SCREEN: "screen",
+}
+
+func (p TrafficProfile) String() string {
+	if name, ok := profileNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("profile-%d", int32(p))
+}
+
+// ParseTrafficProfile parses a profile name, "fixed", "audio", "video" or "screen"
+func ParseTrafficProfile(name string) (TrafficProfile, error) {
+	for profile, profileName := range profileNames {
+		if strings.EqualFold(name, profileName) {
+			return profile, nil
+		}
+	}
+	return PROFILE_FIXED, fmt.Errorf("unknown traffic profile %q", name)
+}
+
+// frameSource generates the package sizes of the media frames of a profile
+type frameSource struct {
+	profile  TrafficProfile
+	interval time.Duration // between frames
+	average  float64       // bytes per frame
+	frame    int
+	rand     *rand.Rand
+}
+
+func newFrameSource(req *TrunRequestST) *frameSource {
+	s := &frameSource{
+		profile: req.Profile,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano() + int64(req.ChanId))),
+	}
+
+	switch req.Profile {
+	case PROFILE_AUDIO:
+		s.interval = audioFrameTime
+
+	case PROFILE_VIDEO:
+		s.interval = time.Second / videoFps
+
+	case PROFILE_SCREEN:
+		s.interval = time.Second / screenFps
+	}
+
+	s.average = float64(profileBitrate(req)) / 8 * s.interval.Seconds()
+
+	return s
+}
+
+// profileBitrate is the bits per second of a media profile, req.Bitrate or the default of the profile
+func profileBitrate(req *TrunRequestST) int64 {
+	if req.Bitrate > 0 {
+		return req.Bitrate
+	}
+
+	switch req.Profile {
+	case PROFILE_AUDIO:
+		return audioDefaultBitrate
+	case PROFILE_VIDEO:
+		return videoDefaultBitrate
+	case PROFILE_SCREEN:
+		return screenDefaultBitrate
+	}
+	return 0
+}
+
+// vary returns size changed randomly by up to percent
+func (s *frameSource) vary(size float64, percent float64) float64 {
+	return size * (1 + (s.rand.Float64()*2-1)*percent/100)
+}
+
+// nextFrame returns the package sizes of the next frame
+func (s *frameSource) nextFrame() []int {
+	var size float64
+
+	switch s.profile {
+	case PROFILE_AUDIO:
+		size = s.vary(s.average, 20)
+
+	case PROFILE_VIDEO:
+		delta := s.average * videoGop / (videoGop - 1 + videoKeyframeRatio)
+		if s.frame%videoGop == 0 {
+			size = s.vary(delta*videoKeyframeRatio, 10)
+		} else {
+			size = s.vary(delta, 30)
+		}
+
+	case PROFILE_SCREEN:
+		static := s.average * screenStaticRatio
+		if s.rand.Float64() < screenChangeRate {
+			size = s.vary((s.average-(1-screenChangeRate)*static)/screenChangeRate, 50)
+		} else {
+			size = s.vary(static, 20)
+		}
+	}
+	s.frame++
+
+	return splitFrame(int(size))
+}
+
+// splitFrame splits a frame into packages of at most maxMediaPackageSize and at least minPackageSize
+func splitFrame(size int) []int {
+	if size < minPackageSize {
+		size = minPackageSize
+	}
+
+	count := (size + maxMediaPackageSize - 1) / maxMediaPackageSize
+	packages := make([]int, count)
+	for i := range packages {
+		packages[i] = size / count
+		if i < size%count {
+			packages[i]++
+		}
+		if packages[i] < minPackageSize {
+			packages[i] = minPackageSize
+		}
+	}
+
+	return packages
+}
+
+// maxPackageSize is the largest package req may send
+func maxPackageSize(req *TrunRequestST) int {
+	if req.Profile == PROFILE_FIXED || int(req.PackageSize) > maxMediaPackageSize {
+		return int(req.PackageSize)
+	}
+	return maxMediaPackageSize
+}
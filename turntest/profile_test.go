@@ -0,0 +1,78 @@
+package turntest
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// checkFrames generates ten minutes of frames and checks the average bitrate and the largest frame
+func checkFrames(t *testing.T, req *TrunRequestST, minBurst int) {
+	frames := newFrameSource(req)
+	frames.rand = rand.New(rand.NewSource(1))
+	count := int(time.Minute * 10 / frames.interval)
+
+	bytes := 0
+	maxFrame := 0
+	for i := 0; i < count; i++ {
+		frame := 0
+		for _, size := range frames.nextFrame() {
+			if size < minPackageSize || size > maxMediaPackageSize {
+				t.Fatalf("%v package size %d", req.Profile, size)
+			}
+			frame += size
+		}
+
+		bytes += frame
+		if frame > maxFrame {
+			maxFrame = frame
+		}
+	}
+
+	want := profileBitrate(req)
+	got := int64(bytes) * 8 / 600
+	if got < want*90/100 || got > want*110/100 {
+		t.Fatalf("%v sends %d bps, want %d", req.Profile, got, want)
+	}
+
+	average := bytes / count
+	if maxFrame < average*minBurst {
+		t.Fatalf("%v largest frame %d, average %d", req.Profile, maxFrame, average)
+	}
+}
+
+func TestProfileFrames(t *testing.T) {
+	checkFrames(t, &TrunRequestST{Profile: PROFILE_AUDIO}, 1)
+	checkFrames(t, &TrunRequestST{Profile: PROFILE_VIDEO}, 5)
+	checkFrames(t, &TrunRequestST{Profile: PROFILE_VIDEO, Bitrate: 300000}, 5)
+	checkFrames(t, &TrunRequestST{Profile: PROFILE_SCREEN}, 5)
+}
+
+func TestParseTrafficProfile(t *testing.T) {
+	for profile, name := range profileNames {
+		got, err := ParseTrafficProfile(name)
+		if err != nil || got != profile || profile.String() != name {
+			t.Fatalf("%q parsed to %v %v", name, got, err)
+		}
+	}
+
+	if _, err := ParseTrafficProfile("music"); err == nil {
+		t.Fatalf("unknown profile should fail")
+	}
+}
+
+func TestSplitFrame(t *testing.T) {
+	for _, size := range []int{1, 64, 1200, 1201, 5000} {
+		total := 0
+		for _, n := range splitFrame(size) {
+			if n > maxMediaPackageSize {
+				t.Fatalf("package of %d", n)
+			}
+			total += n
+		}
+
+		if size >= minPackageSize && total != size {
+			t.Fatalf("%d split to %d", size, total)
+		}
+	}
+}
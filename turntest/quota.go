@@ -0,0 +1,185 @@
+package turntest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+)
+
+const (
+	defaultQuotaAllocations = 1000
+	defaultRecoveryTimeout  = time.Second * 10
+
+	// wait between allocations checking whether the capacity came back
+	recoveryRetryWait = time.Millisecond * 500
+)
+
+type QuotaRequestST struct {
+	Ctx             context.Context
+	Log             logging.LeveledLogger
+	TurnServerAddr  string      // TURN server addrees (e.g. "turn.abc.com:3478" or "turns:turn.abc.com:443?transport=tcp")
+	TlsConfig       *tls.Config // optional, for turns: servers
+	Username        string
+	Password        string
+	Credential      CredentialFunc // optional, distinct credentials for each allocation instead of Username/Password, called with its index
+	ClientFamily    AddressFamily  // optional, family of our sockets to the TURN server, IPv4 by default
+	MaxAllocations  int            // optional, allocations made before giving up looking for the limit, 1000 by default
+	RecoveryTimeout time.Duration  // optional, how long an allocation is retried after deallocating all, 10s by default
+}
+
+// QuotaResult is the allocation limit found by DiscoverQuota
+type QuotaResult struct {
+	Allocations int           `json:"allocations"`      // allocations granted before the server refused one
+	Reached     bool          `json:"reached"`          // the server refused one within MaxAllocations
+	Code        int           `json:"code,omitempty"`   // error code of the refusal, 486 for a quota and 508 for capacity
+	Reason      string        `json:"reason,omitempty"` // the connection refused or closed by the server, when not an error response
+	Elapsed     time.Duration `json:"elapsed"`          // from the first allocation until the refusal
+
+	Recovered    bool          `json:"recovered"`              // allocating worked again after deallocating all, only checked when Reached
+	RecoveryTime time.Duration `json:"recoveryTime,omitempty"` // from deallocating all until allocating worked again
+}
+
+// DiscoverQuota allocates from new 5-tuples, with the same credentials or distinct ones by Credential, until the
+// server refuses, then deallocates all and checks that allocating works again. Only 486 and 508 or a TCP/TLS
+// connection the server refuses or closes are a refusal, other failures (401, 438, timeouts...) are errors.
+func DiscoverQuota(req *QuotaRequestST) (*QuotaResult, error) {
+	if req == nil || req.Ctx == nil || req.Log == nil || req.TurnServerAddr == "" {
+		return nil, fmt.Errorf("[DiscoverQuota]Paramters error")
+	}
+
+	max := req.MaxAllocations
+	if max <= 0 {
+		max = defaultQuotaAllocations
+	}
+
+	var clients []*rawClient
+	defer func() {
+		for _, raw := range clients {
+			raw.Close()
+		}
+	}()
+
+	result := &QuotaResult{}
+	start := time.Now()
+	for result.Allocations < max && !result.Reached {
+		if req.Ctx.Err() != nil {
+			return result, req.Ctx.Err()
+		}
+
+		raw, err := dialQuotaClient(req, result.Allocations)
+		if err != nil {
+			if result.Allocations == 0 || !connectionRefused(err) {
+				return result, err
+			}
+			result.Reason = err.Error()
+		} else {
+			res, err := raw.allocate()
+			if err == nil {
+				clients = append(clients, raw)
+				result.Allocations++
+				continue
+			}
+			raw.Close()
+
+			code := errorCodeOf(err)
+			switch {
+			case code == stun.CodeAllocQuotaReached || code == stun.CodeInsufficientCapacity:
+				result.Code = int(code)
+			case raw.reliable && connectionRefused(err):
+				result.Reason = err.Error()
+			default:
+				return result, fmt.Errorf("[DiscoverQuota]allocation %d:%s", result.Allocations+1, outcome(res, err))
+			}
+		}
+
+		result.Reached = true
+		result.Elapsed = time.Since(start)
+		req.Log.Infof("[DiscoverQuota]refused after %d allocations in %v:code %d %s", result.Allocations, result.Elapsed, result.Code, result.Reason)
+	}
+
+	// without a limit there is no capacity to recover
+	if !result.Reached {
+		result.Elapsed = time.Since(start)
+		req.Log.Infof("[DiscoverQuota]no limit within %d allocations", result.Allocations)
+		deallocateAll(req, clients)
+		return result, nil
+	}
+
+	// waiting for each deallocation, so that the server had them all before checking the recovery
+	deallocateAll(req, clients)
+
+	timeout := req.RecoveryTimeout
+	if timeout <= 0 {
+		timeout = defaultRecoveryTimeout
+	}
+
+	freed := time.Now()
+	for time.Since(freed) < timeout && req.Ctx.Err() == nil {
+		raw, err := dialQuotaClient(req, result.Allocations)
+		if err != nil {
+			return result, err
+		}
+
+		_, err = raw.allocate()
+		raw.Close()
+		if err == nil {
+			result.Recovered = true
+			result.RecoveryTime = time.Since(freed)
+			break
+		}
+
+		req.Log.Debugf("[DiscoverQuota]allocate after deallocating error:%s", err)
+		select {
+		case <-req.Ctx.Done():
+		case <-time.After(recoveryRetryWait):
+		}
+	}
+
+	return result, nil
+}
+
+// deallocateAll deallocates the allocations of clients one after the other
+func deallocateAll(req *QuotaRequestST, clients []*rawClient) {
+	for _, raw := range clients {
+		if err := raw.refresh(0); err != nil {
+			req.Log.Warnf("[DiscoverQuota]refresh error:%s", err)
+		}
+	}
+}
+
+// connectionRefused tells if err is a stream the server refused, reset or closed, as it does limiting connections
+func connectionRefused(err error) bool {
+	return errors.Is(err, errRawClientClosed) || errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// dialQuotaClient dials a rawClient with the credentials of the index-th allocation
+func dialQuotaClient(req *QuotaRequestST, index int) (*rawClient, error) {
+	trunReq := &TrunRequestST{
+		Ctx:            req.Ctx,
+		Log:            req.Log,
+		TurnServerAddr: req.TurnServerAddr,
+		TlsConfig:      req.TlsConfig,
+		Username:       req.Username,
+		Password:       req.Password,
+		ClientFamily:   req.ClientFamily,
+	}
+
+	if req.Credential != nil {
+		cred, err := req.Credential(uint64(index))
+		if err != nil {
+			return nil, err
+		}
+		trunReq.Username = cred.Username
+		trunReq.Password = cred.Password
+	}
+
+	return dialRawClient(trunReq)
+}
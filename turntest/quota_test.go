@@ -0,0 +1,85 @@
+package turntest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/xylophone21/go-turn-test/testserver"
+)
+
+func makeQuotaRequestST(server string) (*QuotaRequestST, func()) {
+	req, cancel := makeConformanceRequestST(server)
+
+	return &QuotaRequestST{
+		Ctx:             req.Ctx,
+		Log:             req.Log,
+		TurnServerAddr:  req.TurnServerAddr,
+		Username:        req.Username,
+		Password:        req.Password,
+		MaxAllocations:  10,
+		RecoveryTimeout: time.Second * 2,
+	}, cancel
+}
+
+// the relay limit of the test server is answered by 508, whoever allocates
+func TestDiscoverQuota(t *testing.T) {
+	const maxRelays = 3
+	server := testserver.StartTest(t, &testserver.ServerConfig{
+		Users:      map[string]string{testUsername: testPassword},
+		AuthSecret: testSecret,
+		MaxRelays:  maxRelays,
+	})
+
+	distinct := func(chanId uint64) (*Credential, error) {
+		username, password, expired := GenerateRestCredentials(testSecret, fmt.Sprintf("user%d", chanId), time.Hour)
+		return &Credential{Username: username, Password: password, Expired: expired}, nil
+	}
+
+	for _, credential := range []CredentialFunc{nil, distinct} {
+		req, cancel := makeQuotaRequestST(server.UDPURI())
+		req.Credential = credential
+
+		result, err := DiscoverQuota(req)
+		cancel()
+		if err != nil {
+			t.Fatalf("DiscoverQuota error:%v", err)
+		}
+		t.Logf("%+v", result)
+
+		if !result.Reached || result.Allocations != maxRelays || result.Code != int(stun.CodeInsufficientCapacity) || !result.Recovered {
+			t.Fatalf("unexpected result:%+v", result)
+		}
+	}
+}
+
+func TestDiscoverQuotaUnlimited(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeQuotaRequestST(server.UDPURI())
+	defer cancel()
+
+	result, err := DiscoverQuota(req)
+	if err != nil {
+		t.Fatalf("DiscoverQuota error:%v", err)
+	}
+	if result.Reached || result.Allocations != req.MaxAllocations || result.Recovered {
+		t.Fatalf("unexpected result:%+v", result)
+	}
+}
+
+// refusing the credentials is no limit but an error
+func TestDiscoverQuotaUnauthorized(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeQuotaRequestST(server.UDPURI())
+	defer cancel()
+	req.Password = "wrong"
+
+	result, err := DiscoverQuota(req)
+	if err == nil || result.Reached {
+		t.Fatalf("bad credentials taken for the limit:%+v", result)
+	}
+	t.Logf("DiscoverQuota error:%v", err)
+}
@@ -0,0 +1,729 @@
+package turntest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+)
+
+const (
+	rawMaxTries        = 4
+	rawReadBufferSize  = 65535
+	rawDataChanSize    = 1000
+	rawDefaultLifetime = time.Minute * 10
+	permissionRefresh  = time.Minute * 4
+
+	// STUN/TURN attributes unknown to pion/stun
+	attrAccessToken      stun.AttrType = 0x001B // ACCESS-TOKEN (RFC 7635)
+	attrThirdPartyAuth   stun.AttrType = 0x802E // THIRD-PARTY-AUTHORIZATION (RFC 7635)
+	attrAdditionalFamily stun.AttrType = 0x8000 // ADDITIONAL-ADDRESS-FAMILY (RFC 8656)
+	attrAddressErrorCode stun.AttrType = 0x8001 // ADDRESS-ERROR-CODE (RFC 8656)
+	protoTCP                           = 6
+	protoUDP                           = 17
+	minChannelNumber                   = 0x4000
+	maxChannelNumber                   = 0x7FFF
+)
+
+var (
+	errRawClientClosed = errors.New("raw client closed")
+	errRawTimeout      = errors.New("transaction timeout")
+	errNoRelayedAddr   = errors.New("no XOR-RELAYED-ADDRESS in response")
+)
+
+// turnError is an error response got from the TURN server
+type turnError struct {
+	Method stun.Method
+	Code   stun.ErrorCode
+	Reason string
+}
+
+func (e *turnError) Error() string {
+	return fmt.Sprintf("%s error %d %s", e.Method, e.Code, e.Reason)
+}
+
+// responseError returns a *turnError if res is an error response, or nil
+func responseError(res *stun.Message) error {
+	if res.Type.Class != stun.ClassErrorResponse {
+		return nil
+	}
+
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err != nil {
+		return &turnError{Method: res.Type.Method}
+	}
+
+	return &turnError{Method: res.Type.Method, Code: code.Code, Reason: string(code.Reason)}
+}
+
+// errorCodeOf returns the STUN error code carried by err, or 0
+func errorCodeOf(err error) stun.ErrorCode {
+	var tErr *turnError
+	if errors.As(err, &tErr) {
+		return tErr.Code
+	}
+	return 0
+}
+
+// xorAddrAttr sets a XOR address attribute (XOR-PEER-ADDRESS, ...) of type Type
+type xorAddrAttr struct {
+	Type stun.AttrType
+	Addr *net.UDPAddr
+}
+
+func (a xorAddrAttr) AddTo(m *stun.Message) error {
+	return stun.XORMappedAddress{IP: a.Addr.IP, Port: a.Addr.Port}.AddToAs(m, a.Type)
+}
+
+// xorAddrsFrom returns all the XOR address attributes of type t in m, in order
+func xorAddrsFrom(m *stun.Message, t stun.AttrType) []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	for _, attr := range m.Attributes {
+		if attr.Type != t {
+			continue
+		}
+
+		single := &stun.Message{TransactionID: m.TransactionID}
+		single.Add(t, attr.Value)
+
+		var addr stun.XORMappedAddress
+		if err := addr.GetFromAs(single, t); err != nil {
+			continue
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+	}
+	return addrs
+}
+
+func requestedTransportAttr(protocol byte) stun.RawAttribute {
+	return stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{protocol, 0, 0, 0}}
+}
+
+func lifetimeAttr(lifetime time.Duration) stun.RawAttribute {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(lifetime.Seconds()))
+	return stun.RawAttribute{Type: stun.AttrLifetime, Value: v}
+}
+
+func channelNumberAttr(number uint16) stun.RawAttribute {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v, number)
+	return stun.RawAttribute{Type: stun.AttrChannelNumber, Value: v}
+}
+
+type rawData struct {
+	data []byte
+	from net.Addr
+}
+
+// rawClient is a minimal TURN client speaking STUN directly over conn. It is used
+// where pion/turn's client can't carry the attributes we need (ACCESS-TOKEN,
+// address families, EVEN-PORT...) or we want to see the server's raw responses.
+type rawClient struct {
+	conn     net.PacketConn
+	server   net.Addr
+	rto      time.Duration
+	reliable bool // over TCP/TLS, no retransmission
+	log      logging.LeveledLogger
+
+	username  stun.Username
+	password  string
+	realm     stun.Realm
+	nonce     stun.Nonce
+	integrity stun.MessageIntegrity
+	authAttrs []stun.Setter // added to each authenticated request, e.g. ACCESS-TOKEN
+
+	lock         sync.Mutex
+	transactions map[[stun.TransactionIDSize]byte]chan *stun.Message
+	permissions  map[string]*net.UDPAddr
+	channels     map[string]uint16
+	peers        map[uint16]net.Addr
+	nextChannel  uint16
+	relayed      []*net.UDPAddr
+	mapped       *net.UDPAddr
+	lifetime     time.Duration
+
+	// called when keeping the allocation alive fails
+	onRefreshError func(err error)
+
+	data      chan rawData
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newRawClient starts reading on conn; closing the client closes conn
+func newRawClient(conn net.PacketConn, server net.Addr, username string, password string, log logging.LeveledLogger) *rawClient {
+	c := &rawClient{
+		conn:         conn,
+		server:       server,
+		rto:          time.Second,
+		log:          log,
+		username:     stun.NewUsername(username),
+		password:     password,
+		transactions: make(map[[stun.TransactionIDSize]byte]chan *stun.Message),
+		permissions:  make(map[string]*net.UDPAddr),
+		channels:     make(map[string]uint16),
+		peers:        make(map[uint16]net.Addr),
+		nextChannel:  minChannelNumber,
+		data:         make(chan rawData, rawDataChanSize),
+		closed:       make(chan struct{}),
+	}
+
+	go c.readLoop()
+
+	return c
+}
+
+// setAccessToken makes the client authenticate with a RFC 7635 access token instead of a password
+func (c *rawClient) setAccessToken(kid string, macKey []byte, token []byte) {
+	c.username = stun.NewUsername(kid)
+	c.password = ""
+	c.integrity = stun.MessageIntegrity(macKey)
+	c.authAttrs = []stun.Setter{stun.RawAttribute{Type: attrAccessToken, Value: token}}
+}
+
+func (c *rawClient) readLoop() {
+	buf := make([]byte, rawReadBufferSize)
+	for {
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.log.Debugf("[rawClient]exiting read loop:%s", err)
+			c.Close()
+			return
+		}
+
+		if stun.IsMessage(buf[:n]) {
+			msg := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if err := msg.Decode(); err != nil {
+				c.log.Debugf("[rawClient]msg.Decode error:%s", err)
+				continue
+			}
+			c.handleMessage(msg, from)
+			continue
+		}
+
+		if n >= 4 && buf[0]&0xC0 == 0x40 {
+			number := binary.BigEndian.Uint16(buf[0:])
+			length := int(binary.BigEndian.Uint16(buf[2:]))
+			if length > n-4 {
+				continue
+			}
+
+			c.lock.Lock()
+			peer, ok := c.peers[number]
+			c.lock.Unlock()
+			if ok {
+				c.pushData(append([]byte{}, buf[4:4+length]...), peer)
+			}
+		}
+	}
+}
+
+func (c *rawClient) handleMessage(msg *stun.Message, from net.Addr) {
+	if msg.Type == stun.NewType(stun.MethodData, stun.ClassIndication) {
+		peers := xorAddrsFrom(msg, stun.AttrXORPeerAddress)
+		data, err := msg.Get(stun.AttrData)
+		if len(peers) == 0 || err != nil {
+			c.log.Debugf("[rawClient]bad data indication from %s", from)
+			return
+		}
+		c.pushData(data, peers[0])
+		return
+	}
+
+	if msg.Type.Class != stun.ClassSuccessResponse && msg.Type.Class != stun.ClassErrorResponse {
+		return
+	}
+
+	c.lock.Lock()
+	ch, ok := c.transactions[msg.TransactionID]
+	c.lock.Unlock()
+	if ok {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func (c *rawClient) pushData(data []byte, from net.Addr) {
+	select {
+	case c.data <- rawData{data: data, from: from}:
+	default:
+		c.log.Debugf("[rawClient]data chan full, drop %d bytes from %s", len(data), from)
+	}
+}
+
+// track registers the transaction of msg, the returned func ends it
+func (c *rawClient) track(msg *stun.Message) (chan *stun.Message, func()) {
+	ch := make(chan *stun.Message, 1)
+
+	c.lock.Lock()
+	c.transactions[msg.TransactionID] = ch
+	c.lock.Unlock()
+
+	return ch, func() {
+		c.lock.Lock()
+		delete(c.transactions, msg.TransactionID)
+		c.lock.Unlock()
+	}
+}
+
+// perform sends msg and waits for its response, retransmitting with doubled RTO unless reliable
+func (c *rawClient) perform(msg *stun.Message) (*stun.Message, error) {
+	ch, done := c.track(msg)
+	defer done()
+
+	rto := c.rto
+	for i := 0; i < rawMaxTries; i++ {
+		if i == 0 || !c.reliable {
+			if _, err := c.conn.WriteTo(msg.Raw, c.server); err != nil {
+				return nil, err
+			}
+		}
+
+		select {
+		case res := <-ch:
+			return res, nil
+
+		case <-c.closed:
+			return nil, errRawClientClosed
+
+		case <-time.After(rto):
+			rto *= 2
+		}
+	}
+
+	return nil, errRawTimeout
+}
+
+// performOnce sends msg.Raw once and waits up to timeout for the response to its transaction,
+// for crafted messages the server may well drop
+func (c *rawClient) performOnce(msg *stun.Message, timeout time.Duration) (*stun.Message, error) {
+	ch, done := c.track(msg)
+	defer done()
+
+	if _, err := c.conn.WriteTo(msg.Raw, c.server); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		return res, nil
+
+	case <-c.closed:
+		return nil, errRawClientClosed
+
+	case <-time.After(timeout):
+		return nil, errRawTimeout
+	}
+}
+
+// authSetters returns the attributes authenticating a request, none before the server sent a nonce
+func (c *rawClient) authSetters() []stun.Setter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.nonce) == 0 {
+		return nil
+	}
+
+	setters := []stun.Setter{c.username, c.realm, c.nonce}
+	setters = append(setters, c.authAttrs...)
+	return append(setters, c.integrity)
+}
+
+// learnNonce keeps the realm and nonce of a 401/438 response
+func (c *rawClient) learnNonce(res *stun.Message) error {
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(res); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var realm stun.Realm
+	if err := realm.GetFrom(res); err == nil {
+		c.realm = realm
+	}
+	c.nonce = nonce
+
+	if c.password != "" {
+		c.integrity = stun.NewLongTermIntegrity(c.username.String(), c.realm.String(), c.password)
+	}
+
+	return nil
+}
+
+// requestOnce sends a request authenticated by the nonce known so far, if any, and returns its response
+func (c *rawClient) requestOnce(method stun.Method, attrs ...stun.Setter) (*stun.Message, error) {
+	setters := []stun.Setter{stun.TransactionID, stun.NewType(method, stun.ClassRequest)}
+	setters = append(setters, attrs...)
+	setters = append(setters, c.authSetters()...)
+	setters = append(setters, stun.Fingerprint)
+
+	msg, err := stun.Build(setters...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.perform(msg)
+}
+
+// request sends an authenticated request, learning nonce and realm when challenged,
+// and returns the final response which may be an error response
+func (c *rawClient) request(method stun.Method, attrs ...stun.Setter) (*stun.Message, error) {
+	var res *stun.Message
+	for try := 0; try < 2; try++ {
+		hadNonce := len(c.authSetters()) > 0
+
+		var err error
+		res, err = c.requestOnce(method, attrs...)
+		if err != nil {
+			return nil, err
+		}
+
+		code := errorCodeOf(responseError(res))
+		if code != stun.CodeStaleNonce && (code != stun.CodeUnauthorized || hadNonce) {
+			return res, nil
+		}
+
+		if err = c.learnNonce(res); err != nil {
+			return res, nil
+		}
+	}
+
+	return res, nil
+}
+
+// allocate sends an Allocate request with REQUESTED-TRANSPORT UDP and extra attrs,
+// keeping the relayed addresses of the response
+func (c *rawClient) allocate(attrs ...stun.Setter) (*stun.Message, error) {
+	attrs = append([]stun.Setter{requestedTransportAttr(protoUDP)}, attrs...)
+	res, err := c.request(stun.MethodAllocate, attrs...)
+	if err != nil {
+		return nil, err
+	}
+	if err = responseError(res); err != nil {
+		return res, err
+	}
+
+	relayed := xorAddrsFrom(res, stun.AttrXORRelayedAddress)
+	if len(relayed) == 0 {
+		return res, errNoRelayedAddr
+	}
+
+	lifetime := lifetimeFrom(res)
+
+	var mapped stun.XORMappedAddress
+	c.lock.Lock()
+	c.relayed = relayed
+	c.lifetime = lifetime
+	if mapped.GetFrom(res) == nil {
+		c.mapped = &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}
+	}
+	c.lock.Unlock()
+
+	go c.keepAlive()
+
+	return res, nil
+}
+
+// lifetimeFrom returns the LIFETIME of res, the default lifetime without one
+func lifetimeFrom(res *stun.Message) time.Duration {
+	if v, err := res.Get(stun.AttrLifetime); err == nil && len(v) == 4 && binary.BigEndian.Uint32(v) > 0 {
+		return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return rawDefaultLifetime
+}
+
+// keepAlive refreshes the allocation and permissions until the client is closed
+func (c *rawClient) keepAlive() {
+	c.lock.Lock()
+	lifetime := c.lifetime
+	c.lock.Unlock()
+
+	refreshTicker := time.NewTicker(lifetime / 2)
+	defer refreshTicker.Stop()
+	permissionTicker := time.NewTicker(permissionRefresh)
+	defer permissionTicker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-c.closed:
+			return
+
+		case <-refreshTicker.C:
+			err = c.refresh(lifetime)
+
+		case <-permissionTicker.C:
+			err = c.refreshPermissions()
+		}
+
+		if err != nil {
+			c.log.Warnf("[rawClient]keep alive error:%s", err)
+			if c.onRefreshError != nil {
+				c.onRefreshError(err)
+			}
+		}
+	}
+}
+
+// refresh sends a Refresh request, lifetime 0 deletes the allocation
+func (c *rawClient) refresh(lifetime time.Duration) error {
+	res, err := c.request(stun.MethodRefresh, lifetimeAttr(lifetime))
+	if err != nil {
+		return err
+	}
+	return responseError(res)
+}
+
+func (c *rawClient) refreshPermissions() error {
+	c.lock.Lock()
+	peers := make([]*net.UDPAddr, 0, len(c.permissions))
+	for _, peer := range c.permissions {
+		peers = append(peers, peer)
+	}
+	c.lock.Unlock()
+
+	if len(peers) == 0 {
+		return nil
+	}
+	return c.createPermission(peers...)
+}
+
+// createPermission installs permissions for the IPs of peers
+func (c *rawClient) createPermission(peers ...*net.UDPAddr) error {
+	attrs := make([]stun.Setter, 0, len(peers))
+	for _, peer := range peers {
+		attrs = append(attrs, xorAddrAttr{Type: stun.AttrXORPeerAddress, Addr: peer})
+	}
+
+	res, err := c.request(stun.MethodCreatePermission, attrs...)
+	if err != nil {
+		return err
+	}
+	if err = responseError(res); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	for _, peer := range peers {
+		c.permissions[peer.IP.String()] = peer
+	}
+	c.lock.Unlock()
+
+	return nil
+}
+
+// channelBind binds the next free channel number to peer
+func (c *rawClient) channelBind(peer *net.UDPAddr) (uint16, error) {
+	c.lock.Lock()
+	number := c.nextChannel
+	c.nextChannel++
+	c.lock.Unlock()
+
+	if number > maxChannelNumber {
+		return 0, fmt.Errorf("no free channel number")
+	}
+
+	res, err := c.request(stun.MethodChannelBind, channelNumberAttr(number), xorAddrAttr{Type: stun.AttrXORPeerAddress, Addr: peer})
+	if err != nil {
+		return 0, err
+	}
+	if err = responseError(res); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	c.channels[peer.String()] = number
+	c.peers[number] = peer
+	c.permissions[peer.IP.String()] = peer
+	c.lock.Unlock()
+
+	return number, nil
+}
+
+// hasPermission tells if a permission for the IP of peer was installed
+func (c *rawClient) hasPermission(peer *net.UDPAddr) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.permissions[peer.IP.String()]
+	return ok
+}
+
+// send relays data to peer, by ChannelData if a channel is bound or else a Send indication
+func (c *rawClient) send(data []byte, peer *net.UDPAddr) error {
+	c.lock.Lock()
+	number, ok := c.channels[peer.String()]
+	c.lock.Unlock()
+
+	if ok {
+		padded := (len(data) + 3) &^ 3
+		buf := make([]byte, 4+padded)
+		binary.BigEndian.PutUint16(buf[0:], number)
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(data)))
+		copy(buf[4:], data)
+		_, err := c.conn.WriteTo(buf, c.server)
+		return err
+	}
+
+	msg, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodSend, stun.ClassIndication),
+		xorAddrAttr{Type: stun.AttrXORPeerAddress, Addr: peer},
+		stun.RawAttribute{Type: stun.AttrData, Value: data},
+		stun.Fingerprint)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conn.WriteTo(msg.Raw, c.server)
+	return err
+}
+
+// binding sends a Binding request to the server and returns our mapped address
+func (c *rawClient) binding() (*net.UDPAddr, error) {
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.perform(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err = responseError(res); err != nil {
+		return nil, err
+	}
+
+	var mapped stun.XORMappedAddress
+	if err = mapped.GetFrom(res); err != nil {
+		return nil, err
+	}
+
+	return &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}, nil
+}
+
+// relayedAddrs returns the relayed addresses of the allocation
+func (c *rawClient) relayedAddrs() []*net.UDPAddr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.relayed
+}
+
+// Close deletes the allocation (best effort, without waiting) and closes the conn
+func (c *rawClient) Close() error {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		allocated := len(c.relayed) > 0
+		c.lock.Unlock()
+
+		if allocated {
+			setters := []stun.Setter{stun.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassRequest), lifetimeAttr(0)}
+			setters = append(setters, c.authSetters()...)
+			setters = append(setters, stun.Fingerprint)
+			if msg, err := stun.Build(setters...); err == nil {
+				c.conn.WriteTo(msg.Raw, c.server)
+			}
+		}
+
+		close(c.closed)
+		c.conn.Close()
+	})
+
+	return nil
+}
+
+// rawRelayConn is the net.PacketConn of a relayed address allocated by a rawClient,
+// permissions are created on the first write to each peer IP
+type rawRelayConn struct {
+	client  *rawClient
+	relayed *net.UDPAddr
+
+	lock         sync.Mutex
+	readDeadline time.Time
+}
+
+func newRawRelayConn(client *rawClient, relayed *net.UDPAddr) *rawRelayConn {
+	return &rawRelayConn{
+		client:  client,
+		relayed: relayed,
+	}
+}
+
+func (r *rawRelayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	r.lock.Lock()
+	deadline := r.readDeadline
+	r.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case d := <-r.client.data:
+		return copy(p, d.data), d.from, nil
+
+	case <-r.client.closed:
+		return 0, nil, errRawClientClosed
+
+	case <-timeout:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: r.relayed, Err: errRawTimeout}
+	}
+}
+
+func (r *rawRelayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	peer, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		peer, err = net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if !r.client.hasPermission(peer) {
+		if err := r.client.createPermission(peer); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := r.client.send(p, peer); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *rawRelayConn) Close() error {
+	return r.client.Close()
+}
+
+func (r *rawRelayConn) LocalAddr() net.Addr {
+	return r.relayed
+}
+
+func (r *rawRelayConn) SetDeadline(t time.Time) error {
+	return r.SetReadDeadline(t)
+}
+
+func (r *rawRelayConn) SetReadDeadline(t time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.readDeadline = t
+	return nil
+}
+
+func (r *rawRelayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,51 @@
+package turntest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// Credential is what a CredentialFunc hands out for the next allocation
+type Credential struct {
+	TurnServerAddr string // server the credentials are for, empty keeps the current one
+	Username       string
+	Password       string
+	Expired        time.Time // when the server stops accepting them, zero means never
+}
+
+// CredentialFunc returns the credentials for the next allocation of channel chanId.
+type CredentialFunc func(chanId uint64) (*Credential, error)
+
+// GenerateRestCredentials makes time-limited credentials of the TURN REST API
+// (coturn "use-auth-secret"): username is "expiry-timestamp:user" and password
+// is base64(HMAC-SHA1(secret, username)).
+func GenerateRestCredentials(secret string, user string, ttl time.Duration) (string, string, time.Time) {
+	expired := time.Now().Add(ttl)
+
+	username := fmt.Sprintf("%d", expired.Unix())
+	if user != "" {
+		username = fmt.Sprintf("%s:%s", username, user)
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	password := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return username, password, expired
+}
+
+// RestCredential returns a CredentialFunc minting a fresh TURN REST API username/password
+// for each channel every time it is called.
+func RestCredential(secret string, user string, ttl time.Duration) CredentialFunc {
+	return func(chanId uint64) (*Credential, error) {
+		if secret == "" || ttl <= 0 {
+			return nil, fmt.Errorf("[RestCredential-%d]secret or ttl error", chanId)
+		}
+
+		username, password, expired := GenerateRestCredentials(secret, user, ttl)
+		return &Credential{Username: username, Password: password, Expired: expired}, nil
+	}
+}
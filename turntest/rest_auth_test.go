@@ -0,0 +1,105 @@
+package turntest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/xylophone21/go-turn-test/statistics"
+)
+
+func TestRestCredentials(t *testing.T) {
+	username, password, expired := GenerateRestCredentials("secret", "alice", time.Hour)
+
+	parts := strings.SplitN(username, ":", 2)
+	if len(parts) != 2 || parts[1] != "alice" {
+		t.Fatalf("username error:%s", username)
+	}
+
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || ts != expired.Unix() {
+		t.Fatalf("timestamp error:%s", username)
+	}
+
+	if time.Until(expired) < time.Minute*59 {
+		t.Fatalf("expired error:%v", expired)
+	}
+
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(username))
+	if password != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("password error:%s", password)
+	}
+
+	cred, err := RestCredential("secret", "", time.Hour)(1)
+	if err != nil || strings.Contains(cred.Username, ":") {
+		t.Fatalf("RestCredential error:%v %v", err, cred)
+	}
+}
+
+func TestRenewCredential(t *testing.T) {
+	f := logging.DefaultLoggerFactory{
+		DefaultLogLevel: logging.LogLevelTrace,
+	}
+
+	calls := 0
+	req := &TrunRequestST{
+		Log:            f.NewLogger("turn-test"),
+		TurnServerAddr: "old:3478",
+		Ch:             make(chan statistics.RequestResults, 10),
+		Credential: func(chanId uint64) (*Credential, error) {
+			calls++
+			return &Credential{
+				TurnServerAddr: "new:3478",
+				Username:       fmt.Sprintf("user%d", calls),
+				Password:       "pass",
+				Expired:        time.Now().Add(time.Second * 2),
+			}, nil
+		},
+	}
+
+	// first credentials, not a rotation
+	renewCredential(req)
+	if req.Username != "user1" || req.TurnServerAddr != "new:3478" || len(req.Ch) != 0 {
+		t.Fatalf("first renew error:%v", req)
+	}
+
+	// expiring within credentialRenewAhead, rotated
+	renewCredential(req)
+	if req.Username != "user2" || len(req.Ch) != 1 || !(<-req.Ch).IsRotated {
+		t.Fatalf("rotate error:%v", req)
+	}
+
+	req.Expired = time.Now().Add(time.Hour)
+	renewCredential(req)
+	if calls != 2 {
+		t.Fatalf("renewed before expiry")
+	}
+}
+
+func TestRotationMidStream(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), "", "")
+	defer cancel()
+
+	// each allocation runs about 0.5s before its credentials are rotated
+	rotations := 0
+	req.Credential = func(chanId uint64) (*Credential, error) {
+		rotations++
+		return &Credential{Username: testUsername, Password: testPassword, Expired: time.Now().Add(credentialRenewAhead + time.Millisecond*500)}, nil
+	}
+
+	// the packages in flight at rotation arrive, and closing the old allocation is no error
+	results := collect(req, TrunRequest)
+	t.Logf("rotations:%d %v", rotations, results)
+	if rotations < 2 || results.Sent() < 10 || results.Recv() < results.Sent()-1 || len(results.ErrCodes()) != 0 {
+		t.Fatalf("rotation disturbed the stream, rotations:%d %v", rotations, results)
+	}
+}
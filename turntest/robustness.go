@@ -0,0 +1,332 @@
+package turntest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// crafted messages sent by CheckRobustness, each must be rejected by an error response or dropped
+	CHECK_BAD_INTEGRITY       = "bad-integrity"       // Allocate with a MESSAGE-INTEGRITY not matching the message
+	CHECK_TRUNCATED           = "truncated"           // message shorter than its header length
+	CHECK_MALFORMED           = "malformed"           // header length not a multiple of 4, garbage attributes
+	CHECK_OVERSIZED_ATTRIBUTE = "oversized-attribute" // attribute running past the message, USERNAME over 513 bytes
+	CHECK_LOOPBACK_PEER       = "loopback-peer"       // CreatePermission for loopback peers, 403 expected
+	CHECK_PRIVATE_PEER        = "private-peer"        // CreatePermission for private and link-local peers, 403 expected
+	CHECK_QUOTA               = "quota"               // allocations of one user until 486
+
+	defaultMaxAllocations = 100
+
+	stunHeaderSize = 20
+
+	// USERNAME is less than 513 bytes (RFC 8489 section 14.3)
+	oversizedUsernameSize = 1024
+
+	// how long the server has to answer the Binding request after each check
+	responsiveTimeout = time.Second * 3
+)
+
+var robustnessChecks = []conformanceCheck{
+	robust(CHECK_BAD_INTEGRITY, checkBadIntegrity),
+	robust(CHECK_TRUNCATED, checkTruncated),
+	robust(CHECK_MALFORMED, checkMalformed),
+	robust(CHECK_OVERSIZED_ATTRIBUTE, checkOversizedAttribute),
+	robust(CHECK_LOOPBACK_PEER, checkLoopbackPeer),
+	robust(CHECK_PRIVATE_PEER, checkPrivatePeer),
+	robust(CHECK_QUOTA, checkQuota),
+}
+
+// reserved peer addresses servers we own should not relay to, by family
+var (
+	loopbackPeers = map[AddressFamily][]string{
+		FAMILY_IPV4: {"127.0.0.1", "127.1.2.3"},
+		FAMILY_IPV6: {"::1"},
+	}
+	privatePeers = map[AddressFamily][]string{
+		FAMILY_IPV4: {"10.0.0.1", "172.16.0.1", "192.168.0.1", "169.254.169.254"},
+		FAMILY_IPV6: {"fc00::1", "fe80::1"},
+	}
+)
+
+// CheckRobustness sends crafted and abusive requests to a TURN server we own, reporting whether each
+// was rejected and the server still answered afterwards. names select the checks, all of them when empty
+func CheckRobustness(req *ConformanceRequestST, names ...string) ([]CheckResult, error) {
+	if req == nil || req.Ctx == nil || req.Log == nil || req.TurnServerAddr == "" {
+		return nil, fmt.Errorf("[CheckRobustness]Paramters error")
+	}
+
+	return runChecks(req, "CheckRobustness", robustnessChecks, names)
+}
+
+// RobustnessCheckNames returns the names of all the robustness checks in the order they run
+func RobustnessCheckNames() []string {
+	return catalogNames(robustnessChecks)
+}
+
+// robust is single also probing whether the server answers after the check, failing it when not
+func robust(name string, run func(req *ConformanceRequestST, result *CheckResult)) conformanceCheck {
+	check := single(name, run)
+	return conformanceCheck{
+		names: check.names,
+		run: func(req *ConformanceRequestST) []CheckResult {
+			results := check.run(req)
+
+			responsive := isResponsive(req)
+			for i := range results {
+				results[i].Responsive = &responsive
+				if !responsive {
+					results[i].Status = CHECK_FAIL
+					results[i].Detail = strings.TrimPrefix(results[i].Detail+", no answer afterwards", ", ")
+				}
+			}
+			return results
+		},
+	}
+}
+
+// isResponsive tells whether the server answers a Binding request from a new 5-tuple
+func isResponsive(req *ConformanceRequestST) bool {
+	raw, err := dialRawClient(req.trunRequest())
+	if err != nil {
+		req.Log.Warnf("[isResponsive]dialRawClient error:%s", err)
+		return false
+	}
+	defer raw.Close()
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		return false
+	}
+
+	res, err := raw.performOnce(msg, responsiveTimeout)
+	return err == nil && responseError(res) == nil
+}
+
+// crafted is a crafted message and what it is
+type crafted struct {
+	name string
+	msg  *stun.Message
+}
+
+// expectRejected sends each message once from its own 5-tuple, as a broken message may break a stream,
+// and passes result when none got a success response
+func expectRejected(req *ConformanceRequestST, result *CheckResult, messages []crafted) {
+	var details, accepted []string
+	for _, m := range messages {
+		raw := dialCheckClient(req, result)
+		if raw == nil {
+			return
+		}
+
+		res, err := raw.performOnce(m.msg, checkReadTimeout)
+		raw.Close()
+
+		switch {
+		case res == nil:
+			details = append(details, m.name+":dropped")
+		case responseError(res) != nil:
+			details = append(details, fmt.Sprintf("%s:%d", m.name, errorCodeOf(responseError(res))))
+		default:
+			accepted = append(accepted, m.name)
+		}
+		req.Log.Debugf("[expectRejected]%s %s", m.name, outcome(res, err))
+	}
+
+	if len(accepted) > 0 {
+		result.Detail = "accepted " + strings.Join(accepted, ", ")
+		return
+	}
+	result.Status = CHECK_PASS
+	result.Detail = strings.Join(details, ", ")
+}
+
+// bindingRequest builds a Binding request with a SOFTWARE attribute first, to be spoiled
+func bindingRequest() (*stun.Message, error) {
+	return stun.Build(stun.TransactionID, stun.BindingRequest, stun.NewSoftware("go-turn-test"), stun.Fingerprint)
+}
+
+func checkBadIntegrity(req *ConformanceRequestST, result *CheckResult) {
+	raw := challengedCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	// MESSAGE-INTEGRITY last so that no FINGERPRINT gives the tampering away
+	setters := []stun.Setter{stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest), requestedTransportAttr(protoUDP)}
+	msg, err := stun.Build(append(setters, raw.authSetters()...)...)
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("stun.Build error:%v", err)
+		return
+	}
+	msg.Raw[len(msg.Raw)-1] ^= 0xFF
+
+	res, err := raw.performOnce(msg, checkReadTimeout)
+	if res != nil && responseError(res) == nil {
+		raw.refresh(0)
+		result.Detail = "allocated with a tampered MESSAGE-INTEGRITY"
+		return
+	}
+
+	result.Status = CHECK_PASS
+	result.Detail = outcome(res, err)
+}
+
+func checkTruncated(req *ConformanceRequestST, result *CheckResult) {
+	var messages []crafted
+	for _, cut := range []int{4, 8, 20} {
+		msg, err := bindingRequest()
+		if err != nil {
+			result.Status = CHECK_SKIP
+			result.Detail = fmt.Sprintf("stun.Build error:%v", err)
+			return
+		}
+
+		// the header still claims the full length
+		msg.Raw = msg.Raw[:len(msg.Raw)-cut]
+		messages = append(messages, crafted{name: fmt.Sprintf("%d bytes short", cut), msg: msg})
+	}
+
+	expectRejected(req, result, messages)
+}
+
+func checkMalformed(req *ConformanceRequestST, result *CheckResult) {
+	unaligned, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("stun.Build error:%v", err)
+		return
+	}
+	unaligned.Raw = append(unaligned.Raw, 0xFF, 0xFF, 0xFF)
+	binary.BigEndian.PutUint16(unaligned.Raw[2:], 3)
+
+	garbage, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("stun.Build error:%v", err)
+		return
+	}
+	garbage.Raw = append(garbage.Raw, 0x00, 0x06, 0x00, 0x03, 0xFF, 0xFF, 0xFF, 0xFF, 0x80, 0x28, 0x00, 0x01)
+	binary.BigEndian.PutUint16(garbage.Raw[2:], 12)
+
+	expectRejected(req, result, []crafted{{name: "unaligned length", msg: unaligned}, {name: "garbage attributes", msg: garbage}})
+}
+
+func checkOversizedAttribute(req *ConformanceRequestST, result *CheckResult) {
+	overrun, err := bindingRequest()
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("stun.Build error:%v", err)
+		return
+	}
+
+	// SOFTWARE is the first attribute, its length now runs past the end of the message
+	binary.BigEndian.PutUint16(overrun.Raw[stunHeaderSize+2:], 0x0400)
+	messages := []crafted{{name: "attribute past the end", msg: overrun}}
+
+	raw := challengedCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	raw.lock.Lock()
+	realm, nonce := raw.realm, raw.nonce
+	raw.lock.Unlock()
+	raw.Close()
+
+	// raw as stun.Username refuses to get that long
+	username := strings.Repeat("u", oversizedUsernameSize)
+	long, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest), requestedTransportAttr(protoUDP),
+		stun.RawAttribute{Type: stun.AttrUsername, Value: []byte(username)}, realm, nonce, stun.NewLongTermIntegrity(username, realm.String(), req.Password), stun.Fingerprint)
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("stun.Build error:%v", err)
+		return
+	}
+	messages = append(messages, crafted{name: fmt.Sprintf("%d bytes USERNAME", oversizedUsernameSize), msg: long})
+
+	expectRejected(req, result, messages)
+}
+
+func checkLoopbackPeer(req *ConformanceRequestST, result *CheckResult) {
+	expectForbiddenPeers(req, result, loopbackPeers)
+}
+
+func checkPrivatePeer(req *ConformanceRequestST, result *CheckResult) {
+	expectForbiddenPeers(req, result, privatePeers)
+}
+
+// expectForbiddenPeers passes result when CreatePermission is refused for each peer of the relayed family
+func expectForbiddenPeers(req *ConformanceRequestST, result *CheckResult, peers map[AddressFamily][]string) {
+	raw := allocateCheckClient(req, result)
+	if raw == nil {
+		return
+	}
+	defer raw.Close()
+
+	var details, accepted []string
+	for _, ip := range peers[familyOf(raw.relayedAddrs()[0].IP)] {
+		peer := &net.UDPAddr{IP: net.ParseIP(ip), Port: 9}
+		res, err := raw.request(stun.MethodCreatePermission, xorAddrAttr{Type: stun.AttrXORPeerAddress, Addr: peer})
+		if res == nil {
+			result.Status = CHECK_SKIP
+			result.Detail = fmt.Sprintf("CreatePermission %s:%s", ip, outcome(res, err))
+			return
+		}
+
+		if code := errorCodeOf(responseError(res)); code == 0 {
+			accepted = append(accepted, ip)
+		} else {
+			details = append(details, fmt.Sprintf("%s:%d", ip, code))
+		}
+	}
+
+	if len(accepted) > 0 {
+		result.Detail = "permitted " + strings.Join(accepted, ", ")
+		return
+	}
+	result.Status = CHECK_PASS
+	result.Detail = strings.Join(details, ", ")
+}
+
+func checkQuota(req *ConformanceRequestST, result *CheckResult) {
+	max := req.MaxAllocations
+	if max <= 0 {
+		max = defaultMaxAllocations
+	}
+
+	quota, err := DiscoverQuota(&QuotaRequestST{
+		Ctx:            req.Ctx,
+		Log:            req.Log,
+		TurnServerAddr: req.TurnServerAddr,
+		TlsConfig:      req.TlsConfig,
+		Username:       req.Username,
+		Password:       req.Password,
+		ClientFamily:   req.ClientFamily,
+		MaxAllocations: max,
+	})
+	if err != nil {
+		result.Status = CHECK_SKIP
+		result.Detail = fmt.Sprintf("DiscoverQuota error:%v", err)
+		return
+	}
+
+	switch {
+	case !quota.Reached:
+		result.Detail = fmt.Sprintf("no 486 after %d allocations", quota.Allocations)
+	case quota.Code == 0:
+		result.Detail = fmt.Sprintf("%s after %d allocations", quota.Reason, quota.Allocations)
+	case quota.Code != int(stun.CodeAllocQuotaReached):
+		result.Detail = fmt.Sprintf("%d instead of 486 after %d allocations", quota.Code, quota.Allocations)
+	case !quota.Recovered:
+		result.Detail = fmt.Sprintf("486 after %d allocations, still refused after deallocating", quota.Allocations)
+	default:
+		result.Status = CHECK_PASS
+		result.Detail = fmt.Sprintf("486 after %d allocations", quota.Allocations)
+	}
+}
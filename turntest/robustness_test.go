@@ -0,0 +1,35 @@
+package turntest
+
+import (
+	"testing"
+)
+
+// pion/turn rejects the crafted messages but relays anywhere and has no quota
+func TestRobustness(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeConformanceRequestST(server.UDPURI())
+	defer cancel()
+	req.MaxAllocations = 5
+
+	results, err := CheckRobustness(req)
+	got := statuses(t, results, err)
+	if len(got) != len(RobustnessCheckNames()) {
+		t.Fatalf("%d results for %d checks", len(got), len(RobustnessCheckNames()))
+	}
+
+	want := map[string]CheckStatus{
+		CHECK_LOOPBACK_PEER: CHECK_FAIL,
+		CHECK_PRIVATE_PEER:  CHECK_FAIL,
+		CHECK_QUOTA:         CHECK_FAIL,
+	}
+	for _, result := range results {
+		if expected, ok := want[result.Name]; !ok && result.Status != CHECK_PASS || ok && result.Status != expected {
+			t.Errorf("%s got %s", result.Name, result.Status)
+		}
+
+		if result.Responsive == nil || !*result.Responsive {
+			t.Errorf("%s server unresponsive", result.Name)
+		}
+	}
+}
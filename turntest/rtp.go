@@ -0,0 +1,302 @@
+package turntest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	rtpHeaderSize = 12
+	rtpVersion    = 2
+
+	rtpPayloadTypeVideo = 96  // dynamic, as VP8/H264 in WebRTC
+	rtpPayloadTypeAudio = 111 // dynamic, as Opus in WebRTC
+	rtpVideoClockRate   = 90000
+	rtpAudioClockRate   = 48000
+
+	rtcpTypeSR         = 200
+	rtcpTypeRR         = 201
+	rtcpSenderReport   = 28 // header, sender ssrc and sender info without report blocks
+	rtcpReceiverReport = 32 // header, reporter ssrc and one report block
+	rtcpInterval       = time.Second
+
+	ntpEpochOffset = 2208988800 // seconds from 1900 to 1970
+)
+
+// ntpTime is t in the 64 bits NTP format
+func ntpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// ntpMiddle is the middle 32 bits of the NTP time, in 1/65536 seconds
+func ntpMiddle(t time.Time) uint32 {
+	return uint32(ntpTime(t) >> 16)
+}
+
+// isRtcp tells RTCP from RTP multiplexed on one flow (RFC 5761) by the packet type
+func isRtcp(buf []byte) bool {
+	return len(buf) >= 8 && buf[0]>>6 == rtpVersion && buf[1] >= 192 && buf[1] <= 223
+}
+
+// rtpSender stamps the RTP header of a channel's packages and makes its sender reports
+type rtpSender struct {
+	ssrc        uint32
+	payloadType uint8
+	clockRate   uint32
+	seq         uint16
+	tsBase      uint32
+	start       time.Time
+	packets     uint32
+	octets      uint32
+	lastReport  time.Time
+}
+
+func newRtpSender(req *TrunRequestST) *rtpSender {
+	s := &rtpSender{
+		ssrc:        rand.Uint32(),
+		payloadType: rtpPayloadTypeVideo,
+		clockRate:   rtpVideoClockRate,
+		seq:         uint16(rand.Uint32()),
+		tsBase:      rand.Uint32(),
+		start:       time.Now(),
+	}
+
+	if req.Profile == PROFILE_AUDIO {
+		s.payloadType = rtpPayloadTypeAudio
+		s.clockRate = rtpAudioClockRate
+	}
+
+	return s
+}
+
+// rtpTime is t in RTP timestamp units
+func (s *rtpSender) rtpTime(t time.Time) uint32 {
+	return s.tsBase + uint32(t.Sub(s.start).Seconds()*float64(s.clockRate))
+}
+
+// writeHeader writes the RTP header of the next package into buf, captured at frameTime,
+// marker is set on the last package of a frame
+func (s *rtpSender) writeHeader(buf []byte, frameTime time.Time, marker bool, payloadSize int) {
+	buf[0] = rtpVersion << 6
+	buf[1] = s.payloadType
+	if marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:], s.seq)
+	binary.BigEndian.PutUint32(buf[4:], s.rtpTime(frameTime))
+	binary.BigEndian.PutUint32(buf[8:], s.ssrc)
+
+	s.seq++
+	s.packets++
+	s.octets += uint32(payloadSize)
+}
+
+// senderReport returns a RTCP SR when one is due
+func (s *rtpSender) senderReport(now time.Time) []byte {
+	if now.Sub(s.lastReport) < rtcpInterval {
+		return nil
+	}
+	s.lastReport = now
+
+	buf := make([]byte, rtcpSenderReport)
+	buf[0] = rtpVersion << 6
+	buf[1] = rtcpTypeSR
+	binary.BigEndian.PutUint16(buf[2:], rtcpSenderReport/4-1)
+	binary.BigEndian.PutUint32(buf[4:], s.ssrc)
+	binary.BigEndian.PutUint64(buf[8:], ntpTime(now))
+	binary.BigEndian.PutUint32(buf[16:], s.rtpTime(now))
+	binary.BigEndian.PutUint32(buf[20:], s.packets)
+	binary.BigEndian.PutUint32(buf[24:], s.octets)
+
+	return buf
+}
+
+// rtpReceiver computes loss and jitter of a RTP stream as RFC 3550 appendix A.3 and A.8
+type rtpReceiver struct {
+	ssrc        uint32 // reporter ssrc of our receiver reports
+	senderSsrc  uint32
+	clockRate   uint32
+	start       time.Time
+	started     bool
+	baseSeq     uint32
+	maxSeq      uint16
+	cycles      uint32
+	received    uint64
+	transit     int32
+	jitter      float64 // in RTP timestamp units
+	lastSR      uint32  // middle of the NTP time of the last sender report
+	lastSRAt    time.Time
+	lastReport  time.Time
+	priorExpect uint64
+	priorRecv   uint64
+}
+
+func newRtpReceiver(req *TrunRequestST) *rtpReceiver {
+	r := &rtpReceiver{
+		ssrc:      rand.Uint32(),
+		clockRate: rtpVideoClockRate,
+		start:     time.Now(),
+	}
+
+	if req.Profile == PROFILE_AUDIO {
+		r.clockRate = rtpAudioClockRate
+	}
+
+	return r
+}
+
+// receive checks the RTP header of buf and updates the statistics
+func (r *rtpReceiver) receive(buf []byte, arrival time.Time) error {
+	if len(buf) < rtpHeaderSize || buf[0]>>6 != rtpVersion {
+		return fmt.Errorf("not a RTP package")
+	}
+
+	seq := binary.BigEndian.Uint16(buf[2:])
+	ts := binary.BigEndian.Uint32(buf[4:])
+	ssrc := binary.BigEndian.Uint32(buf[8:])
+
+	if !r.started {
+		r.started = true
+		r.senderSsrc = ssrc
+		r.baseSeq = uint32(seq)
+		r.maxSeq = seq
+	} else if ssrc != r.senderSsrc {
+		return fmt.Errorf("ssrc %x, want %x", ssrc, r.senderSsrc)
+	} else if delta := seq - r.maxSeq; delta < 0x8000 && delta > 0 {
+		if seq < r.maxSeq {
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = seq
+	}
+
+	r.received++
+
+	// modulo 2^32 like the timestamps, so a wrapping timestamp doesn't jump the transit (RFC 3550 A.8)
+	arrivalUnits := int64(arrival.Sub(r.start).Seconds() * float64(r.clockRate))
+	transit := int32(uint32(arrivalUnits) - ts)
+	if r.received > 1 {
+		d := transit - r.transit
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+	}
+	r.transit = transit
+
+	return nil
+}
+
+// handleSenderReport remembers when the last sender report came for the receiver report
+func (r *rtpReceiver) handleSenderReport(buf []byte, arrival time.Time) {
+	if len(buf) < rtcpSenderReport || buf[1] != rtcpTypeSR {
+		return
+	}
+
+	r.lastSR = uint32(binary.BigEndian.Uint64(buf[8:]) >> 16)
+	r.lastSRAt = arrival
+}
+
+func (r *rtpReceiver) expected() uint64 {
+	if !r.started {
+		return 0
+	}
+	return uint64(r.cycles) + uint64(r.maxSeq) - uint64(r.baseSeq) + 1
+}
+
+// lost is the cumulative number of packages lost, negative when duplicates came
+func (r *rtpReceiver) lost() int64 {
+	return int64(r.expected()) - int64(r.received)
+}
+
+func (r *rtpReceiver) jitterDuration() time.Duration {
+	return time.Duration(r.jitter / float64(r.clockRate) * float64(time.Second))
+}
+
+// receiverReport returns a RTCP RR when one is due
+func (r *rtpReceiver) receiverReport(now time.Time) []byte {
+	if !r.started || now.Sub(r.lastReport) < rtcpInterval {
+		return nil
+	}
+	r.lastReport = now
+
+	expected := r.expected()
+	expectedInterval := expected - r.priorExpect
+	lostInterval := int64(expectedInterval) - int64(r.received-r.priorRecv)
+	r.priorExpect = expected
+	r.priorRecv = r.received
+
+	fraction := uint32(0)
+	if expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint32(lostInterval<<8) / uint32(expectedInterval)
+	}
+
+	lost := r.lost()
+	if lost > 0x7fffff {
+		lost = 0x7fffff
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+
+	dlsr := uint32(0)
+	if !r.lastSRAt.IsZero() {
+		dlsr = uint32(now.Sub(r.lastSRAt).Seconds() * 65536)
+	}
+
+	buf := make([]byte, rtcpReceiverReport)
+	buf[0] = rtpVersion<<6 | 1
+	buf[1] = rtcpTypeRR
+	binary.BigEndian.PutUint16(buf[2:], rtcpReceiverReport/4-1)
+	binary.BigEndian.PutUint32(buf[4:], r.ssrc)
+	binary.BigEndian.PutUint32(buf[8:], r.senderSsrc)
+	binary.BigEndian.PutUint32(buf[12:], fraction<<24|uint32(lost)&0xffffff)
+	binary.BigEndian.PutUint32(buf[16:], r.cycles|uint32(r.maxSeq))
+	binary.BigEndian.PutUint32(buf[20:], uint32(r.jitter))
+	binary.BigEndian.PutUint32(buf[24:], r.lastSR)
+	binary.BigEndian.PutUint32(buf[28:], dlsr)
+
+	return buf
+}
+
+// rttFromReceiverReport is the round trip time by LSR and DLSR of a receiver report (RFC 3550 6.4.1)
+func rttFromReceiverReport(buf []byte, arrival time.Time) (time.Duration, bool) {
+	if len(buf) < rtcpReceiverReport || buf[1] != rtcpTypeRR || buf[0]&0x1f == 0 {
+		return 0, false
+	}
+
+	lsr := binary.BigEndian.Uint32(buf[24:])
+	dlsr := binary.BigEndian.Uint32(buf[28:])
+	if lsr == 0 {
+		return 0, false
+	}
+
+	rtt := ntpMiddle(arrival) - lsr - dlsr
+	if rtt > 0x80000000 {
+		return 0, false
+	}
+
+	return time.Duration(float64(rtt) / 65536 * float64(time.Second)), true
+}
+
+// readReceiverReports reads the receiver reports coming back to the sender conn and reports the round trip time
+func readReceiverReports(req *TrunRequestST, conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if !isRtcp(buf[:n]) {
+			continue
+		}
+
+		if rtt, ok := rttFromReceiverReport(buf[:n], time.Now()); ok {
+			sendRtpReportResults(req, nil, rtt)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package turntest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRtpReceiverLoss(t *testing.T) {
+	req := &TrunRequestST{Profile: PROFILE_AUDIO}
+	sender := newRtpSender(req)
+	sender.seq = 0xfff0                 // wraps around
+	sender.tsBase = 0xffffffff - 10*960 // wraps around too, after 10 audio frames
+	receiver := newRtpReceiver(req)
+
+	buf := make([]byte, rtpHeaderSize+100)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		frameTime := start.Add(audioFrameTime * time.Duration(i))
+		sender.writeHeader(buf, frameTime, true, 100)
+		if i%10 == 5 {
+			continue
+		}
+
+		// every package 1ms late, so there is no jitter
+		if err := receiver.receive(buf, frameTime.Add(time.Millisecond)); err != nil {
+			t.Fatalf("receive error:%v", err)
+		}
+	}
+
+	if receiver.expected() != 100 || receiver.lost() != 10 {
+		t.Fatalf("expected:%d lost:%d", receiver.expected(), receiver.lost())
+	}
+
+	if jitter := receiver.jitterDuration(); jitter > time.Millisecond/10 {
+		t.Fatalf("jitter:%v", jitter)
+	}
+
+	buf[0] = 0
+	if receiver.receive(buf, time.Now()) == nil {
+		t.Fatalf("bad version accepted")
+	}
+}
+
+func TestRtpReceiverJitter(t *testing.T) {
+	req := &TrunRequestST{Profile: PROFILE_VIDEO}
+	sender := newRtpSender(req)
+	receiver := newRtpReceiver(req)
+
+	buf := make([]byte, rtpHeaderSize+100)
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		frameTime := start.Add(time.Second / videoFps * time.Duration(i))
+		sender.writeHeader(buf, frameTime, true, 100)
+
+		// alternately 0 and 10ms late, the jitter converges to 10ms
+		arrival := frameTime
+		if i%2 == 1 {
+			arrival = arrival.Add(time.Millisecond * 10)
+		}
+		receiver.receive(buf, arrival)
+	}
+
+	if jitter := receiver.jitterDuration(); jitter < time.Millisecond*9 || jitter > time.Millisecond*11 {
+		t.Fatalf("jitter:%v", jitter)
+	}
+}
+
+func TestRtcpRtt(t *testing.T) {
+	req := &TrunRequestST{Profile: PROFILE_VIDEO}
+	sender := newRtpSender(req)
+	receiver := newRtpReceiver(req)
+
+	buf := make([]byte, rtpHeaderSize+100)
+	now := time.Now()
+	sender.writeHeader(buf, now, true, 100)
+	receiver.receive(buf, now)
+
+	sr := sender.senderReport(now)
+	if !isRtcp(sr) || isRtcp(buf) {
+		t.Fatalf("rtcp not told from rtp")
+	}
+	if sender.senderReport(now) != nil {
+		t.Fatalf("sender report before the interval")
+	}
+
+	// 20ms to the receiver, held 300ms, 30ms back
+	receiver.handleSenderReport(sr, now.Add(time.Millisecond*20))
+	rr := receiver.receiverReport(now.Add(time.Millisecond * 320))
+	rtt, ok := rttFromReceiverReport(rr, now.Add(time.Millisecond*350))
+	if !ok || rtt < time.Millisecond*49 || rtt > time.Millisecond*51 {
+		t.Fatalf("rtt:%v ok:%v", rtt, ok)
+	}
+}
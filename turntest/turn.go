@@ -3,15 +3,18 @@ package turntest
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"net"
-	"strings"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/turn/v2"
+	"github.com/xylophone21/go-turn-test/impair"
 	"github.com/xylophone21/go-turn-test/statistics"
 )
 
@@ -22,6 +25,19 @@ const (
 	chanIdOffset  = 0
 	timeLenOffset = chanIdOffset + 8
 	timeOffset    = timeLenOffset + 4
+
+	// renew credentials this long before they expire
+	credentialRenewAhead = time.Second * 5
+
+	// wait before asking the credential provider again after it failed
+	credentialRetryWait = time.Second
+
+	// wait for the packages in flight before freeing an allocation ended for new credentials
+	rotationDrain = time.Second
+
+	// directions of bidirectional requests, up leaves the TURN client (of relay1 in 2-cloud), down comes to it
+	DIRECTION_UP   = "up"
+	DIRECTION_DOWN = "down"
 )
 
 type TrunRequestST struct {
@@ -29,26 +45,95 @@ type TrunRequestST struct {
 	Log            logging.LeveledLogger
 	ChanId         uint64
 	PackageSize    int32
-	PackageWait    time.Duration
-	StunServerAddr string // STUN server address (e.g. "stun.abc.com:3478")
-	TurnServerAddr string // TURN server addrees (e.g. "turn.abc.com:3478")
+	PackageWait    time.Duration  // interval between packages, unless Bitrate or PacketRate is set
+	Bitrate        int64          // optional, bits per second to send
+	PacketRate     float64        // optional, packages per second to send
+	Burst          int            // optional, packages the pacer may send back-to-back to catch up
+	Profile        TrafficProfile // traffic to send, PROFILE_FIXED sends PackageSize packages
+	Rtp            bool           // wrap packages in RTP headers on top of their size and send RTCP reports
+	Echo           bool           // the far peer reflects packages, latency is the round trip time on the sender's clock
+	Bidirectional  bool           // both ends send and verify, results are reported per direction
+	PeerCount      int            // optional, fan-out: the allocation binds channels to this many peers and sends to each (1-cloud)
+	ClientFamily   AddressFamily  // optional, family of our sockets to the TURN server, IPv4 by default
+	RelayFamily    AddressFamily  // optional, asks for a relayed address of this family by REQUESTED-ADDRESS-FAMILY (RFC 6156), our peers follow it
+	DualAllocation bool           // asks for IPv4 and IPv6 relayed addresses at once by ADDITIONAL-ADDRESS-FAMILY (RFC 8656) and sends through each (1-cloud)
+	StunServerAddr string         // STUN server address (e.g. "stun.abc.com:3478" or "stun:stun.abc.com")
+	TurnServerAddr string         // TURN server addrees (e.g. "turn.abc.com:3478" or "turns:turn.abc.com:443?transport=tcp")
+	TlsConfig      *tls.Config    // optional, for turns: servers
 	Username       string
 	Password       string
+	Credential     CredentialFunc // optional, renews Username/Password before each allocation once expired
+	Expired        time.Time      // when Username/Password expire, zero means never
+	OAuthUrl       string         // optional, authorization server issuing RFC 7635 access tokens used instead of Username/Password
+	OAuthClientId  string
+	Token          *OAuthToken    // current access token when OAuthUrl is set
+	Impair         *impair.Config // optional, impairs the packets our UDP sockets send
+	Peers          *PeerHub       // optional, remote peers are the far end instead of our own sockets
 	Ch             chan statistics.RequestResults
+
+	direction string          // of the traffic of a bidirectional request
+	peer      int             // 1 based peer of the traffic of a fan-out request
+	family    string          // of the relayed address of the traffic of a dual allocation
+	parentCtx context.Context // the context of the whole run when Ctx ends at credential rotation
+}
+
+// rotating tells whether Ctx ended for new credentials while the run goes on
+func (req *TrunRequestST) rotating() bool {
+	return req.parentCtx != nil && req.Ctx.Err() != nil && req.parentCtx.Err() == nil
+}
+
+// drainAfterRotation waits for the packages in flight when Ctx ended for new credentials, so that
+// they aren't counted as lost to the server
+func drainAfterRotation(req *TrunRequestST) {
+	if !req.rotating() {
+		return
+	}
+
+	select {
+	case <-req.parentCtx.Done():
+	case <-time.After(rotationDrain):
+	}
 }
 
 type relayClient struct {
 	Conn      net.PacketConn
 	Client    *turn.Client
+	Raw       *rawClient    // instead of Client when pion/turn can't do the allocation
+	Allocated *stun.Message // success response to the Allocate of Raw
 	RelayConn net.PacketConn
 }
 
+func (relay *relayClient) sendBindingRequest() (net.Addr, error) {
+	if relay.Raw != nil {
+		return relay.Raw.binding()
+	}
+	return relay.Client.SendBindingRequest()
+}
+
 func sendErrorRequestResults(req *TrunRequestST, errCode int) {
 	if req.Ch != nil {
 		result := statistics.RequestResults{
-			ChanID:  req.ChanId,
-			Time:    time.Now(),
-			ErrCode: errCode,
+			ChanID:    req.ChanId,
+			Time:      time.Now(),
+			ErrCode:   errCode,
+			Server:    req.TurnServerAddr,
+			Profile:   req.Profile.String(),
+			Direction: req.direction,
+			Peer:      req.peer,
+			Family:    req.family,
+		}
+
+		req.Ch <- result
+	}
+}
+
+func sendRotatedRequestResults(req *TrunRequestST) {
+	if req.Ch != nil {
+		result := statistics.RequestResults{
+			ChanID:    req.ChanId,
+			Time:      time.Now(),
+			IsRotated: true,
+			Server:    req.TurnServerAddr,
 		}
 
 		req.Ch <- result
@@ -58,14 +143,21 @@ func sendErrorRequestResults(req *TrunRequestST, errCode int) {
 func sendSuccessRequestResults(req *TrunRequestST, isSent bool, bytes uint64, latency *time.Duration) {
 	if req.Ch != nil {
 		result := statistics.RequestResults{
-			ChanID:  req.ChanId,
-			Time:    time.Now(),
-			ErrCode: 0,
-			IsSent:  isSent,
-			Bytes:   bytes,
+			ChanID:    req.ChanId,
+			Time:      time.Now(),
+			ErrCode:   0,
+			IsSent:    isSent,
+			Bytes:     bytes,
+			Server:    req.TurnServerAddr,
+			Profile:   req.Profile.String(),
+			Direction: req.direction,
+			Peer:      req.peer,
+			Family:    req.family,
 		}
 
-		if !isSent {
+		if isSent {
+			result.TargetBitrate = targetBitrate(req, bytes)
+		} else {
 			result.Latency = *latency
 		}
 
@@ -75,42 +167,176 @@ func sendSuccessRequestResults(req *TrunRequestST, isSent bool, bytes uint64, la
 	}
 }
 
+// sendRtpReportResults reports the RTP statistics of the receiver, or the round trip time seen by the sender when recv is nil
+func sendRtpReportResults(req *TrunRequestST, recv *rtpReceiver, rtt time.Duration) {
+	if req.Ch != nil {
+		result := statistics.RequestResults{
+			ChanID:      req.ChanId,
+			Time:        time.Now(),
+			IsRtpReport: true,
+			Rtt:         rtt,
+			Server:      req.TurnServerAddr,
+			Profile:     req.Profile.String(),
+			Direction:   req.direction,
+			Peer:        req.peer,
+			Family:      req.family,
+		}
+
+		if recv != nil {
+			result.RtpExpected = recv.expected()
+			result.RtpLost = recv.lost()
+			result.Jitter = recv.jitterDuration()
+		}
+
+		req.Ch <- result
+	}
+}
+
 func requestWrap(req *TrunRequestST, doRequest func(req *TrunRequestST) error) error {
 	if req == nil {
 		err := fmt.Errorf("[requestWrap-unkonw]req nil")
 		return err
 	}
 
-	if req.Ctx == nil || req.Log == nil || req.PackageSize < minPackageSize || req.PackageWait < minPackageWait || req.TurnServerAddr == "" {
+	if req.Ctx == nil || req.Log == nil || req.TurnServerAddr == "" {
+		err := fmt.Errorf("[requestWrap-%d]Paramters error", req.ChanId)
+		return err
+	}
+
+	paced := req.Bitrate > 0 || req.PacketRate > 0
+	if req.Profile == PROFILE_FIXED && (req.PackageSize < minPackageSize || (!paced && req.PackageWait < minPackageWait)) {
 		err := fmt.Errorf("[requestWrap-%d]Paramters error", req.ChanId)
 		return err
 	}
 
+	if req.Bidirectional && (req.Echo || req.Peers != nil) {
+		err := fmt.Errorf("[requestWrap-%d]bidirectional requests can't echo or use remote peers", req.ChanId)
+		return err
+	}
+
+	if req.PeerCount > 0 && (req.Echo || req.Peers != nil || req.Bidirectional) {
+		err := fmt.Errorf("[requestWrap-%d]fan-out requests can't echo, use remote peers or be bidirectional", req.ChanId)
+		return err
+	}
+
+	if req.DualAllocation && (req.Echo || req.Peers != nil || req.Bidirectional || req.PeerCount > 0 || req.RelayFamily != FAMILY_ANY) {
+		err := fmt.Errorf("[requestWrap-%d]dual allocations can't echo, use remote peers, be bidirectional, fan out or ask for one family", req.ChanId)
+		return err
+	}
+
+	if _, ok := profileNames[req.Profile]; !ok {
+		err := fmt.Errorf("[requestWrap-%d]unknown profile %v", req.ChanId, req.Profile)
+		return err
+	}
+
 	if req.StunServerAddr == "" {
 		req.StunServerAddr = req.TurnServerAddr
 	}
 
 	for {
-		doRequest(req)
+		wait := 100 * time.Millisecond
+		err := renewCredential(req)
+		if err != nil {
+			req.Log.Warnf("[requestWrap-%d]renewCredential error:%s", req.ChanId, err)
+			sendErrorRequestResults(req, 300)
+			wait = credentialRetryWait
+		} else if err = renewToken(req); err != nil {
+			req.Log.Warnf("[requestWrap-%d]renewToken error:%s", req.ChanId, err)
+			sendErrorRequestResults(req, 301)
+		} else {
+			doRequestUntilExpired(req, doRequest)
+		}
 
 		// timeout or canceled, return
 		select {
 		case <-req.Ctx.Done():
 			return nil
 
-		// wait 100 Microsecond and retry
-		case <-time.After(100 * time.Millisecond):
+		// wait 100 Microsecond, or longer for the credential provider, and retry
+		case <-time.After(wait):
 			continue
 		}
 	}
 }
 
+// renewCredential fetches new credentials when there are none yet or the current ones are about to expire
+func renewCredential(req *TrunRequestST) error {
+	if req.Credential == nil {
+		return nil
+	}
+
+	if req.Username != "" && (req.Expired.IsZero() || time.Now().Before(req.Expired.Add(-credentialRenewAhead))) {
+		return nil
+	}
+
+	cred, err := req.Credential(req.ChanId)
+	if err != nil {
+		return err
+	}
+
+	req.Log.Debugf("[renewCredential-%d]server=%s username=%s expired=%v", req.ChanId, cred.TurnServerAddr, cred.Username, cred.Expired)
+
+	if req.Username != "" {
+		sendRotatedRequestResults(req)
+	}
+
+	if cred.TurnServerAddr != "" {
+		req.TurnServerAddr = cred.TurnServerAddr
+	}
+	req.Username = cred.Username
+	req.Password = cred.Password
+	req.Expired = cred.Expired
+
+	return nil
+}
+
+// doRequestUntilExpired runs doRequest and stops it when the credentials expire,
+// so requestWrap reconnects with renewed ones
+func doRequestUntilExpired(req *TrunRequestST, doRequest func(req *TrunRequestST) error) error {
+	if req.Expired.IsZero() {
+		return doRequest(req)
+	}
+
+	deadline := req.Expired.Add(-credentialRenewAhead)
+	if deadline.Before(time.Now()) {
+		deadline = req.Expired
+	}
+
+	ctx, cancel := context.WithDeadline(req.Ctx, deadline)
+	defer cancel()
+
+	attempt := *req
+	attempt.Ctx = ctx
+	attempt.parentCtx = req.Ctx
+
+	return doRequest(&attempt)
+}
+
 func readAndVerifyDataback(req *TrunRequestST, conn net.PacketConn, start time.Time) {
+	var rtp *rtpReceiver
+	headerSize := 0
+	if req.Rtp {
+		headerSize = rtpHeaderSize
+		// echoed packages come back to the sender, whose loss and jitter the far peer reports
+		if !req.Echo {
+			rtp = newRtpReceiver(req)
+		}
+	}
+
 	var byteRecv uint64 = 0
-	recvBuf := make([]byte, req.PackageSize+32)
+	recvBuf := make([]byte, headerSize+maxPackageSize(req)+32)
 	for {
-		n, _, err := conn.ReadFrom(recvBuf)
+		n, from, err := conn.ReadFrom(recvBuf)
 		if err != nil {
+			if rtp != nil {
+				sendRtpReportResults(req, rtp, 0)
+			}
+
+			// closed by ourselves at the end of the run or at credential rotation
+			if req.Ctx.Err() != nil {
+				return
+			}
+
 			req.Log.Warnf("[readAndVerifyDataback-%d]conn.ReadFrom error:%s", req.ChanId, err)
 			sendErrorRequestResults(req, 1000)
 			return
@@ -120,22 +346,61 @@ func readAndVerifyDataback(req *TrunRequestST, conn net.PacketConn, start time.T
 			continue
 		}
 
-		if n != int(req.PackageSize) {
-			req.Log.Warnf("[readAndVerifyDataback-%d]conn.ReadFrom len error,want %d got %d", req.ChanId, req.PackageSize, n)
+		if req.Echo && req.Rtp && isRtcp(recvBuf[:n]) {
+			if rtt, ok := rttFromReceiverReport(recvBuf[:n], time.Now()); ok {
+				sendRtpReportResults(req, nil, rtt)
+			}
+			continue
+		}
+
+		if rtp != nil {
+			now := time.Now()
+			if isRtcp(recvBuf[:n]) {
+				// receiver reports of what we send the other way in bidirectional requests
+				if rtt, ok := rttFromReceiverReport(recvBuf[:n], now); ok {
+					sendRtpReportResults(req, nil, rtt)
+				}
+				rtp.handleSenderReport(recvBuf[:n], now)
+				continue
+			}
+
+			if err = rtp.receive(recvBuf[:n], now); err != nil {
+				req.Log.Warnf("[readAndVerifyDataback-%d]rtp error:%s", req.ChanId, err)
+				sendErrorRequestResults(req, 1005)
+				continue
+			}
+
+			if report := rtp.receiverReport(now); report != nil {
+				conn.WriteTo(report, from)
+				sendRtpReportResults(req, rtp, 0)
+			}
+		}
+
+		payload := recvBuf[headerSize:n]
+		size := len(payload)
+
+		// media profiles send packages of any size
+		if (req.Profile == PROFILE_FIXED && size != int(req.PackageSize)) || size < minPackageSize || size > maxPackageSize(req) {
+			req.Log.Warnf("[readAndVerifyDataback-%d]conn.ReadFrom len error,want %d got %d", req.ChanId, req.PackageSize, size)
 			sendErrorRequestResults(req, 1001)
 			continue
 		}
 
-		chanId := binary.BigEndian.Uint64(recvBuf[chanIdOffset:])
+		chanId := binary.BigEndian.Uint64(payload[chanIdOffset:])
 		if chanId != req.ChanId {
 			req.Log.Warnf("[readAndVerifyDataback-%d]chanId error:%d", req.ChanId, chanId)
 			sendErrorRequestResults(req, 1002)
 			continue
 		}
 
-		timeLen := int(binary.BigEndian.Uint32(recvBuf[timeLenOffset:]))
+		timeLen := int(binary.BigEndian.Uint32(payload[timeLenOffset:]))
+		if timeOffset+timeLen > size-8 {
+			req.Log.Warnf("[readAndVerifyDataback-%d]time length error:%d", req.ChanId, timeLen)
+			sendErrorRequestResults(req, 1003)
+			continue
+		}
 
-		timeStr := string(recvBuf[timeOffset : timeOffset+timeLen])
+		timeStr := string(payload[timeOffset : timeOffset+timeLen])
 		sentAt, err := time.Parse(time.RFC3339Nano, timeStr)
 		if err != nil {
 			req.Log.Warnf("[readAndVerifyDataback-%d]time.Parse error:%s", req.ChanId, err)
@@ -143,8 +408,8 @@ func readAndVerifyDataback(req *TrunRequestST, conn net.PacketConn, start time.T
 			continue
 		}
 
-		crc32Get := binary.BigEndian.Uint32(recvBuf[req.PackageSize-8:])
-		crc32Sum := crc32.ChecksumIEEE(recvBuf[:req.PackageSize-8])
+		crc32Get := binary.BigEndian.Uint32(recvBuf[n-8:])
+		crc32Sum := crc32.ChecksumIEEE(recvBuf[:n-8])
 		if crc32Get != crc32Sum {
 			req.Log.Warnf("[readAndVerifyDataback-%d]crc error, want %x got %x", req.ChanId, crc32Sum, crc32Get)
 			sendErrorRequestResults(req, 1004)
@@ -162,39 +427,109 @@ func readAndVerifyDataback(req *TrunRequestST, conn net.PacketConn, start time.T
 	}
 }
 
-func sendData(req *TrunRequestST, conn net.PacketConn, toAddr net.Addr, start time.Time) error {
-	sendBuf := make([]byte, req.PackageSize)
-	rand.Read(sendBuf)
+// echoPackages reflects the packages coming to the far peer back to their sender, reporting RTP statistics on the way
+func echoPackages(req *TrunRequestST, conn net.PacketConn) {
+	var rtp *rtpReceiver
+	if req.Rtp {
+		rtp = newRtpReceiver(req)
+	}
 
-	var byteSend uint64 = 0
+	buf := make([]byte, rtpHeaderSize+maxPackageSize(req)+32)
 	for {
-		select {
-		case <-req.Ctx.Done():
-			return nil
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if rtp != nil {
+				sendRtpReportResults(req, rtp, 0)
+			}
+			return
+		}
+
+		if string(buf[:n]) == "Hello" {
+			continue
+		}
+
+		if rtp != nil {
+			now := time.Now()
+			if isRtcp(buf[:n]) {
+				rtp.handleSenderReport(buf[:n], now)
+				continue
+			}
+
+			if err = rtp.receive(buf[:n], now); err != nil {
+				req.Log.Warnf("[echoPackages-%d]rtp error:%s", req.ChanId, err)
+				sendErrorRequestResults(req, 1005)
+				continue
+			}
+
+			if report := rtp.receiverReport(now); report != nil {
+				conn.WriteTo(report, from)
+				sendRtpReportResults(req, rtp, 0)
+			}
+		}
 
-		default:
+		_, err = conn.WriteTo(buf[:n], from)
+		if err != nil {
+			req.Log.Warnf("[echoPackages-%d]conn.WriteTo error:%s", req.ChanId, err)
+			sendErrorRequestResults(req, 2001)
 		}
+	}
+}
+
+// sendBidirectional sends from both conns of a pair to the address of the other, each verifying
+// what the other sends, upAddr is where up sends to
+func sendBidirectional(req *TrunRequestST, up net.PacketConn, upAddr net.Addr, down net.PacketConn, downAddr net.Addr, start time.Time) error {
+	ctx, cancel := context.WithCancel(req.Ctx)
+	defer cancel()
+
+	upReq := *req
+	upReq.Ctx = ctx
+	upReq.direction = DIRECTION_UP
+
+	downReq := *req
+	downReq.Ctx = ctx
+	downReq.direction = DIRECTION_DOWN
+
+	go readAndVerifyDataback(&upReq, down, start)
+	go readAndVerifyDataback(&downReq, up, start)
+
+	// the first one failing stops the other
+	errCh := make(chan error, 1)
+	go func() {
+		err := sendData(&downReq, down, downAddr, start)
+		cancel()
+		errCh <- err
+	}()
+
+	err := sendData(&upReq, up, upAddr, start)
+	cancel()
+
+	if downErr := <-errCh; err == nil {
+		err = downErr
+	}
+	return err
+}
+
+func sendData(req *TrunRequestST, conn net.PacketConn, toAddr net.Addr, start time.Time) error {
+	w := newPackageWriter(req, conn, toAddr)
 
-		binary.BigEndian.PutUint64(sendBuf[chanIdOffset:], req.ChanId)
+	if req.Profile != PROFILE_FIXED {
+		return sendFrames(req, w, start)
+	}
 
-		nowStr := time.Now().Format(time.RFC3339Nano)
-		binary.BigEndian.PutUint32(sendBuf[timeLenOffset:], uint32(len(nowStr)))
-		copy(sendBuf[timeOffset:], []byte(nowStr))
+	pace := newPacer(req)
 
-		crc32 := crc32.ChecksumIEEE(sendBuf[:req.PackageSize-8])
-		binary.BigEndian.PutUint32(sendBuf[req.PackageSize-8:], crc32)
+	var byteSend uint64 = 0
+	for {
+		if !pace.wait(req.Ctx, int(req.PackageSize)) {
+			return nil
+		}
 
-		_, err := conn.WriteTo(sendBuf, toAddr)
+		err := w.write(int(req.PackageSize), time.Now(), true)
 		if err != nil {
-			req.Log.Warnf("[sendData-%d]conn.WriteTo error:%s", req.ChanId, err)
-			sendErrorRequestResults(req, 2000)
 			return err
 		}
-		byteSend += uint64(len(sendBuf))
+		byteSend += uint64(req.PackageSize)
 
-		sendSuccessRequestResults(req, true, uint64(len(sendBuf)), nil)
-
-		time.Sleep(req.PackageWait)
 		since := time.Since(start).Seconds()
 		if since > 0 {
 			req.Log.Infof("[sendData-%d] Send %d kps", req.ChanId, int(8*float64(byteSend)/since/1024))
@@ -202,7 +537,118 @@ func sendData(req *TrunRequestST, conn net.PacketConn, toAddr net.Addr, start ti
 	}
 }
 
+// sendFrames sends the frames of the media profile of req, spreading the packages of large frames
+func sendFrames(req *TrunRequestST, w *packageWriter, start time.Time) error {
+	frames := newFrameSource(req)
+	pace := &pacer{interval: frames.interval}
+	packagePace := &pacer{bitrate: profileBitrate(req) * framePacingFactor}
+
+	var byteSend uint64 = 0
+	for {
+		if !pace.wait(req.Ctx, 0) {
+			return nil
+		}
+
+		frameTime := time.Now()
+		sizes := frames.nextFrame()
+		for i, size := range sizes {
+			if !packagePace.wait(req.Ctx, size) {
+				return nil
+			}
+
+			err := w.write(size, frameTime, i == len(sizes)-1)
+			if err != nil {
+				return err
+			}
+			byteSend += uint64(size)
+		}
+
+		since := time.Since(start).Seconds()
+		if since > 0 {
+			req.Log.Infof("[sendFrames-%d] Send %d kps", req.ChanId, int(8*float64(byteSend)/since/1024))
+		}
+	}
+}
+
+// packageWriter stamps the packages of a channel and sends them, in RTP when req.Rtp is set
+type packageWriter struct {
+	req     *TrunRequestST
+	conn    net.PacketConn
+	toAddr  net.Addr
+	rtp     *rtpSender
+	sendBuf []byte
+}
+
+func newPackageWriter(req *TrunRequestST, conn net.PacketConn, toAddr net.Addr) *packageWriter {
+	w := &packageWriter{
+		req:    req,
+		conn:   conn,
+		toAddr: toAddr,
+	}
+
+	headerSize := 0
+	if req.Rtp {
+		w.rtp = newRtpSender(req)
+		headerSize = rtpHeaderSize
+	}
+
+	w.sendBuf = make([]byte, headerSize+maxPackageSize(req))
+	rand.Read(w.sendBuf)
+
+	return w
+}
+
+// write sends a package of size bytes besides the RTP header, captured at frameTime,
+// last tells the last package of a frame
+func (w *packageWriter) write(size int, frameTime time.Time, last bool) error {
+	req := w.req
+
+	headerSize := 0
+	if w.rtp != nil {
+		headerSize = rtpHeaderSize
+		w.rtp.writeHeader(w.sendBuf, frameTime, last, size)
+	}
+
+	sendBuf := w.sendBuf[:headerSize+size]
+	payload := sendBuf[headerSize:]
+
+	binary.BigEndian.PutUint64(payload[chanIdOffset:], req.ChanId)
+
+	nowStr := time.Now().Format(time.RFC3339Nano)
+	binary.BigEndian.PutUint32(payload[timeLenOffset:], uint32(len(nowStr)))
+	copy(payload[timeOffset:], []byte(nowStr))
+
+	crc32 := crc32.ChecksumIEEE(sendBuf[:len(sendBuf)-8])
+	binary.BigEndian.PutUint32(sendBuf[len(sendBuf)-8:], crc32)
+
+	_, err := w.conn.WriteTo(sendBuf, w.toAddr)
+	if err != nil {
+		req.Log.Warnf("[sendData-%d]conn.WriteTo error:%s", req.ChanId, err)
+		sendErrorRequestResults(req, 2000)
+		return err
+	}
+
+	sendSuccessRequestResults(req, true, uint64(len(sendBuf)), nil)
+
+	if w.rtp != nil {
+		if report := w.rtp.senderReport(time.Now()); report != nil {
+			w.conn.WriteTo(report, w.toAddr)
+		}
+	}
+
+	return nil
+}
+
 func allocRelayClient(req *TrunRequestST) (*relayClient, error) {
+	// pion/turn's client resolves the servers as udp4 and can't ask for an address family
+	if req.Token != nil || req.ClientFamily == FAMILY_IPV6 || req.RelayFamily != FAMILY_ANY {
+		relay, err := allocRawRelayClient(req)
+		if err != nil {
+			req.Log.Warnf("[allocRelayClient-%d]allocRawRelayClient error:%s", req.ChanId, err)
+		}
+		return relay, err
+	}
+
 	var relay relayClient
 	var err error
 	defer func() {
@@ -211,16 +657,28 @@ func allocRelayClient(req *TrunRequestST) (*relayClient, error) {
 		}
 	}()
 
-	var lc net.ListenConfig
-	relay.Conn, err = lc.ListenPacket(req.Ctx, "udp4", "0.0.0.0:0")
+	var uri *IceURI
+	relay.Conn, uri, err = dialTurnServer(req)
 	if err != nil {
-		req.Log.Warnf("[TrunRequest2Cloud-%d]ListenPacket error:%s", req.ChanId, err)
+		req.Log.Warnf("[TrunRequest2Cloud-%d]dialTurnServer error:%s", req.ChanId, err)
 		return nil, err
 	}
 
+	// over TCP/TLS the binding request goes to the TURN server through the same stream
+	stunAddr := uri.Addr()
+	if uri.Transport == TRANSPORT_UDP {
+		var stunUri *IceURI
+		stunUri, err = ParseStunURI(req.StunServerAddr)
+		if err != nil {
+			req.Log.Warnf("[TrunRequest2Cloud-%d]ParseStunURI error:%s", req.ChanId, err)
+			return nil, err
+		}
+		stunAddr = stunUri.Addr()
+	}
+
 	cfg := &turn.ClientConfig{
-		STUNServerAddr: req.StunServerAddr,
-		TURNServerAddr: req.TurnServerAddr,
+		STUNServerAddr: stunAddr,
+		TURNServerAddr: uri.Addr(),
 		Conn:           relay.Conn,
 		Username:       req.Username,
 		Password:       req.Password,
@@ -249,6 +707,126 @@ func allocRelayClient(req *TrunRequestST) (*relayClient, error) {
 	return &relay, nil
 }
 
+// allocRawRelayClient allocates by a rawClient with extra attrs, with the access token of req presented in ACCESS-TOKEN if any
+func allocRawRelayClient(req *TrunRequestST, attrs ...stun.Setter) (*relayClient, error) {
+	var token, macKey []byte
+	if req.Token != nil {
+		var err error
+		token, err = base64.StdEncoding.DecodeString(req.Token.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		macKey, err = base64.StdEncoding.DecodeString(req.Token.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := dialRawClient(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Token != nil {
+		raw.setAccessToken(req.Token.Kid, macKey, token)
+	}
+	raw.onRefreshError = func(err error) {
+		sendErrorRequestResults(req, allocErrCode(req, err, 104))
+		raw.Close()
+	}
+
+	if req.RelayFamily != FAMILY_ANY {
+		attrs = append(attrs, requestedFamilyAttr(req.RelayFamily))
+	}
+
+	res, err := raw.allocate(attrs...)
+	if err != nil {
+		if res != nil && res.Contains(attrThirdPartyAuth) {
+			v, _ := res.Get(attrThirdPartyAuth)
+			req.Log.Warnf("[allocRawRelayClient-%d]server wants token of %s", req.ChanId, v)
+		}
+		raw.Close()
+		return nil, err
+	}
+
+	// servers not knowing RFC 6156 may ignore the attribute
+	relayed := raw.relayedAddrs()[0]
+	if req.RelayFamily != FAMILY_ANY && familyOf(relayed.IP) != req.RelayFamily {
+		raw.Close()
+		return nil, fmt.Errorf("%w: %s for %s", errRelayFamily, relayed, req.RelayFamily)
+	}
+
+	return &relayClient{
+		Conn:      raw.conn,
+		Raw:       raw,
+		Allocated: res,
+		RelayConn: newRawRelayConn(raw, relayed),
+	}, nil
+}
+
+// dialRawClient opens a rawClient to the TURN server of req with its username and password
+func dialRawClient(req *TrunRequestST) (*rawClient, error) {
+	conn, uri, err := dialTurnServer(req)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := net.ResolveUDPAddr(req.ClientFamily.udpNetwork(), uri.Addr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	raw := newRawClient(conn, server, req.Username, req.Password, req.Log)
+	raw.reliable = uri.Transport != TRANSPORT_UDP
+
+	return raw, nil
+}
+
+// dialTurnServer opens the client socket to the TURN server of req by the transport of its URI,
+// TCP and TLS streams are framed by turn.STUNConn and not impaired as the kernel would resend lost segments
+func dialTurnServer(req *TrunRequestST) (net.PacketConn, *IceURI, error) {
+	uri, err := ParseTurnURI(req.TurnServerAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if uri.Transport == TRANSPORT_UDP {
+		var lc net.ListenConfig
+		conn, err := lc.ListenPacket(req.Ctx, req.ClientFamily.udpNetwork(), req.ClientFamily.wildcard())
+		if err != nil {
+			return nil, nil, err
+		}
+		return impair.Wrap(conn, req.Impair), uri, nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(req.Ctx, req.ClientFamily.tcpNetwork(), uri.Addr())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if uri.IsSecure() {
+		cfg := &tls.Config{}
+		if req.TlsConfig != nil {
+			cfg = req.TlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = uri.Host
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		if err = tlsConn.HandshakeContext(req.Ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	return turn.NewSTUNConn(conn), uri, nil
+}
+
 func freeRelayClient(relay *relayClient) {
 	if relay == nil {
 		return
@@ -264,33 +842,58 @@ func freeRelayClient(relay *relayClient) {
 		relay.Client = nil
 	}
 
+	if relay.Raw != nil {
+		relay.Raw.Close()
+		relay.Raw = nil
+	}
+
 	if relay.RelayConn != nil {
 		relay.RelayConn.Close()
 		relay.RelayConn = nil
 	}
 }
 func doTrunRequest(req *TrunRequestST) error {
+	if req.Peers != nil {
+		return doTrunRequestPeer(req, false)
+	}
+
+	if req.PeerCount > 0 {
+		return doTrunRequestFanout(req)
+	}
+
+	if req.DualAllocation {
+		return doTrunRequestDual(req)
+	}
+
 	relay, err := allocRelayClient(req)
 	if err != nil {
-		sendErrorRequestResults(req, 100)
+		sendErrorRequestResults(req, allocErrCode(req, err, 100))
 		return err
 	}
 	defer freeRelayClient(relay)
 
-	// Set up sender socket (senderConn)
+	relayed, err := toUDPAddr(relay.RelayConn.LocalAddr())
+	if err != nil {
+		sendErrorRequestResults(req, 100)
+		return err
+	}
+
+	// Set up sender socket (senderConn) of the relayed family, as TURN relays within one family
+	peerFamily := familyOf(relayed.IP)
 	var lc net.ListenConfig
-	senderConn, err := lc.ListenPacket(req.Ctx, "udp4", "0.0.0.0:0")
+	senderConn, err := lc.ListenPacket(req.Ctx, peerFamily.udpNetwork(), peerFamily.wildcard())
 	if err != nil {
 		req.Log.Warnf("[doTrunRequest-%d]lc.ListenPacket error:%s", req.ChanId, err)
 		sendErrorRequestResults(req, 101)
 		return err
 	}
+	senderConn = impair.Wrap(senderConn, req.Impair)
 	defer senderConn.Close()
 
 	// Send BindingRequest to learn our external IP
-	mappedAddr, err := relay.Client.SendBindingRequest()
+	mappedIp, err := peerIp(relay, relayed)
 	if err != nil {
-		req.Log.Warnf("[TrunRequest-%d]client.SendBindingRequest() error:%s", req.ChanId, err)
+		req.Log.Warnf("[TrunRequest-%d]peerIp error:%s", req.ChanId, err)
 		sendErrorRequestResults(req, 102)
 		return err
 	}
@@ -298,9 +901,7 @@ func doTrunRequest(req *TrunRequestST) error {
 	// [workaround] server with pulibc ip will usually have a local ip but mapping all port to local ip
 	// so use public ip and connection port
 	// for standard mode, port in mappedAddr will be ingore, so changing it will make no error
-	addrIp := strings.Split(mappedAddr.String(), ":")
-	addrPort := strings.Split(senderConn.LocalAddr().String(), ":")
-	mappedAddr, _ = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%s", addrIp[0], addrPort[1]))
+	mappedAddr := &net.UDPAddr{IP: mappedIp, Port: senderConn.LocalAddr().(*net.UDPAddr).Port}
 
 	// added mappedAddr (without port) to permission list in turn server
 	_, err = relay.RelayConn.WriteTo([]byte("Hello"), mappedAddr)
@@ -311,27 +912,50 @@ func doTrunRequest(req *TrunRequestST) error {
 	}
 
 	timeSend := time.Now()
-	go readAndVerifyDataback(req, relay.RelayConn, timeSend)
+	if req.Bidirectional {
+		err = sendBidirectional(req, relay.RelayConn, mappedAddr, senderConn, relay.RelayConn.LocalAddr(), timeSend)
+
+		drainAfterRotation(req)
+		freeRelayClient(relay)
+		senderConn.Close()
+
+		return err
+	}
+
+	if req.Echo {
+		go echoPackages(req, relay.RelayConn)
+		go readAndVerifyDataback(req, senderConn, timeSend)
+	} else {
+		go readAndVerifyDataback(req, relay.RelayConn, timeSend)
+		if req.Rtp {
+			go readReceiverReports(req, senderConn)
+		}
+	}
 
 	err = sendData(req, senderConn, relay.RelayConn.LocalAddr(), timeSend)
 
-	relay.Client.Close()
+	drainAfterRotation(req)
+	freeRelayClient(relay)
 	senderConn.Close()
 
 	return nil
 }
 
 func doTrunRequest2Cloud(req *TrunRequestST) error {
+	if req.Peers != nil {
+		return doTrunRequestPeer(req, true)
+	}
+
 	relay1, err := allocRelayClient(req)
 	if err != nil {
-		sendErrorRequestResults(req, 200)
+		sendErrorRequestResults(req, allocErrCode(req, err, 200))
 		return err
 	}
 	defer freeRelayClient(relay1)
 
 	relay2, err := allocRelayClient(req)
 	if err != nil {
-		sendErrorRequestResults(req, 201)
+		sendErrorRequestResults(req, allocErrCode(req, err, 201))
 		return err
 	}
 	defer freeRelayClient(relay2)
@@ -351,9 +975,27 @@ func doTrunRequest2Cloud(req *TrunRequestST) error {
 	}
 
 	timeSend := time.Now()
-	go readAndVerifyDataback(req, relay2.RelayConn, timeSend)
+	if req.Bidirectional {
+		err = sendBidirectional(req, relay1.RelayConn, relay2.RelayConn.LocalAddr(), relay2.RelayConn, relay1.RelayConn.LocalAddr(), timeSend)
+		drainAfterRotation(req)
+		relay1.RelayConn.Close()
+		relay2.RelayConn.Close()
+
+		return err
+	}
+
+	if req.Echo {
+		go echoPackages(req, relay2.RelayConn)
+		go readAndVerifyDataback(req, relay1.RelayConn, timeSend)
+	} else {
+		go readAndVerifyDataback(req, relay2.RelayConn, timeSend)
+		if req.Rtp {
+			go readReceiverReports(req, relay1.RelayConn)
+		}
+	}
 
 	err = sendData(req, relay1.RelayConn, relay2.RelayConn.LocalAddr(), timeSend)
+	drainAfterRotation(req)
 	relay1.RelayConn.Close()
 	relay2.RelayConn.Close()
 
@@ -366,5 +1008,10 @@ func TrunRequest(req *TrunRequestST) error {
 
 // PeerA <--> RelayA  <---> RelayB  <---> PeerB
 func TrunRequest2Cloud(req *TrunRequestST) error {
+	if req != nil && (req.PeerCount > 0 || req.DualAllocation) {
+		err := fmt.Errorf("[TrunRequest2Cloud-%d]fan-out and dual allocations run in 1-cloud mode only", req.ChanId)
+		return err
+	}
+
 	return requestWrap(req, doTrunRequest2Cloud)
 }
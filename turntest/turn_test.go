@@ -2,18 +2,42 @@ package turntest
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/pion/logging"
-	"github.com/xylophone21/go-turn-test/testdata"
+	"github.com/pion/stun"
+	"github.com/xylophone21/go-turn-test/impair"
+	"github.com/xylophone21/go-turn-test/statistics"
+	"github.com/xylophone21/go-turn-test/testserver"
 )
 
-func makeTrunRequestST(StunServerAddr string, TurnServerAddr string, Username string, Password string) *TrunRequestST {
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*15)
+const (
+	testUsername = "user"
+	testPassword = "pass"
+	testSecret   = "secret"
+	testKid      = "kid"
+	testMacKey   = "0123456789abcdef"
+)
+
+func startTestServer(t *testing.T) *testserver.Server {
+	return testserver.StartTest(t, &testserver.ServerConfig{
+		Users:      map[string]string{testUsername: testPassword},
+		AuthSecret: testSecret,
+		OAuthKeys:  map[string][]byte{testKid: []byte(testMacKey)},
+	})
+}
+
+func makeTrunRequestST(StunServerAddr string, TurnServerAddr string, Username string, Password string) (*TrunRequestST, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 
 	f := logging.DefaultLoggerFactory{
-		DefaultLogLevel: logging.LogLevelTrace,
+		DefaultLogLevel: logging.LogLevelWarn,
 	}
 	log := f.NewLogger("turn-test")
 
@@ -22,51 +46,397 @@ func makeTrunRequestST(StunServerAddr string, TurnServerAddr string, Username st
 	req.Log = log
 	req.ChanId = 0x1234567890
 	req.PackageSize = 1024
-	req.PackageWait = time.Millisecond * 1000
+	req.PackageWait = time.Millisecond * 20
 	req.StunServerAddr = StunServerAddr
 	req.TurnServerAddr = TurnServerAddr
 	req.Username = Username
 	req.Password = Password
+	req.Ch = make(chan statistics.RequestResults, 1000)
 
 	log.Infof("TurnServerAddr=%s", TurnServerAddr)
 
-	return &req
+	return &req, cancel
+}
+
+// collect runs the request until its context ends and collects the results it reported
+func collect(req *TrunRequestST, run func(req *TrunRequestST) error) testserver.Results {
+	return testserver.Collect(req.Ch, func() { run(req) })
+}
+
+// lastRtt is the round trip time of the last RTP report with one, 0 without
+func lastRtt(results testserver.Results) time.Duration {
+	var rtt time.Duration
+	for _, result := range results {
+		if result.IsRtpReport && result.Rtt > 0 {
+			rtt = result.Rtt
+		}
+	}
+	return rtt
+}
+
+// checkDelivered fails unless most packages went through without errors, closing the relay at the end is none
+func checkDelivered(t *testing.T, results testserver.Results) {
+	t.Logf("%v", results)
+
+	if sent := results.Sent(); sent < 10 || results.Recv() < sent*9/10 {
+		t.Fatalf("too few packages delivered:%v", results)
+	}
+
+	if len(results.ErrCodes()) != 0 {
+		t.Fatalf("unexpected errors:%v", results)
+	}
 }
 
 func TestBasic(t *testing.T) {
-	req := makeTrunRequestST(testdata.BasicStunUrl, testdata.BasicTurnUrl, testdata.BasicTurnUsername, testdata.BasicTurnPassword)
-	TrunRequest(req)
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+	defer cancel()
+
+	checkDelivered(t, collect(req, TrunRequest))
+}
+
+func TestBasicTCP(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.TCPURI(), testUsername, testPassword)
+	defer cancel()
+
+	checkDelivered(t, collect(req, TrunRequest))
+}
+
+func TestBasicTLS(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.TLSURI(), testUsername, testPassword)
+	defer cancel()
+	req.TlsConfig = server.TlsConfig
+
+	checkDelivered(t, collect(req, TrunRequest))
+}
+
+// a server never answering the TLS handshake doesn't hold the allocation past the context
+func TestDialHandshakeCanceled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error:%v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err = dialTurnServer(&TrunRequestST{Ctx: ctx, TurnServerAddr: "turns:" + listener.Addr().String() + "?transport=tcp"})
+	if elapsed := time.Since(start); err == nil || elapsed > time.Second*3 {
+		t.Fatalf("handshake not canceled after %v:%v", elapsed, err)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	server := startTestServer(t)
+
+	for _, profile := range []TrafficProfile{PROFILE_AUDIO, PROFILE_VIDEO, PROFILE_SCREEN} {
+		req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+		req.Profile = profile
+
+		results := collect(req, TrunRequest)
+		cancel()
+
+		t.Logf("%v %v", profile, results)
+		if sent := results.Sent(); sent < 5 || results.Recv() < sent*9/10 || len(results.ErrCodes()) != 0 {
+			t.Fatalf("%v not delivered:%v", profile, results)
+		}
+	}
+}
+
+func TestRtp(t *testing.T) {
+	server := startTestServer(t)
+
+	for _, run := range []func(req *TrunRequestST) error{TrunRequest, TrunRequest2Cloud} {
+		req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+		req.Ctx, cancel = context.WithTimeout(req.Ctx, time.Second*3)
+		req.Profile = PROFILE_VIDEO
+		req.Rtp = true
+
+		results := collect(req, run)
+		cancel()
+
+		// the receiver side reports tell the loss, the sender side ones the round trip time
+		reports, lost := 0, int64(0)
+		for _, result := range results {
+			if result.IsRtpReport {
+				reports++
+				if result.RtpExpected > 0 {
+					lost = result.RtpLost
+				}
+			}
+		}
+
+		t.Logf("%v rtp reports:%d lost:%d rtt:%v", results, reports, lost, lastRtt(results))
+		if sent := results.Sent(); sent < 5 || results.Recv() < sent*9/10 || len(results.ErrCodes()) != 0 {
+			t.Fatalf("not delivered:%v", results)
+		}
+		if reports == 0 || lastRtt(results) <= 0 || lost != 0 {
+			t.Fatalf("bad rtp reports:%d lost:%d rtt:%v", reports, lost, lastRtt(results))
+		}
+	}
+}
+
+func TestEcho(t *testing.T) {
+	server := startTestServer(t)
+
+	for _, run := range []func(req *TrunRequestST) error{TrunRequest, TrunRequest2Cloud} {
+		req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+		req.Echo = true
+		req.Rtp = true
+		req.Impair = &impair.Config{Delay: time.Millisecond * 30}
+
+		results := collect(req, run)
+		cancel()
+
+		var minLatency time.Duration
+		for _, result := range results.Received() {
+			if minLatency == 0 || result.Latency < minLatency {
+				minLatency = result.Latency
+			}
+		}
+
+		// both the sender and the far peer delay their packages
+		t.Logf("%v min latency:%v rtt:%v", results, minLatency, lastRtt(results))
+		if sent := results.Sent(); sent < 10 || results.Recv() < sent*8/10 || len(results.ErrCodes()) != 0 {
+			t.Fatalf("not echoed:%v", results)
+		}
+		if minLatency < time.Millisecond*60 || lastRtt(results) < time.Millisecond*60 {
+			t.Fatalf("latency %v and rtt %v are not round trip times", minLatency, lastRtt(results))
+		}
+	}
+}
+
+func TestBidirectional(t *testing.T) {
+	server := startTestServer(t)
+
+	for _, run := range []func(req *TrunRequestST) error{TrunRequest, TrunRequest2Cloud} {
+		req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+		req.Bidirectional = true
+		req.Rtp = true
+
+		results := collect(req, run)
+		cancel()
+
+		received := results.Received()
+		up := received.Count(func(result *statistics.RequestResults) bool { return result.Direction == DIRECTION_UP })
+		down := received.Count(func(result *statistics.RequestResults) bool { return result.Direction == DIRECTION_DOWN })
+
+		t.Logf("%v up:%d down:%d rtt:%v", results, up, down, lastRtt(results))
+		if sent := results.Sent(); sent < 150 || len(received) < sent*9/10 || len(results.ErrCodes()) != 0 {
+			t.Fatalf("not delivered:%v", results)
+		}
+		if up < 80 || down < 80 || lastRtt(results) <= 0 {
+			t.Fatalf("not delivered both ways, up:%d down:%d rtt:%v", up, down, lastRtt(results))
+		}
+	}
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+	defer cancel()
+	req.Bidirectional = true
+	req.Echo = true
+	if TrunRequest(req) == nil {
+		t.Fatalf("bidirectional echo accepted")
+	}
+}
+
+func TestFanout(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+	defer cancel()
+	req.PeerCount = 8
+
+	results := collect(req, TrunRequest)
+
+	t.Logf("%v", results)
+	if results.Recv() < results.Sent()*9/10 || len(results.ErrCodes()) != 0 {
+		t.Fatalf("not delivered:%v", results)
+	}
+	for peer := 1; peer <= req.PeerCount; peer++ {
+		got := results.Received().Count(func(result *statistics.RequestResults) bool { return result.Peer == peer })
+		if got < 50 {
+			t.Fatalf("peer %d got %d packages", peer, got)
+		}
+	}
+	for _, method := range []string{SETUP_CREATE_PERMISSION, SETUP_CHANNEL_BIND} {
+		setups := results.Count(func(result *statistics.RequestResults) bool { return result.SetupMethod == method })
+		if setups != req.PeerCount {
+			t.Fatalf("%d %s for %d peers", setups, method, req.PeerCount)
+		}
+	}
+
+	// peers behind one public ip share its permission
+	if ip, distinct := fanoutPeerIp(net.ParseIP("127.0.0.1"), 7); !distinct || !ip.Equal(net.ParseIP("127.0.0.8")) {
+		t.Fatalf("loopback peer ip %v", ip)
+	}
+	if ip, distinct := fanoutPeerIp(net.ParseIP("192.0.2.1"), 7); distinct || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("public peer ip %v", ip)
+	}
+
+	if TrunRequest2Cloud(req) == nil {
+		t.Fatalf("2-cloud fan-out accepted")
+	}
+}
+
+func TestBadPassword(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, "wrong")
+	defer cancel()
+
+	results := collect(req, TrunRequest)
+	if results.Recv() != 0 || results.ErrCodes()[100] == 0 {
+		t.Fatalf("allocation should fail, got %v", results)
+	}
+}
+
+func TestRestSecret(t *testing.T) {
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), "", "")
+	defer cancel()
+	req.Credential = RestCredential(testSecret, "alice", time.Hour)
+
+	checkDelivered(t, collect(req, TrunRequest))
+}
+
+func TestOAuth(t *testing.T) {
+	server := startTestServer(t)
+
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request OAuthTokenRequest
+		json.NewDecoder(r.Body).Decode(&request)
+
+		json.NewEncoder(w).Encode(&OAuthToken{
+			AccessToken: base64.StdEncoding.EncodeToString([]byte("token")),
+			TokenType:   "pop",
+			ExpiresIn:   3600,
+			Kid:         testKid,
+			Key:         base64.StdEncoding.EncodeToString([]byte(testMacKey)),
+		})
+	}))
+	defer auth.Close()
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), "", "")
+	defer cancel()
+	req.OAuthUrl = auth.URL
+
+	checkDelivered(t, collect(req, TrunRequest2Cloud))
+
+	// pion answers 400 to unknown keys, a RFC 7635 server answers 401 to expired tokens
+	req, cancel = makeTrunRequestST("", startUnauthorizedServer(t), "", "")
+	defer cancel()
+	req.OAuthUrl = auth.URL
+
+	results := collect(req, TrunRequest)
+	if results.Recv() != 0 || results.ErrCodes()[ERRCODE_TOKEN_EXPIRED] == 0 {
+		t.Fatalf("token should be rejected, got %v", results)
+	}
+}
+
+// startUnauthorizedServer answers every request with 401 and a fresh nonce
+func startUnauthorizedServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket error:%v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if req.Decode() != nil {
+				continue
+			}
+
+			res := stun.MustBuild(stun.NewTransactionIDSetter(req.TransactionID),
+				stun.NewType(req.Type.Method, stun.ClassErrorResponse),
+				stun.CodeUnauthorized, stun.NewNonce("nonce"), stun.NewRealm("realm"))
+			conn.WriteTo(res.Raw, from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
 }
 
 func TestAws(t *testing.T) {
-	awsreq := &RequestBody{
-		DeviceId: testdata.AwsDeviceId,
-		Token:    testdata.AwsToken,
+	awsreq, _ := awsRequestBody(t)
+	ret, err := AllocAwsTurns(awsreq)
+	if err != nil || len(ret.TurnServerAddrs) == 0 {
+		t.Fatalf("AllocAwsTurns error:%v", err)
 	}
+
+	req, cancel := makeTrunRequestST(ret.StunServerAddr, ret.TurnServerAddrs[0].TurnServerAddr, ret.TurnServerAddrs[0].Username, ret.TurnServerAddrs[0].Password)
+	defer cancel()
+
+	checkDelivered(t, collect(req, TrunRequest))
+}
+
+func TestAwsExpired(t *testing.T) {
+	awsreq, provider := awsRequestBody(t)
+	if provider == nil {
+		t.Skip("needs the mock provider")
+	}
+
+	provider.SetReplies(testserver.ProviderReply{Expired: true})
 	ret, err := AllocAwsTurns(awsreq)
-	if err != nil {
-		t.Fail()
+	if err != nil || len(ret.TurnServerAddrs) == 0 {
+		t.Fatalf("AllocAwsTurns error:%v", err)
 	}
 
-	req := makeTrunRequestST(ret.StunServerAddr, ret.TurnServerAddrs[0].TurnServerAddr, ret.TurnServerAddrs[0].Username, ret.TurnServerAddrs[0].Password)
-	TrunRequest(req)
+	// the expired credentials are renewed from the provider before allocating
+	req, cancel := makeTrunRequestST(ret.StunServerAddr, ret.TurnServerAddrs[0].TurnServerAddr, ret.TurnServerAddrs[0].Username, ret.TurnServerAddrs[0].Password)
+	defer cancel()
+	req.Expired = ret.TurnServerAddrs[0].Expired
+	req.Credential = NewAwsCredentialCache(awsreq).Credential(0)
+
+	checkDelivered(t, collect(req, TrunRequest))
+	if provider.Calls() != 2 {
+		t.Fatalf("credentials renewed %d times", provider.Calls()-1)
+	}
 }
 
 func Test2CloudBasic(t *testing.T) {
-	req := makeTrunRequestST(testdata.BasicStunUrl, testdata.BasicTurnUrl, testdata.BasicTurnUsername, testdata.BasicTurnPassword)
-	TrunRequest2Cloud(req)
+	server := startTestServer(t)
+
+	req, cancel := makeTrunRequestST("", server.UDPURI(), testUsername, testPassword)
+	defer cancel()
+
+	checkDelivered(t, collect(req, TrunRequest2Cloud))
 }
 
 func Test2CloudAws(t *testing.T) {
-	awsreq := &RequestBody{
-		DeviceId: testdata.AwsDeviceId,
-		Token:    testdata.AwsToken,
-	}
+	awsreq, _ := awsRequestBody(t)
 	ret, err := AllocAwsTurns(awsreq)
-	if err != nil {
-		t.Fail()
+	if err != nil || len(ret.TurnServerAddrs) == 0 {
+		t.Fatalf("AllocAwsTurns error:%v", err)
 	}
 
-	req := makeTrunRequestST(ret.StunServerAddr, ret.TurnServerAddrs[0].TurnServerAddr, ret.TurnServerAddrs[0].Username, ret.TurnServerAddrs[0].Password)
-	TrunRequest2Cloud(req)
+	req, cancel := makeTrunRequestST(ret.StunServerAddr, ret.TurnServerAddrs[0].TurnServerAddr, ret.TurnServerAddrs[0].Username, ret.TurnServerAddrs[0].Password)
+	defer cancel()
+
+	checkDelivered(t, collect(req, TrunRequest2Cloud))
 }
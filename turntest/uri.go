@@ -0,0 +1,161 @@
+package turntest
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	SCHEME_STUN  = "stun"
+	SCHEME_STUNS = "stuns"
+	SCHEME_TURN  = "turn"
+	SCHEME_TURNS = "turns"
+
+	TRANSPORT_UDP = "udp"
+	TRANSPORT_TCP = "tcp"
+
+	DEFAULT_PORT     = 3478
+	DEFAULT_TLS_PORT = 5349
+)
+
+// IceURI is a parsed stun:/stuns: (RFC 7064) or turn:/turns: (RFC 7065) URI
+type IceURI struct {
+	Scheme    string
+	Host      string // without brackets for IPv6 literals
+	Port      int
+	Transport string // TRANSPORT_UDP or TRANSPORT_TCP, TLS is given by the stuns/turns scheme
+}
+
+// ParseIceURI parses uri like "turn:host:443?transport=tcp", "turns:[::1]" or "stun:host",
+// filling the default port (3478, or 5349 for stuns/turns) and transport (udp, or tcp for stuns/turns)
+func ParseIceURI(uri string) (*IceURI, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &IceURI{
+		Scheme: strings.ToLower(u.Scheme),
+	}
+
+	switch ret.Scheme {
+	case SCHEME_STUN, SCHEME_TURN:
+		ret.Port = DEFAULT_PORT
+		ret.Transport = TRANSPORT_UDP
+
+	case SCHEME_STUNS, SCHEME_TURNS:
+		ret.Port = DEFAULT_TLS_PORT
+		ret.Transport = TRANSPORT_TCP
+
+	default:
+		return nil, fmt.Errorf("unknown scheme %q in %q", u.Scheme, uri)
+	}
+
+	// "turn://host" is not RFC 7065 but some providers hand it out
+	hostPort := u.Opaque
+	if hostPort == "" {
+		hostPort = u.Host
+	}
+
+	ret.Host, ret.Port, err = splitHostPort(hostPort, ret.Port)
+	if err != nil {
+		return nil, fmt.Errorf("%v in %q", err, uri)
+	}
+
+	if transport := u.Query().Get("transport"); transport != "" {
+		ret.Transport = strings.ToLower(transport)
+	}
+
+	if ret.Transport != TRANSPORT_UDP && ret.Transport != TRANSPORT_TCP {
+		return nil, fmt.Errorf("unknown transport %q in %q", ret.Transport, uri)
+	}
+
+	if ret.IsSecure() && ret.Transport == TRANSPORT_UDP {
+		return nil, fmt.Errorf("DTLS is not supported in %q", uri)
+	}
+
+	return ret, nil
+}
+
+// ParseTurnURI parses a TURN server given either as turn:/turns: URI or as plain "host:port"
+func ParseTurnURI(addr string) (*IceURI, error) {
+	if !hasIceScheme(addr) {
+		addr = SCHEME_TURN + ":" + addr
+	}
+	return ParseIceURI(addr)
+}
+
+// ParseStunURI parses a STUN server given either as stun:/stuns: URI or as plain "host:port"
+func ParseStunURI(addr string) (*IceURI, error) {
+	if !hasIceScheme(addr) {
+		addr = SCHEME_STUN + ":" + addr
+	}
+	return ParseIceURI(addr)
+}
+
+func hasIceScheme(addr string) bool {
+	i := strings.Index(addr, ":")
+	if i < 0 {
+		return false
+	}
+
+	switch strings.ToLower(addr[:i]) {
+	case SCHEME_STUN, SCHEME_STUNS, SCHEME_TURN, SCHEME_TURNS:
+		// "turn:3478" is host turn with port 3478
+		_, err := strconv.Atoi(addr[i+1:])
+		return err != nil
+	}
+	return false
+}
+
+// splitHostPort splits "host", "host:port", "[v6]" or "[v6]:port", using defPort when there is no port
+func splitHostPort(hostPort string, defPort int) (string, int, error) {
+	if hostPort == "" {
+		return "", 0, fmt.Errorf("missing host")
+	}
+
+	if strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]") {
+		return hostPort[1 : len(hostPort)-1], defPort, nil
+	}
+
+	switch strings.Count(hostPort, ":") {
+	case 0:
+		return hostPort, defPort, nil
+
+	case 1:
+
+	default:
+		if !strings.HasPrefix(hostPort, "[") {
+			return "", 0, fmt.Errorf("IPv6 literal without brackets")
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("bad port %q", portStr)
+	}
+
+	return host, port, nil
+}
+
+// IsSecure tells if the URI asks for TLS
+func (u *IceURI) IsSecure() bool {
+	return u.Scheme == SCHEME_STUNS || u.Scheme == SCHEME_TURNS
+}
+
+// Addr returns "host:port" to dial
+func (u *IceURI) Addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+func (u *IceURI) String() string {
+	return fmt.Sprintf("%s:%s?transport=%s", u.Scheme, u.Addr(), u.Transport)
+}
@@ -0,0 +1,57 @@
+package turntest
+
+import "testing"
+
+func TestParseIceURI(t *testing.T) {
+	cases := []struct {
+		uri       string
+		scheme    string
+		host      string
+		port      int
+		transport string
+	}{
+		{"turn:example.org", SCHEME_TURN, "example.org", 3478, TRANSPORT_UDP},
+		{"turn:example.org:443?transport=tcp", SCHEME_TURN, "example.org", 443, TRANSPORT_TCP},
+		{"turns:example.org", SCHEME_TURNS, "example.org", 5349, TRANSPORT_TCP},
+		{"turns:example.org:443?transport=tcp", SCHEME_TURNS, "example.org", 443, TRANSPORT_TCP},
+		{"TURN:[2001:db8::1]:3479", SCHEME_TURN, "2001:db8::1", 3479, TRANSPORT_UDP},
+		{"turn:[::1]", SCHEME_TURN, "::1", 3478, TRANSPORT_UDP},
+		{"stun:example.org", SCHEME_STUN, "example.org", 3478, TRANSPORT_UDP},
+		{"stuns:example.org", SCHEME_STUNS, "example.org", 5349, TRANSPORT_TCP},
+		{"turn://example.org:80", SCHEME_TURN, "example.org", 80, TRANSPORT_UDP},
+	}
+
+	for _, c := range cases {
+		u, err := ParseIceURI(c.uri)
+		if err != nil {
+			t.Fatalf("%s error:%v", c.uri, err)
+		}
+
+		if u.Scheme != c.scheme || u.Host != c.host || u.Port != c.port || u.Transport != c.transport {
+			t.Fatalf("%s got %+v", c.uri, u)
+		}
+	}
+
+	for _, uri := range []string{"http:example.org", "turns:example.org?transport=udp", "turn:example.org?transport=sctp", "turn:2001:db8::1", "turn:example.org:0", "turn:"} {
+		if _, err := ParseIceURI(uri); err == nil {
+			t.Fatalf("%s should fail", uri)
+		}
+	}
+}
+
+func TestParseTurnURI(t *testing.T) {
+	u, err := ParseTurnURI("turn.abc.com:3478")
+	if err != nil || u.Scheme != SCHEME_TURN || u.Addr() != "turn.abc.com:3478" {
+		t.Fatalf("plain address error:%v %+v", err, u)
+	}
+
+	u, err = ParseTurnURI("turns:turn.abc.com:443")
+	if err != nil || !u.IsSecure() || u.String() != "turns:turn.abc.com:443?transport=tcp" {
+		t.Fatalf("uri error:%v %+v", err, u)
+	}
+
+	u, err = ParseStunURI("[::1]:3478")
+	if err != nil || u.Scheme != SCHEME_STUN || u.Addr() != "[::1]:3478" {
+		t.Fatalf("plain v6 address error:%v %+v", err, u)
+	}
+}